@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/proxoar/talk/internal"
+	"github.com/spf13/cobra"
+)
+
+func transcribeCommand(configPath *string) *cobra.Command {
+	var provider, model string
+	cmd := &cobra.Command{
+		Use:     "transcribe <audio file>",
+		Short:   "Print the text of an audio file",
+		Example: "  talk transcribe file.mp3 --provider whisper",
+		Args:    cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cli, err := internal.NewCLI(*configPath)
+			if err != nil {
+				return err
+			}
+			ctx, stop := interruptible(cmd)
+			defer stop()
+			text, err := cli.Transcribe(ctx, args[0], provider, model)
+			if err != nil {
+				return err
+			}
+			fmt.Println(text)
+			return nil
+		},
+	}
+	cmd.Flags().StringVarP(&provider, "provider", "p", "", "Key of a speech-to-text provider in config, e.g. whisper")
+	cmd.Flags().StringVarP(&model, "model", "m", "", "Model, or recognizer of google")
+	return cmd
+}
+
+func sayCommand(configPath *string) *cobra.Command {
+	var provider, voice, output string
+	cmd := &cobra.Command{
+		Use:     "say <text>",
+		Short:   "Write the audio of text to a file or stdout",
+		Example: "  talk say \"Hello there\" -o out.mp3 --provider openai --voice alloy",
+		Args:    cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cli, err := internal.NewCLI(*configPath)
+			if err != nil {
+				return err
+			}
+			ctx, stop := interruptible(cmd)
+			defer stop()
+			audio, err := cli.Say(ctx, args[0], provider, voice)
+			if err != nil {
+				return err
+			}
+			if output == "" {
+				_, err = os.Stdout.Write(audio)
+				return err
+			}
+			return os.WriteFile(output, audio, 0o644)
+		},
+	}
+	cmd.Flags().StringVarP(&provider, "provider", "p", "", "Key of a text-to-speech provider in config, e.g. elevenlabs")
+	cmd.Flags().StringVar(&voice, "voice", "", "Voice id, or voice name of openai")
+	cmd.Flags().StringVarP(&output, "output", "o", "", "Path of the audio file, stdout by default")
+	return cmd
+}
+
+func chatCommand(configPath *string) *cobra.Command {
+	var provider, model string
+	cmd := &cobra.Command{
+		Use:     "chat",
+		Short:   "Chat with an LLM in the terminal",
+		Example: "  talk chat --provider claude",
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cli, err := internal.NewCLI(*configPath)
+			if err != nil {
+				return err
+			}
+			ctx, stop := interruptible(cmd)
+			defer stop()
+			return cli.Chat(ctx, os.Stdin, os.Stdout, provider, model)
+		},
+	}
+	cmd.Flags().StringVarP(&provider, "provider", "p", "", "Key of an LLM provider in config, e.g. chat-gpt or openai-compatible/ollama")
+	cmd.Flags().StringVarP(&model, "model", "m", "", "Model, or deployment of azure-chat-gpt")
+	return cmd
+}
+
+// interruptible cancels requests to providers on Ctrl-C, which the server leaves to its default action
+func interruptible(cmd *cobra.Command) (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+}
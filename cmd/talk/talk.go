@@ -1,7 +1,66 @@
 package main
 
-import "github.com/proxoar/talk/internal"
+import (
+	"os"
+
+	"github.com/proxoar/talk/internal"
+	"github.com/spf13/cobra"
+)
 
 func main() {
-	internal.StartServer()
+	var configPath string
+	root := &cobra.Command{
+		Use:   "talk",
+		Short: "Talk to LLMs by voice, serving the web UI by default",
+		Args:  cobra.NoArgs,
+		// `talk --config ./talk.yaml` has served since before there were subcommands
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.StartServer(configPath)
+		},
+		SilenceUsage: true,
+	}
+	root.PersistentFlags().StringVar(&configPath, "config", "",
+		"Path to config file, talk.yaml in /etc/talk, ~/.config/talk, ~/.talk, ~ or . by default")
+
+	root.AddCommand(
+		serveCommand(&configPath),
+		configCommand(&configPath),
+		transcribeCommand(&configPath),
+		sayCommand(&configPath),
+		chatCommand(&configPath),
+	)
+
+	if err := root.Execute(); err != nil {
+		os.Exit(1)
+	}
+}
+
+func serveCommand(configPath *string) *cobra.Command {
+	return &cobra.Command{
+		Use:   "serve",
+		Short: "Serve the API and the web UI",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.StartServer(*configPath)
+		},
+	}
+}
+
+func configCommand(configPath *string) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "Manage the config file",
+	}
+	var live bool
+	validate := &cobra.Command{
+		Use:   "validate",
+		Short: "Report mistakes in the config file",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return internal.ValidateConfig(*configPath, live)
+		},
+	}
+	validate.Flags().BoolVar(&live, "live", false, "Check each credential with a request to its provider")
+	cmd.AddCommand(validate)
+	return cmd
 }
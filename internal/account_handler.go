@@ -0,0 +1,200 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/proxoar/talk/internal/api"
+	"github.com/proxoar/talk/internal/config"
+	"github.com/proxoar/talk/internal/middleware"
+	"github.com/proxoar/talk/internal/storage"
+	"go.uber.org/zap"
+)
+
+const defaultSessionTTL = 30 * 24 * time.Hour
+
+// AccountHandler serves login, personal API tokens of each user, and user management for admins
+type AccountHandler struct {
+	storage    *storage.Storage
+	sessionTTL time.Duration
+	logger     *zap.Logger
+}
+
+func NewAccountHandler(storage *storage.Storage, c config.AccountsConfig, logger *zap.Logger) *AccountHandler {
+	ttl := c.SessionTTL
+	if ttl <= 0 {
+		ttl = defaultSessionTTL
+	}
+	return &AccountHandler{
+		storage:    storage,
+		sessionTTL: ttl,
+		logger:     logger,
+	}
+}
+
+// Bootstrap creates the admin in config if there is no user, and deletes expired tokens
+func (h *AccountHandler) Bootstrap(ctx context.Context, admin config.AdminConfig) error {
+	if err := h.storage.DeleteExpiredTokens(ctx); err != nil {
+		return err
+	}
+	users, err := h.storage.Users(ctx)
+	if err != nil {
+		return err
+	}
+	if len(users) > 0 {
+		return nil
+	}
+	if admin.Name == "" || admin.Password == "" {
+		h.logger.Warn("there is no user, set server.accounts.admin to create an admin")
+		return nil
+	}
+	if _, err = h.storage.CreateUser(ctx, admin.Name, admin.Password, true); err != nil {
+		return err
+	}
+	h.logger.Sugar().Info("admin is created: ", admin.Name)
+	return nil
+}
+
+// Login issues a session token
+func (h *AccountHandler) Login(c echo.Context) error {
+	login := new(api.Login)
+	if err := bindValid(c, login); err != nil {
+		return err
+	}
+	ctx := c.Request().Context()
+	u, err := h.storage.Authenticate(ctx, login.Name, login.Password)
+	if err != nil {
+		return accountError(err)
+	}
+	secret, t, err := h.storage.CreateToken(ctx, u.Id, storage.TokenSession, c.Request().UserAgent(), h.sessionTTL)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, api.LoginResult{Token: secret, ExpiresAt: t.ExpiresAt, User: u})
+}
+
+// Logout revokes the token of the request
+func (h *AccountHandler) Logout(c echo.Context) error {
+	u, _ := middleware.UserOf(c)
+	t := c.Get(middleware.TokenKey).(storage.Token)
+	if err := h.storage.RevokeToken(c.Request().Context(), u.Id, t.Id); err != nil {
+		return accountError(err)
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+func (h *AccountHandler) Me(c echo.Context) error {
+	u, _ := middleware.UserOf(c)
+	return c.JSON(http.StatusOK, u)
+}
+
+// ChangePassword replaces the password of the user, which logs the user out everywhere
+func (h *AccountHandler) ChangePassword(c echo.Context) error {
+	cp := new(api.ChangePassword)
+	if err := bindValid(c, cp); err != nil {
+		return err
+	}
+	ctx := c.Request().Context()
+	u, _ := middleware.UserOf(c)
+	if _, err := h.storage.Authenticate(ctx, u.Name, cp.OldPassword); err != nil {
+		return accountError(err)
+	}
+	if err := h.storage.SetPassword(ctx, u.Id, cp.NewPassword); err != nil {
+		return accountError(err)
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+// ListTokens lists personal API tokens of the user, secrets are not included
+func (h *AccountHandler) ListTokens(c echo.Context) error {
+	u, _ := middleware.UserOf(c)
+	tokens, err := h.storage.Tokens(c.Request().Context(), u.Id, storage.TokenAPI)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, tokens)
+}
+
+// CreateToken creates a personal API token, whose secret is replied only once
+func (h *AccountHandler) CreateToken(c echo.Context) error {
+	nt := new(api.NewToken)
+	if err := bindValid(c, nt); err != nil {
+		return err
+	}
+	u, _ := middleware.UserOf(c)
+	ttl := time.Duration(nt.ExpiresInDays) * 24 * time.Hour
+	secret, t, err := h.storage.CreateToken(c.Request().Context(), u.Id, storage.TokenAPI, nt.Name, ttl)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusCreated, api.CreatedToken{Token: t, Secret: secret})
+}
+
+func (h *AccountHandler) RevokeToken(c echo.Context) error {
+	u, _ := middleware.UserOf(c)
+	if err := h.storage.RevokeToken(c.Request().Context(), u.Id, c.Param("tokenId")); err != nil {
+		return accountError(err)
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+// ListUsers is for admins
+func (h *AccountHandler) ListUsers(c echo.Context) error {
+	users, err := h.storage.Users(c.Request().Context())
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, users)
+}
+
+// CreateUser is for admins
+func (h *AccountHandler) CreateUser(c echo.Context) error {
+	nu := new(api.NewUser)
+	if err := bindValid(c, nu); err != nil {
+		return err
+	}
+	u, err := h.storage.CreateUser(c.Request().Context(), nu.Name, nu.Password, nu.Admin)
+	if err != nil {
+		return accountError(err)
+	}
+	return c.JSON(http.StatusCreated, u)
+}
+
+// DeleteUser is for admins, who can't delete themselves
+func (h *AccountHandler) DeleteUser(c echo.Context) error {
+	me, _ := middleware.UserOf(c)
+	userId := c.Param("userId")
+	if userId == me.Id {
+		return echo.NewHTTPError(http.StatusBadRequest, "can't delete yourself")
+	}
+	if err := h.storage.DeleteUser(c.Request().Context(), userId); err != nil {
+		return accountError(err)
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+func bindValid(c echo.Context, v interface{}) error {
+	if err := c.Bind(v); err != nil {
+		return err
+	}
+	if err := api.RestfulValidator.Struct(v); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return nil
+}
+
+func accountError(err error) error {
+	switch {
+	case errors.Is(err, storage.ErrInvalidCredentials):
+		return echo.NewHTTPError(http.StatusUnauthorized, "wrong name or password")
+	case errors.Is(err, storage.ErrNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, "user or token is not found")
+	case errors.Is(err, storage.ErrConflict):
+		return echo.NewHTTPError(http.StatusConflict, "user name has been taken")
+	default:
+		return err
+	}
+}
@@ -1,13 +1,21 @@
 package api
 
-import "github.com/proxoar/talk/pkg/client"
+import (
+	"time"
+
+	"github.com/proxoar/talk/pkg/client"
+)
 
 const (
-	EventMessageThinking    = "message/thinking"
-	EventMessageTextTyping  = "message/text/typing"
-	EventMessageTextEOF     = "message/text/EOF"
-	EventMessageAudio       = "message/audio"
-	EventMessageError       = "message/error"
+	EventMessageThinking   = "message/thinking"
+	EventMessageTextTyping = "message/text/typing"
+	EventMessageTextEOF    = "message/text/EOF"
+	EventMessageAudio      = "message/audio"
+	EventMessageError      = "message/error"
+	// EventMessageQuotaExceeded is sent instead of EventMessageError if a step is refused by quotas
+	EventMessageQuotaExceeded = "message/error/quota"
+	// EventMessageCancelled is sent once a ticket is cancelled by client, events of the ticket afterwards should be ignored
+	EventMessageCancelled   = "message/cancelled"
 	EventSystemAbility      = "system/ability"
 	EventSystemNotification = "system/notification"
 	EventSystemKeepAlive    = ""
@@ -35,15 +43,68 @@ type MessageMeta struct {
 type Text struct {
 	MessageMeta
 	Text string `json:"text"`
+	// Replace is true if Text replaces all the text typed so far, e.g. an interim transcription may be revised
+	Replace bool `json:"replace,omitempty"`
 }
 
 type Audio struct {
 	MessageMeta
 	Audio      []byte `json:"audio"`
 	DurationMs int    `json:"durationMs,omitempty"`
+	// Seq is the index of the chunk in a message, starting from 0.
+	// A message has a single chunk unless TalkOption.SentenceToSpeech is on
+	Seq int `json:"seq"`
+	// Final marks the last chunk of a message, whose Audio may be empty
+	Final bool `json:"final"`
 }
 
 type Error struct {
 	MessageMeta
+	Kind   string `json:"kind,omitempty"` // the failed step: llm, text-to-speech or speech-to-text
 	ErrMsg string `json:"errMsg"`
 }
+
+// QuotaExceeded
+// is sent when a step is refused since the quota of the user is exceeded, client can retry after ResetAt
+type QuotaExceeded struct {
+	MessageMeta
+	Quota   string    `json:"quota"` // requests, llm-tokens, tts-characters or stt-seconds
+	Limit   int64     `json:"limit"`
+	Used    int64     `json:"used"`
+	ResetAt time.Time `json:"resetAt"`
+	ErrMsg  string    `json:"errMsg"`
+}
+
+type Notification struct {
+	Level   string `json:"level"` // info, warn or error
+	Message string `json:"message"`
+}
+
+// ProviderFallback is sent when a provider fails and a message is served by another provider in the fallback chain
+type ProviderFallback struct {
+	MessageMeta
+	Notification
+	Kind string `json:"kind"` // llm, text-to-speech or speech-to-text
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// ProviderStatus is the result of the latest health check of a provider
+type ProviderStatus struct {
+	Kind string `json:"kind"` // llm, text-to-speech or speech-to-text
+	Name string `json:"name"`
+	client.Health
+	CheckedAt time.Time `json:"checkedAt"`
+}
+
+// ProviderStatusChanged is sent to every client when a health check finds that the status of a provider has changed
+type ProviderStatusChanged struct {
+	Notification
+	ProviderStatus
+}
+
+// Cancelled is sent with EventMessageCancelled
+type Cancelled struct {
+	ChatId   string `json:"chatId"`
+	TicketId string `json:"ticketId"`
+}
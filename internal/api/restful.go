@@ -1,7 +1,10 @@
 package api
 
 import (
+	"time"
+
 	"github.com/go-playground/validator/v10"
+	"github.com/proxoar/talk/internal/storage"
 	"github.com/proxoar/talk/pkg/ability"
 	"github.com/proxoar/talk/pkg/client"
 )
@@ -24,7 +27,67 @@ type TalkOption struct {
 	ToSpeech           bool               `json:"toSpeech"`           // synthesize user's text to speech, requiring TTSOption
 	Completion         bool               `json:"completion"`         // completion, requires messages or result of transcription, require LLMOption
 	CompletionToSpeech bool               `json:"completionToSpeech"` // synthesize result of completion to speech, requiring TTSOption
+	SentenceToSpeech   bool               `json:"sentenceToSpeech"`   // synthesize completion sentence by sentence while it's streaming, requiring CompletionToSpeech
 	LLMOption          *ability.LLMOption `json:"llmOption,omitempty"`
 	STTOption          *ability.STTOption `json:"sttOption,omitempty"`
 	TTSOption          *ability.TTSOption `json:"ttsOption,omitempty"`
 }
+
+type RenameChat struct {
+	Title string `json:"title" validate:"required"`
+}
+
+type RecordedChat struct {
+	storage.Chat
+	Messages []storage.Message `json:"messages"`
+}
+
+// ChatResult is the response of POST /api/chat/sync and /api/audio-chat/sync, which collects the events
+// of a chat into one document
+type ChatResult struct {
+	ChatId        string `json:"chatId"`
+	TicketId      string `json:"ticketId"`
+	Transcription string `json:"transcription,omitempty"` // transcription of user's voice
+	Completion    string `json:"completion,omitempty"`
+	// UserAudio is speech of user's text, see TalkOption.ToSpeech
+	UserAudio []byte `json:"userAudio,omitempty"`
+	// Audio is speech of completion, whose chunks are joined in order if TalkOption.SentenceToSpeech is on
+	Audio     []byte             `json:"audio,omitempty"`
+	Errors    []Error            `json:"errors,omitempty"`
+	Fallbacks []ProviderFallback `json:"fallbacks,omitempty"`
+	// QuotaExceeded is set if a step is refused by quotas
+	QuotaExceeded *QuotaExceeded `json:"quotaExceeded,omitempty"`
+}
+
+type Login struct {
+	Name     string `json:"name" validate:"required"`
+	Password string `json:"password" validate:"required"`
+}
+
+type LoginResult struct {
+	Token     string       `json:"token"` // session token, sent as Authorization: Bearer <token>
+	ExpiresAt time.Time    `json:"expiresAt"`
+	User      storage.User `json:"user"`
+}
+
+type NewUser struct {
+	Name     string `json:"name" validate:"required"`
+	Password string `json:"password" validate:"min=8"`
+	Admin    bool   `json:"admin"`
+}
+
+type ChangePassword struct {
+	OldPassword string `json:"oldPassword" validate:"required"`
+	NewPassword string `json:"newPassword" validate:"min=8"`
+}
+
+type NewToken struct {
+	Name          string `json:"name" validate:"required"`
+	ExpiresInDays int    `json:"expiresInDays" validate:"min=0"` // the token never expires if it's 0
+}
+
+// CreatedToken carries the secret of a token, which is shown only once
+type CreatedToken struct {
+	storage.Token
+	Secret string `json:"secret"`
+}
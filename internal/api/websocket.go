@@ -0,0 +1,59 @@
+package api
+
+/*
+WebSocket carries the same events as SSE, along with requests from client, over a single connection.
+
+Text frames are JSON:
+
+	server -> client: WSEvent, e.g. {"event": "message/text/typing", "data": {...}}
+	client -> server: WSRequest, e.g. {"type": "chat", "chat": {...}} or {"type": "cancel", "ticketId": "..."}
+
+Binary frames carry audio, which is prefixed by a JSON header and its length:
+
+	| header length, uint32 big-endian | header, JSON | audio |
+
+	server -> client: header is WSEvent of EventMessageAudio, whose Audio.Audio is omitted
+	client -> server: header is WSAudioChat, the same as the form of POST /api/audio-chat,
+	                  or WSAudioChunk, which is a chunk of audio that is still being recorded
+
+Audio can be sent while it's being recorded, so that it's transcribed as it arrives and interim transcripts
+are emitted as EventMessageTextTyping with Text.Replace set:
+
+	{"type": "audio-start", "chat": {...}, "fileName": "audio.webm"}
+	binary frames of WSAudioChunk, e.g. {"type": "audio-chunk", "ticketId": "..."}
+	{"type": "audio-end", "ticketId": "..."}
+*/
+
+const (
+	WSRequestChat       = "chat"
+	WSRequestCancel     = "cancel"
+	WSRequestAudioStart = "audio-start"
+	WSRequestAudioEnd   = "audio-end"
+	WSAudioChunkType    = "audio-chunk"
+)
+
+type WSEvent struct {
+	Event string      `json:"event"`
+	Data  interface{} `json:"data"`
+}
+
+type WSRequest struct {
+	Type     string `json:"type" validate:"oneof=chat cancel audio-start audio-end"`
+	Chat     *Chat  `json:"chat,omitempty" validate:"required_if=Type chat,required_if=Type audio-start"`
+	TicketId string `json:"ticketId,omitempty" validate:"required_if=Type cancel,required_if=Type audio-end"`
+	// FileName is the file name of audio of audio-start, see WSAudioChat
+	FileName string `json:"fileName,omitempty" validate:"required_if=Type audio-start"`
+}
+
+type WSAudioChat struct {
+	// Type is empty
+	Type     string `json:"type,omitempty"`
+	Chat     Chat   `json:"chat"`
+	FileName string `json:"fileName" validate:"required"` // e.g. audio.webm, providers tell the format by the extension
+}
+
+// WSAudioChunk is a chunk of audio of the chat started by audio-start with the same ticket id
+type WSAudioChunk struct {
+	Type     string `json:"type" validate:"eq=audio-chunk"`
+	TicketId string `json:"ticketId" validate:"required"`
+}
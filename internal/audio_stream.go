@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/proxoar/talk/pkg/client"
+)
+
+// a stream of audio can't be longer than audio sent in one message, since all of it is kept for storage
+const maxStreamedAudio = wsMaxMessageSize
+
+var errAudioTooLarge = fmt.Errorf("audio exceeds %d bytes", maxStreamedAudio)
+
+// audioStream
+// is an io.Reader of audio that is still being recorded. Chunks are written as they arrive from client,
+// and Read blocks until there is data or the stream is closed.
+type audioStream struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	buf    bytes.Buffer
+	closed bool
+	err    error
+	// written counts bytes of all chunks, which is capped by maxStreamedAudio
+	written int
+}
+
+func newAudioStream() *audioStream {
+	s := &audioStream{}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// Write never blocks, so that a slow speech-to-text provider doesn't hold up the connection.
+// The stream is closed with an error once it exceeds maxStreamedAudio.
+func (s *audioStream) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if s.written+len(p) > maxStreamedAudio {
+		s.closed, s.err = true, errAudioTooLarge
+		s.cond.Broadcast()
+		return 0, errAudioTooLarge
+	}
+	s.written += len(p)
+	n, _ := s.buf.Write(p)
+	s.cond.Broadcast()
+	return n, nil
+}
+
+// Close ends the stream. Read returns err once buffered data is drained, or io.EOF if err is nil.
+// Only the first call takes effect.
+func (s *audioStream) Close(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	if err == nil {
+		err = io.EOF
+	}
+	s.closed, s.err = true, err
+	s.cond.Broadcast()
+}
+
+func (s *audioStream) Read(p []byte) (int, error) {
+	return s.ReadContext(context.Background(), p)
+}
+
+// ReadContext implements client.ContextReader
+func (s *audioStream) ReadContext(ctx context.Context, p []byte) (int, error) {
+	stop := context.AfterFunc(ctx, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.cond.Broadcast()
+	})
+	defer stop()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.buf.Len() == 0 && !s.closed && ctx.Err() == nil {
+		s.cond.Wait()
+	}
+	if s.buf.Len() > 0 {
+		return s.buf.Read(p)
+	}
+	if s.closed {
+		return 0, s.err
+	}
+	return 0, ctx.Err()
+}
+
+// audioTee is io.TeeReader that keeps ReadContext of r, see client.ContextReader
+type audioTee struct {
+	r io.Reader
+	w io.Writer
+}
+
+func (t *audioTee) Read(p []byte) (int, error) {
+	return t.ReadContext(context.Background(), p)
+}
+
+func (t *audioTee) ReadContext(ctx context.Context, p []byte) (int, error) {
+	n, err := client.ReadContext(ctx, t.r, p)
+	if n > 0 {
+		if n, err := t.w.Write(p[:n]); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,189 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/proxoar/talk/internal/api"
+	"github.com/proxoar/talk/internal/storage"
+	"github.com/proxoar/talk/pkg/ability"
+	"github.com/proxoar/talk/pkg/client"
+	"go.uber.org/zap"
+)
+
+// streamingSTT transcribes the first chunk of audio it reads, and returns without waiting for the end of audio,
+// as a provider does once it detects the end of an utterance
+type streamingSTT struct{}
+
+func (streamingSTT) StreamingSpeechToText(ctx context.Context, audio io.Reader, _ string, _ ability.STTOption,
+	_ func(client.Transcript)) (string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	first := make(chan string, 1)
+	sent := make(chan struct{})
+	defer func() {
+		cancel()
+		<-sent
+	}()
+	go func() {
+		defer close(sent)
+		buf := make([]byte, 64)
+		for i := 0; ; i++ {
+			n, err := client.ReadContext(ctx, audio, buf)
+			if i == 0 {
+				first <- string(buf[:n])
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return <-first, nil
+}
+
+func (streamingSTT) SpeechToText(_ context.Context, audio io.Reader, _ string, _ ability.STTOption) (string, error) {
+	b, err := io.ReadAll(audio)
+	return string(b), err
+}
+
+func (streamingSTT) CheckHealth(_ context.Context) client.Health {
+	return client.Healthy()
+}
+
+func (streamingSTT) SetAbility(_ context.Context, _ *ability.STTAblt) error {
+	return nil
+}
+
+func (streamingSTT) Support(_ ability.STTOption) bool {
+	return true
+}
+
+// textPublisher keeps the transcription that is published
+type textPublisher struct {
+	mu   sync.Mutex
+	text *api.Text
+}
+
+func (p *textPublisher) PublishData(_, event string, data interface{}) {
+	if t, ok := data.(api.Text); ok && event == api.EventMessageTextEOF {
+		p.mu.Lock()
+		p.text = &t
+		p.mu.Unlock()
+	}
+}
+
+func TestToTextStreaming(t *testing.T) {
+	store, err := storage.Open(filepath.Join(t.TempDir(), "talk.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = store.Close() }()
+
+	talker := &Talker{logger: zap.NewNop()}
+	talker.set.Store(&providerSet{sstProviders: []client.SpeechToText{streamingSTT{}}})
+	o := api.TalkOption{STTOption: &ability.STTOption{Google: &ability.GoogleSTTOption{}}}
+	pub := &textPublisher{}
+	h := NewChatHandler("stream", "chat", "alice", "ticket", o, pub, talker, NewTickets(), store, nil, zap.NewNop())
+	defer h.done()
+
+	audio := newAudioStream()
+	_, _ = audio.Write([]byte("hello"))
+	type result struct {
+		text string
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		text, err := h.toText(h.ctx, AudioReader{Reader: audio, FileName: "voice.webm", Streaming: true}, client.RoleUser)
+		done <- result{text, err}
+	}()
+	// transcription ends before audio does
+	select {
+	case r := <-done:
+		if r.err != nil || r.text != "hello" {
+			t.Fatalf("toText() = %q, %v, want %q", r.text, r.err, "hello")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("toText() waits for the end of audio")
+	}
+
+	// the rest of audio is kept along with what the provider has read
+	for _, chunk := range []string{" there", ", how", " are you"} {
+		_, _ = audio.Write([]byte(chunk))
+	}
+	audio.Close(nil)
+	pub.mu.Lock()
+	meta := pub.text.MessageMeta
+	pub.mu.Unlock()
+	want := []byte("hello there, how are you")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got, err := store.Audio(context.Background(), "alice", meta.ChatId, meta.MessageID, 0)
+		if err == nil && bytes.Equal(got, want) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("saved audio = %q, %v, want %q", got, err, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAudioStream(t *testing.T) {
+	large := bytes.Repeat([]byte("a"), maxStreamedAudio)
+	tests := []struct {
+		name     string
+		chunks   [][]byte
+		close    bool
+		closeErr error
+		// late chunks are written after the stream is closed
+		late     [][]byte
+		wantData []byte
+		wantErr  error
+	}{
+		{name: "ended", chunks: [][]byte{[]byte("ab"), []byte("cd")}, close: true, wantData: []byte("abcd"), wantErr: io.EOF},
+		{name: "cancelled", chunks: [][]byte{[]byte("ab")}, close: true, closeErr: context.Canceled, wantData: []byte("ab"), wantErr: context.Canceled},
+		{name: "written after close", chunks: [][]byte{[]byte("ab")}, close: true, late: [][]byte{[]byte("cd")}, wantData: []byte("ab"), wantErr: io.EOF},
+		{name: "still recording", chunks: [][]byte{[]byte("ab")}, wantData: []byte("ab"), wantErr: context.DeadlineExceeded},
+		{name: "too large", chunks: [][]byte{large, []byte("b")}, late: [][]byte{[]byte("c")}, wantData: large, wantErr: errAudioTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newAudioStream()
+			for _, c := range tt.chunks {
+				_, _ = s.Write(c)
+			}
+			if tt.close {
+				s.Close(tt.closeErr)
+			}
+			for _, c := range tt.late {
+				if n, err := s.Write(c); n != 0 || err == nil {
+					t.Errorf("Write() after close = %d, %v, want an error", n, err)
+				}
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			var got []byte
+			buf := make([]byte, 64<<10)
+			for {
+				n, err := s.ReadContext(ctx, buf)
+				got = append(got, buf[:n]...)
+				if err != nil {
+					if !errors.Is(err, tt.wantErr) {
+						t.Errorf("ReadContext() error = %v, want %v", err, tt.wantErr)
+					}
+					break
+				}
+			}
+			if !bytes.Equal(got, tt.wantData) {
+				t.Errorf("read %d bytes, want %d", len(got), len(tt.wantData))
+			}
+		})
+	}
+}
@@ -50,3 +50,9 @@ func (s *talkCache) GetAbility() (ability.Ability, bool) {
 		return ability.Ability{}, false
 	}
 }
+
+// DeleteAbility makes the next GetAbility miss, e.g. once providers are reloaded
+func (s *talkCache) DeleteAbility() {
+	s.cache.Delete(abilityKey)
+	s.logger.Sugar().Debug("delete ability from cache")
+}
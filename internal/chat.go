@@ -1,43 +1,77 @@
 package internal
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
+	"sync"
+	"time"
+	"unicode/utf8"
 
 	. "github.com/proxoar/talk/internal/api"
+	"github.com/proxoar/talk/internal/metrics"
+	"github.com/proxoar/talk/internal/storage"
+	"github.com/proxoar/talk/internal/tracing"
 	"github.com/proxoar/talk/internal/util"
+	"github.com/proxoar/talk/pkg/ability"
 	"github.com/proxoar/talk/pkg/client"
+	"github.com/proxoar/talk/pkg/providers"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
 type ChatHandler struct {
 	streamId string
 	chatId   string
+	// owner is the identity key of the sender, who owns the recorded chat
+	owner    string
 	ticketId string
 	o        TalkOption
-	sse      *SSE
+	pub      Publisher
 	talker   *Talker
-	logger   *zap.Logger
+	// storage is nil if persistence is disabled
+	storage *storage.Storage
+	// quota is nil if no limit applies to the user
+	quota *Quota
+	// ctx is the context of the ticket, which is done once the ticket is cancelled, see Tickets
+	ctx context.Context
+	// done must be called once the ticket finishes
+	done   func()
+	logger *zap.Logger
 }
 
+// NewChatHandler registers the ticket, which is finished by Start, so Start must be called for each handler
 func NewChatHandler(
 	streamId string,
 	chatId string,
+	owner string,
 	ticketId string,
 	o TalkOption,
-	sse *SSE,
+	pub Publisher,
 	talker *Talker,
+	tickets *Tickets,
+	storage *storage.Storage,
+	quota *Quota,
 	logger *zap.Logger,
 ) *ChatHandler {
+	// the ticket is registered before the request is answered, so that client can cancel it right away,
+	// even if Start runs in another goroutine that hasn't been scheduled yet
+	ctx, done := tickets.Register(streamId, chatId, ticketId)
 	return &ChatHandler{
 		streamId: streamId,
 		chatId:   chatId,
+		owner:    owner,
 		ticketId: ticketId,
 		o:        o,
-		sse:      sse,
-		talker:   talker,
+		pub:      pub,
+		talker:   talker.Pinned(), // a reload of config doesn't affect tickets that have started
+		storage:  storage,
+		quota:    quota,
+		ctx:      ctx,
+		done:     done,
 		logger:   logger,
 	}
 }
@@ -62,9 +96,31 @@ Start
 	          |
 	          v
 	        client
+
+	if SentenceToSpeech is on, [toSpeech] is replaced by a speechPipeline, which synthesizes each sentence
+	as soon as [completion] finishes typing it, and sends audio to client chunk by chunk
+
+	the pipeline stops as soon as the ticket is cancelled by client
+
+	if a provider fails with a retryable error, the next provider in the fallback chain serves the step instead,
+	unless the step has sent any output to client
+
+	each step is refused with EventMessageQuotaExceeded if it would exceed the quota of the user
 */
 func (c *ChatHandler) Start(ms []client.Message, ar *AudioReader) {
-	ctx := context.Background()
+	defer c.done()
+	ctx, span := tracing.Start(c.ctx, "chat",
+		attribute.String("ticket.id", c.ticketId),
+		attribute.String("chat.id", c.chatId),
+		attribute.String("stream.id", c.streamId),
+	)
+	defer span.End()
+	if c.refusedByQuota(ctx, MessageMeta{ChatId: c.chatId, TicketId: c.ticketId}, c.quota.Take(ctx, quotaRequests, 1)) {
+		return
+	}
+	// the ticket must not finish before speech of user's text, otherwise its context is cancelled
+	var wg sync.WaitGroup
+	defer wg.Wait()
 	if ar != nil {
 		if c.o.ToText {
 			text, err := c.toText(ctx, *ar, client.RoleUser)
@@ -79,25 +135,50 @@ func (c *ChatHandler) Start(ms []client.Message, ar *AudioReader) {
 			c.logger.Warn("if audio is not uploaded, ms should not be empty and the last message should have Role==RoleUser")
 			return
 		}
+		text := ms[len(ms)-1].Content
+		messageId := util.RandomHash16Chars()
+		c.record(func(s *storage.Storage) error {
+			return s.SaveMessage(context.Background(), c.owner, c.storageMessage(messageId, client.RoleUser, text, false))
+		})
 		if c.o.ToSpeech {
-			go func() { c.toSpeech(ctx, ms[len(ms)-1].Content, client.RoleUser) }()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				c.toSpeech(ctx, text, client.RoleUser, messageId)
+			}()
 		}
 	}
 
 	if c.o.Completion {
-		text, err := c.completion(ctx, ms, client.RoleAssistant)
+		meta := c.newMeta(client.RoleAssistant)
+		var speech *speechPipeline
+		if c.o.CompletionToSpeech && c.o.SentenceToSpeech {
+			speech = c.newSpeechPipeline(ctx, client.RoleAssistant, meta.MessageID)
+		}
+		text, err := c.completion(ctx, ms, meta, speech)
 		if err != nil {
+			if speech != nil {
+				speech.Abort()
+			}
 			c.logger.Sugar().Error("got empty text from completion, ", err)
 			return
 		}
 
-		if c.o.CompletionToSpeech {
-			c.toSpeech(ctx, text, client.RoleAssistant)
+		if speech != nil {
+			speech.Close()
+		} else if c.o.CompletionToSpeech {
+			c.toSpeech(ctx, text, client.RoleAssistant, meta.MessageID)
 		}
 	}
 }
 
-func (c *ChatHandler) toSpeech(ctx context.Context, text string, role client.Role) {
+// toSpeech
+// the audio is recorded as audio of message textMessageId, whose text is synthesized
+func (c *ChatHandler) toSpeech(ctx context.Context, text string, role client.Role, textMessageId string) {
+	ctx, span := tracing.Start(ctx, "toSpeech", attribute.String("role", string(role)))
+	var err error
+	defer func() { tracing.End(span, err) }()
+
 	meta := MessageMeta{
 		ChatId:    c.chatId,
 		TicketId:  c.ticketId,
@@ -107,32 +188,50 @@ func (c *ChatHandler) toSpeech(ctx context.Context, text string, role client.Rol
 
 	tts, ok := c.talker.SelectTTSProvider(c.o.TTSOption)
 	if !ok {
-		c.sse.PublishData(c.streamId, EventMessageError, Error{
-			MessageMeta: meta,
-			ErrMsg:      "No text-to-speech providers are available"},
-		)
+		c.publishError(ctx, meta, kindTTS, "No text-to-speech providers are available")
 		return
 	}
 
-	go func() { c.sse.PublishData(c.streamId, EventMessageThinking, meta) }()
+	speakable := util.RemoveCodeFromText(text)
+	chars := int64(utf8.RuneCountInString(speakable))
+	span.SetAttributes(attribute.Int64("characters", chars))
+	if err = c.quota.Take(ctx, quotaTTSCharacters, chars); c.refusedByQuota(ctx, meta, err) {
+		return
+	}
+
+	go func() { c.pub.PublishData(c.streamId, EventMessageThinking, meta) }()
 
-	audio, err := tts.TextToSpeech(ctx, util.RemoveCodeFromText(text), text, *c.o.TTSOption)
+	var audio []byte
+	first := Fallback[client.TextToSpeech, ability.TTSOption]{Name: ttsOptionName(*c.o.TTSOption), Provider: tts, Option: *c.o.TTSOption}
+	served, err := withFallback(ctx, c, meta, kindTTS, first, c.ttsFallbacks,
+		func(f Fallback[client.TextToSpeech, ability.TTSOption]) (bool, error) {
+			var err error
+			audio, err = f.Provider.TextToSpeech(ctx, speakable, text, f.Option)
+			return false, err
+		})
 	if err != nil {
+		c.quota.Refund(ctx, quotaTTSCharacters, chars)
 		c.logger.Sugar().Error(err)
-		c.sse.PublishData(c.streamId, EventMessageError, Error{
-			MessageMeta: meta,
-			ErrMsg:      fmt.Sprintf("Empty content from text-to-speech sever: \n%s", err)},
-		)
+		c.publishError(ctx, meta, kindTTS, fmt.Sprintf("Empty content from text-to-speech sever: \n%s", err))
 		return
 	}
+	metrics.AddTTSCharacters(served.Name, chars)
 
-	c.sse.PublishData(c.streamId, EventMessageAudio, Audio{
+	c.pub.PublishData(c.streamId, EventMessageAudio, Audio{
 		MessageMeta: meta,
 		Audio:       audio,
+		Seq:         0,
+		Final:       true,
+	})
+	c.record(func(s *storage.Storage) error {
+		return s.SaveAudio(context.Background(), textMessageId, 0, audio)
 	})
 }
 
-func (c *ChatHandler) toText(ctx context.Context, ar AudioReader, role client.Role) (string, error) {
+func (c *ChatHandler) toText(ctx context.Context, ar AudioReader, role client.Role) (_ string, err error) {
+	ctx, span := tracing.Start(ctx, "toText", attribute.Bool("streaming", ar.Streaming))
+	defer func() { tracing.End(span, err) }()
+
 	meta := MessageMeta{
 		ChatId:    c.chatId,
 		TicketId:  c.ticketId,
@@ -143,83 +242,242 @@ func (c *ChatHandler) toText(ctx context.Context, ar AudioReader, role client.Ro
 	stt, ok := c.talker.SelectSTTProvider(c.o.STTOption)
 	if !ok {
 		eMsg := "No speech-to-text providers are available"
-		c.sse.PublishData(c.streamId, EventMessageError, Error{
-			MessageMeta: meta,
-			ErrMsg:      eMsg},
-		)
+		c.publishError(ctx, meta, kindSTT, eMsg)
 		//goland:noinspection GoErrorStringFormat
 		return "", errors.New(eMsg)
 	}
+	// duration of audio is unknown until it's read, so a second is taken, and the rest is added once it's read
+	if err := c.quota.Take(ctx, quotaSTTSeconds, 1); c.refusedByQuota(ctx, meta, err) {
+		return "", err
+	}
 
-	go func() { c.sse.PublishData(c.streamId, EventMessageThinking, meta) }()
+	go func() { c.pub.PublishData(c.streamId, EventMessageThinking, meta) }()
+
+	// audio is kept for providers that fall back, and for storage
+	var buf bytes.Buffer
+	tee := &audioTee{r: ar.Reader, w: &buf}
+	readAll := func() ([]byte, error) {
+		_, err := io.Copy(io.Discard, tee)
+		return buf.Bytes(), err
+	}
+	onTranscript := func(t client.Transcript) {
+		c.pub.PublishData(c.streamId, EventMessageTextTyping, Text{MessageMeta: meta, Text: t.Text, Replace: true})
+	}
 
-	text, err := stt.SpeechToText(ctx, ar.Reader, ar.FileName, *c.o.STTOption)
+	var text string
+	first := Fallback[client.SpeechToText, ability.STTOption]{Name: sttOptionName(*c.o.STTOption), Provider: stt, Option: *c.o.STTOption}
+	served, err := withFallback(ctx, c, meta, kindSTT, first,
+		func(from Fallback[client.SpeechToText, ability.STTOption]) []Fallback[client.SpeechToText, ability.STTOption] {
+			return c.talker.STTFallbacks(ctx, from.Option)
+		},
+		func(f Fallback[client.SpeechToText, ability.STTOption]) (bool, error) {
+			var err error
+			if ar.Streaming && f.Provider == stt {
+				// transcribe audio as it's being recorded
+				text, err = providers.StreamSpeechToText(ctx, f.Provider, tee, ar.FileName, f.Option, onTranscript)
+				return false, err
+			}
+			audio, err := readAll()
+			if err != nil {
+				return false, fmt.Errorf("failed to read audio: %w", err)
+			}
+			text, err = f.Provider.SpeechToText(ctx, bytes.NewReader(audio), ar.FileName, f.Option)
+			return false, err
+		})
 	if err != nil {
+		c.quota.Refund(ctx, quotaSTTSeconds, 1)
 		errMsg := fmt.Sprintf("Failed to get text from speech-to-text sever:\n %s", err.Error())
 		c.logger.Error(errMsg)
-		c.sse.PublishData(c.streamId, EventMessageError, Error{
-			MessageMeta: meta,
-			ErrMsg:      errMsg},
-		)
+		c.publishError(ctx, meta, kindSTT, errMsg)
 		return "", errors.New(errMsg)
 	}
 	if text == "" {
+		c.quota.Refund(ctx, quotaSTTSeconds, 1)
 		eMsg := "Empty content from speech-to-text sever"
-		c.sse.PublishData(c.streamId, EventMessageError, Error{
-			MessageMeta: meta,
-			ErrMsg:      eMsg},
-		)
+		c.publishError(ctx, meta, kindSTT, eMsg)
 		//goland:noinspection GoErrorStringFormat
 		return "", errors.New(eMsg)
 	}
 
+	// transcription is published before completion starts
+	c.pub.PublishData(c.streamId, EventMessageTextEOF, Text{
+		MessageMeta: meta,
+		Text:        text,
+	})
+	// the rest of streaming audio may arrive after the utterance has ended, don't wait for it
 	go func() {
-		c.sse.PublishData(c.streamId, EventMessageTextEOF, Text{
-			MessageMeta: meta,
-			Text:        text,
+		audio, readErr := readAll()
+		seconds := estimateAudioSeconds(audio, ar.FileName)
+		c.quota.Add(context.Background(), quotaSTTSeconds, seconds-1)
+		metrics.AddSTTAudioSeconds(served.Name, seconds)
+		c.record(func(s *storage.Storage) error {
+			err := s.SaveMessage(context.Background(), c.owner, c.storageMessage(meta.MessageID, role, text, true))
+			if err != nil {
+				return err
+			}
+			if readErr != nil {
+				return readErr
+			}
+			// user's voice is kept along with its transcription
+			return s.SaveAudio(context.Background(), meta.MessageID, 0, audio)
 		})
 	}()
 	return text, nil
 }
 
-func (c *ChatHandler) completion(ctx context.Context, latestMs []client.Message, assistant client.Role) (string, error) {
-	meta := MessageMeta{
-		ChatId:    c.chatId,
-		TicketId:  c.ticketId,
-		MessageID: util.RandomHash16Chars(),
-		Role:      assistant,
-	}
+// completion streams text to client, and to speech if it's not nil
+func (c *ChatHandler) completion(ctx context.Context, latestMs []client.Message, meta MessageMeta, speech *speechPipeline) (_ string, err error) {
+	ctx, span := tracing.Start(ctx, "completion")
+	defer func() { tracing.End(span, err) }()
 
 	llm, ok := c.talker.SelectLLMProvider(c.o.LLMOption)
 	if !ok {
 		eMsg := "No Large Language Model providers are available"
-		c.sse.PublishData(c.streamId, EventMessageError, Error{
-			MessageMeta: meta,
-			ErrMsg:      eMsg},
-		)
+		c.publishError(ctx, meta, kindLLM, eMsg)
 		//goland:noinspection GoErrorStringFormat
 		return "", errors.New(eMsg)
 	}
+	contents := make([]string, len(latestMs))
+	for i, m := range latestMs {
+		contents[i] = m.Content
+	}
+	prompt := estimateTokens(contents...)
+	if err := c.quota.Take(ctx, quotaLLMTokens, prompt); c.refusedByQuota(ctx, meta, err) {
+		return "", err
+	}
 
-	go func() { c.sse.PublishData(c.streamId, EventMessageThinking, meta) }()
-
-	stream := llm.CompletionStream(ctx, latestMs, *c.o.LLMOption)
+	go func() { c.pub.PublishData(c.streamId, EventMessageThinking, meta) }()
 
 	text := ""
+	first := Fallback[client.LLM, ability.LLMOption]{Name: llmOptionName(*c.o.LLMOption), Provider: llm, Option: *c.o.LLMOption}
+	_, err = withFallback(ctx, c, meta, kindLLM, first,
+		func(from Fallback[client.LLM, ability.LLMOption]) []Fallback[client.LLM, ability.LLMOption] {
+			return c.talker.LLMFallbacks(ctx, from.Option)
+		},
+		func(f Fallback[client.LLM, ability.LLMOption]) (bool, error) {
+			return c.streamCompletion(ctx, f.Provider, latestMs, f.Option, meta, speech, &text)
+		})
+	// only successful calls are charged, but text that has been streamed is counted even if completion fails
+	// or is cancelled
+	if err != nil && text == "" {
+		c.quota.Refund(ctx, quotaLLMTokens, prompt)
+	} else {
+		c.quota.Add(ctx, quotaLLMTokens, estimateTokens(text))
+	}
+	if err != nil {
+		c.publishError(ctx, meta, kindLLM, err.Error())
+		return "", err
+	}
+	c.pub.PublishData(c.streamId, EventMessageTextEOF, meta)
+	c.record(func(s *storage.Storage) error {
+		return s.SaveMessage(context.Background(), c.owner, c.storageMessage(meta.MessageID, meta.Role, text, false))
+	})
+	return text, nil
+}
+
+// streamCompletion appends streamed text to text, sent reports whether any text has been streamed to client
+func (c *ChatHandler) streamCompletion(
+	ctx context.Context,
+	llm client.LLM,
+	latestMs []client.Message,
+	o ability.LLMOption,
+	meta MessageMeta,
+	speech *speechPipeline,
+	text *string,
+) (sent bool, err error) {
+	start := time.Now()
+	stream := llm.CompletionStream(ctx, latestMs, o)
+	// stop reading as soon as the ticket is cancelled, even if the provider is stuck
+	stop := context.AfterFunc(ctx, func() { stream.Cancel(context.Cause(ctx)) })
+	defer stop()
+
 	for {
 		data, err := stream.Recv()
 		if err != nil {
 			if errors.Is(err, io.EOF) {
-				c.sse.PublishData(c.streamId, EventMessageTextEOF, meta)
-				return text, nil
-			} else {
-				c.sse.PublishData(c.streamId, EventMessageError,
-					Error{MessageMeta: meta, ErrMsg: err.Error()})
-				return "", err
+				return sent, nil
 			}
+			return sent, err
 		}
-		c.sse.PublishData(c.streamId, EventMessageTextTyping,
+		if !sent {
+			metrics.ObserveTimeToFirstToken(llmOptionName(o), c.talker.metricModel(ctx, o), time.Since(start))
+			trace.SpanFromContext(ctx).AddEvent("first token")
+		}
+		c.pub.PublishData(c.streamId, EventMessageTextTyping,
 			Text{MessageMeta: meta, Text: string(data)})
-		text += string(data)
+		*text += string(data)
+		sent = true
+		if speech != nil {
+			speech.Write(data)
+		}
+	}
+}
+
+func (c *ChatHandler) ttsFallbacks(from Fallback[client.TextToSpeech, ability.TTSOption]) []Fallback[client.TextToSpeech, ability.TTSOption] {
+	return c.talker.TTSFallbacks(from.Option)
+}
+
+func (c *ChatHandler) newMeta(role client.Role) MessageMeta {
+	return MessageMeta{
+		ChatId:    c.chatId,
+		TicketId:  c.ticketId,
+		MessageID: util.RandomHash16Chars(),
+		Role:      role,
 	}
 }
+
+// record runs f if storage is enabled. Failures are logged only, since they shouldn't break the conversation.
+func (c *ChatHandler) record(f func(s *storage.Storage) error) {
+	if c.storage == nil {
+		return
+	}
+	if err := f(c.storage); err != nil {
+		c.logger.Sugar().Errorf("failed to record ticket %s: %v", c.ticketId, err)
+	}
+}
+
+func (c *ChatHandler) storageMessage(messageId string, role client.Role, text string, transcribed bool) storage.Message {
+	return storage.Message{
+		Id:          messageId,
+		ChatId:      c.chatId,
+		TicketId:    c.ticketId,
+		Role:        role,
+		Text:        text,
+		Transcribed: transcribed,
+	}
+}
+
+// refusedByQuota publishes EventMessageQuotaExceeded and returns true if err is a QuotaError
+func (c *ChatHandler) refusedByQuota(ctx context.Context, meta MessageMeta, err error) bool {
+	var qe *QuotaError
+	if !errors.As(err, &qe) {
+		return false
+	}
+	c.logger.Sugar().Infof("ticket %s is refused: %s", c.ticketId, qe)
+	if ctx.Err() != nil {
+		return true
+	}
+	c.pub.PublishData(c.streamId, EventMessageQuotaExceeded, QuotaExceeded{
+		MessageMeta: meta,
+		Quota:       qe.Metric,
+		Limit:       qe.Limit,
+		Used:        qe.Used,
+		ResetAt:     qe.ResetAt,
+		ErrMsg:      qe.Error(),
+	})
+	return true
+}
+
+// publishError sends an error to client unless the ticket has been cancelled,
+// in which case client has been notified by EventMessageCancelled.
+func (c *ChatHandler) publishError(ctx context.Context, meta MessageMeta, kind, errMsg string) {
+	if ctx.Err() != nil {
+		c.logger.Sugar().Debugf("ticket %s has been cancelled, drop error: %s", c.ticketId, errMsg)
+		return
+	}
+	c.pub.PublishData(c.streamId, EventMessageError, Error{
+		MessageMeta: meta,
+		Kind:        kind,
+		ErrMsg:      errMsg},
+	)
+}
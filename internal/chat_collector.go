@@ -0,0 +1,64 @@
+package internal
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/proxoar/talk/internal/api"
+	"github.com/proxoar/talk/pkg/client"
+)
+
+// chatCollector is a Publisher that collects the events of a chat into an api.ChatResult
+type chatCollector struct {
+	mu     sync.Mutex
+	result api.ChatResult
+	texts  map[client.Role]string
+	audios []api.Audio
+}
+
+func newChatCollector(chatId, ticketId string) *chatCollector {
+	return &chatCollector{
+		result: api.ChatResult{ChatId: chatId, TicketId: ticketId},
+		texts:  map[client.Role]string{},
+	}
+}
+
+func (c *chatCollector) PublishData(_, eventName string, data interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch d := data.(type) {
+	case api.Text:
+		// EOF of a transcription carries the whole text
+		if d.Replace || eventName == api.EventMessageTextEOF {
+			c.texts[d.Role] = d.Text
+		} else {
+			c.texts[d.Role] += d.Text
+		}
+	case api.Audio:
+		c.audios = append(c.audios, d)
+	case api.Error:
+		c.result.Errors = append(c.result.Errors, d)
+	case api.QuotaExceeded:
+		c.result.QuotaExceeded = &d
+	case api.ProviderFallback:
+		c.result.Fallbacks = append(c.result.Fallbacks, d)
+	}
+}
+
+// Result should be called after ChatHandler.Start returns
+func (c *chatCollector) Result() api.ChatResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r := c.result
+	r.Transcription = c.texts[client.RoleUser]
+	r.Completion = c.texts[client.RoleAssistant]
+	slices.SortStableFunc(c.audios, func(a, b api.Audio) int { return a.Seq - b.Seq })
+	for _, a := range c.audios {
+		if a.Role == client.RoleUser {
+			r.UserAudio = append(r.UserAudio, a.Audio...)
+		} else {
+			r.Audio = append(r.Audio, a.Audio...)
+		}
+	}
+	return r
+}
@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/proxoar/talk/internal/api"
+	"github.com/proxoar/talk/pkg/client"
+)
+
+func TestChatCollector(t *testing.T) {
+	user := api.MessageMeta{ChatId: "chat", TicketId: "ticket", MessageID: "m1", Role: client.RoleUser}
+	assistant := api.MessageMeta{ChatId: "chat", TicketId: "ticket", MessageID: "m2", Role: client.RoleAssistant}
+	type event struct {
+		name string
+		data interface{}
+	}
+	tests := []struct {
+		name   string
+		events []event
+		want   api.ChatResult
+	}{
+		{
+			name: "transcription and completion",
+			events: []event{
+				{api.EventMessageTextTyping, api.Text{MessageMeta: user, Text: "hel", Replace: true}},
+				{api.EventMessageTextTyping, api.Text{MessageMeta: user, Text: "hello", Replace: true}},
+				{api.EventMessageTextEOF, api.Text{MessageMeta: user, Text: "hello there"}},
+				{api.EventMessageTextTyping, api.Text{MessageMeta: assistant, Text: "Hi"}},
+				{api.EventMessageTextTyping, api.Text{MessageMeta: assistant, Text: ", how"}},
+				{api.EventMessageTextTyping, api.Text{MessageMeta: assistant, Text: " are you?"}},
+			},
+			want: api.ChatResult{ChatId: "chat", TicketId: "ticket", Transcription: "hello there", Completion: "Hi, how are you?"},
+		},
+		{
+			name: "audio out of order",
+			events: []event{
+				{api.EventMessageAudio, api.Audio{MessageMeta: assistant, Audio: []byte("c"), Seq: 2}},
+				{api.EventMessageAudio, api.Audio{MessageMeta: user, Audio: []byte("user")}},
+				{api.EventMessageAudio, api.Audio{MessageMeta: assistant, Seq: 3, Final: true}},
+				{api.EventMessageAudio, api.Audio{MessageMeta: assistant, Audio: []byte("a")}},
+				{api.EventMessageAudio, api.Audio{MessageMeta: assistant, Audio: []byte("b"), Seq: 1}},
+			},
+			want: api.ChatResult{ChatId: "chat", TicketId: "ticket", UserAudio: []byte("user"), Audio: []byte("abc")},
+		},
+		{
+			name: "failed",
+			events: []event{
+				{api.EventSystemNotification, api.ProviderFallback{MessageMeta: assistant, Kind: kindLLM, From: "chatGPT", To: "gemini"}},
+				{api.EventMessageError, api.Error{MessageMeta: assistant, Kind: kindTTS, ErrMsg: "boom"}},
+				{api.EventMessageQuotaExceeded, api.QuotaExceeded{MessageMeta: assistant, Quota: quotaLLMTokens, Limit: 100, Used: 100}},
+			},
+			want: api.ChatResult{
+				ChatId:        "chat",
+				TicketId:      "ticket",
+				Errors:        []api.Error{{MessageMeta: assistant, Kind: kindTTS, ErrMsg: "boom"}},
+				Fallbacks:     []api.ProviderFallback{{MessageMeta: assistant, Kind: kindLLM, From: "chatGPT", To: "gemini"}},
+				QuotaExceeded: &api.QuotaExceeded{MessageMeta: assistant, Quota: quotaLLMTokens, Limit: 100, Used: 100},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newChatCollector("chat", "ticket")
+			for _, e := range tt.events {
+				c.PublishData("stream", e.name, e.data)
+			}
+			if got := c.Result(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Result() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,239 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/proxoar/talk/internal/config"
+	"github.com/proxoar/talk/pkg/ability"
+	"github.com/proxoar/talk/pkg/client"
+	"go.uber.org/zap"
+)
+
+// CLI runs each step of a chat from a terminal with the providers of config, see cmd/talk.
+// A provider is referred to by its key in config, e.g. whisper or openai-compatible/ollama, and the first one
+// configured of its kind is used if none is given.
+type CLI struct {
+	talker *Talker
+	logger *zap.Logger
+}
+
+func NewCLI(configPath string) (*CLI, error) {
+	logger := mustCLILogger()
+	conf, err := config.LoadConfig(configPath, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+	talker, err := NewTalker(*conf, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create providers: %w", err)
+	}
+	return &CLI{talker: talker, logger: logger}, nil
+}
+
+// Transcribe converts the audio file at path to text, model replaces the default model or recognizer of provider
+func (c *CLI) Transcribe(ctx context.Context, path, provider, model string) (string, error) {
+	name, err := c.providerName(kindSTT, provider)
+	if err != nil {
+		return "", err
+	}
+	o, ok := c.talker.translateSTTOption(ctx, name)
+	if !ok {
+		return "", fmt.Errorf("%s has no model to use", name)
+	}
+	if model != "" {
+		setSTTModel(&o, model)
+	}
+	stt, ok := c.talker.SelectSTTProvider(&o)
+	if !ok {
+		return "", fmt.Errorf("%s doesn't support the option, check the model", name)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = f.Close() }()
+	return stt.SpeechToText(ctx, f, filepath.Base(path), o)
+}
+
+// Say converts text to audio, voice replaces the default voice of provider
+func (c *CLI) Say(ctx context.Context, text, provider, voice string) ([]byte, error) {
+	name, err := c.providerName(kindTTS, provider)
+	if err != nil {
+		return nil, err
+	}
+	o, ok := translateTTSOption(name)
+	if !ok {
+		return nil, fmt.Errorf("%s is not supported", name)
+	}
+	if voice != "" {
+		setTTSVoice(&o, voice)
+	}
+	tts, ok := c.talker.SelectTTSProvider(&o)
+	if !ok {
+		return nil, fmt.Errorf("%s doesn't support the option, check the voice", name)
+	}
+	return tts.TextToSpeech(ctx, text, text, o)
+}
+
+// Chat
+// reads a message from each line of in, and streams the reply to out, until in ends or ctx is done.
+// The whole conversation is sent each time, as the web UI does.
+func (c *CLI) Chat(ctx context.Context, in io.Reader, out io.Writer, provider, model string) error {
+	name, err := c.providerName(kindLLM, provider)
+	if err != nil {
+		return err
+	}
+	// the default parameters of ChatGPT are carried over to other providers
+	o, ok := c.talker.translateLLMOption(ctx, ability.LLMOption{ChatGPT: ability.DefaultChatGPTOption()}, name)
+	if !ok {
+		return fmt.Errorf("%s has no model to use", name)
+	}
+	if model != "" {
+		setLLMModel(&o, model)
+	}
+	llm, ok := c.talker.SelectLLMProvider(&o)
+	if !ok {
+		return fmt.Errorf("%s doesn't support the option, check the model", name)
+	}
+
+	_, _ = fmt.Fprintf(out, "chatting with %s, press Ctrl-D to quit\n> ", name)
+	var ms []client.Message
+	lines, readErr := readLines(ctx, in)
+	for {
+		var line string
+		select {
+		case <-ctx.Done():
+			_, _ = fmt.Fprintln(out)
+			return nil
+		case l, ok := <-lines:
+			if !ok {
+				return <-readErr
+			}
+			line = l
+		}
+		text := strings.TrimSpace(line)
+		if text == "" {
+			_, _ = fmt.Fprint(out, "> ")
+			continue
+		}
+		ms = append(ms, client.Message{Role: client.RoleUser, Content: text})
+		reply, err := streamReply(ctx, llm, ms, o, out)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			// the message can be sent again
+			ms = ms[:len(ms)-1]
+			_, _ = fmt.Fprintf(out, "\n✗ %s\n> ", err)
+			continue
+		}
+		ms = append(ms, client.Message{Role: client.RoleAssistant, Content: reply})
+		_, _ = fmt.Fprint(out, "\n> ")
+	}
+}
+
+// readLines sends each line of in until in ends or ctx is done, and then the error of reading.
+// Chat doesn't wait for the goroutine to stop, since a read of the terminal can't be interrupted by ctx.
+func readLines(ctx context.Context, in io.Reader) (<-chan string, <-chan error) {
+	lines := make(chan string)
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(in)
+		defer func() { readErr <- scanner.Err() }()
+		for scanner.Scan() {
+			select {
+			case lines <- scanner.Text():
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return lines, readErr
+}
+
+func streamReply(ctx context.Context, llm client.LLM, ms []client.Message, o ability.LLMOption, out io.Writer) (string, error) {
+	stream := llm.CompletionStream(ctx, ms, o)
+	var sb strings.Builder
+	for {
+		r, err := stream.Recv()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return sb.String(), nil
+			}
+			return "", err
+		}
+		sb.WriteRune(r)
+		_, _ = fmt.Fprint(out, string(r))
+	}
+}
+
+// providerName returns name if a provider of kind is configured with it, or the first one of kind if name is empty
+func (c *CLI) providerName(kind, name string) (string, error) {
+	var names []string
+	for _, n := range c.talker.current().named {
+		if n.kind == kind {
+			names = append(names, n.name)
+		}
+	}
+	if len(names) == 0 {
+		return "", fmt.Errorf("no %s provider is configured", kind)
+	}
+	if name == "" {
+		return names[0], nil
+	}
+	if !slices.Contains(names, name) {
+		return "", fmt.Errorf("%s provider %s is not configured, choose one of: %s", kind, name, strings.Join(names, ", "))
+	}
+	return name, nil
+}
+
+func setLLMModel(o *ability.LLMOption, model string) {
+	switch {
+	case o.ChatGPT != nil:
+		o.ChatGPT.Model = model
+	case o.AzureChatGPT != nil:
+		o.AzureChatGPT.Model = model
+	case o.OpenAICompatible != nil:
+		o.OpenAICompatible.Model = model
+	case o.Gemini != nil:
+		o.Gemini.Model = model
+	case o.Claude != nil:
+		o.Claude.Model = model
+	}
+}
+
+func setSTTModel(o *ability.STTOption, model string) {
+	switch {
+	case o.Whisper != nil:
+		o.Whisper.Model = model
+	case o.AzureWhisper != nil:
+		o.AzureWhisper.Model = model
+	case o.LocalWhisper != nil:
+		o.LocalWhisper.Model = model
+	case o.Google != nil:
+		o.Google.Recognizer = model
+	}
+}
+
+func setTTSVoice(o *ability.TTSOption, voice string) {
+	switch {
+	case o.Elevenlabs != nil:
+		o.Elevenlabs.VoiceId = voice
+	case o.Google != nil:
+		o.Google.VoiceId = voice
+	case o.Piper != nil:
+		o.Piper.VoiceId = voice
+	case o.OpenAI != nil:
+		o.OpenAI.Voice = voice
+	}
+}
@@ -1,11 +1,19 @@
 package config
 
+import "time"
+
 type TalkConfig struct {
 	Server       ServerConfig       `mapstructure:"server"`
 	SpeechToText SpeechToTextConfig `mapstructure:"speech-to-text"`
 	TextToSpeech TextToSpeechConfig `mapstructure:"text-to-speech"`
 	Llm          LlmConfig          `mapstructure:"llm"`
+	Fallback     FallbackConfig     `mapstructure:"fallback"`
+	Retry        RetryConfig        `mapstructure:"retry"`
+	Quota        QuotaConfig        `mapstructure:"quota"`
+	Secrets      SecretsConfig      `mapstructure:"secrets"`
 
+	// values may refer to secrets elsewhere, e.g. file:/run/secrets/openai, env:OPENAI_KEY or vault:secret/talk#openai,
+	// which are resolved by LoadConfig and on every reload
 	Creds map[string]string `mapstructure:"creds"`
 }
 
@@ -15,23 +23,164 @@ type ServerConfig struct {
 	Passwords            []string `mapstructure:"passwords"`
 	DemoMode             bool     `mapstructure:"demo-mode"`
 	Tls                  TLS      `mapstructure:"tls"`
+	// Optional. Path of a SQLite file to record chats in, e.g. /var/lib/talk/talk.db. Nothing is recorded if empty
+	SQLite   string         `mapstructure:"sqlite"`
+	Accounts AccountsConfig `mapstructure:"accounts"`
+	Tracing  TracingConfig  `mapstructure:"tracing"`
+	// Optional. Check providers periodically, and notify clients when their status changes. Disabled if 0
+	HealthCheckInterval time.Duration `mapstructure:"health-check-interval"`
+}
+
+// TracingConfig exports OpenTelemetry spans of each ticket and of provider calls, nothing is exported if Exporter is empty
+type TracingConfig struct {
+	Exporter string `mapstructure:"exporter"` // "otlp" or "stdout"
+	// Optional. host:port of an OTLP/HTTP collector, localhost:4318 by default. Env OTEL_EXPORTER_OTLP_* also applies
+	Endpoint string  `mapstructure:"endpoint"`
+	Insecure bool    `mapstructure:"insecure"`     // Optional. Use HTTP instead of HTTPS
+	Ratio    float64 `mapstructure:"sample-ratio"` // Optional. Ratio of tickets to trace, 1 by default
+}
+
+// SecretsConfig configures secret stores that creds may refer to, see package secret
+type SecretsConfig struct {
+	Vault VaultConfig `mapstructure:"vault"`
+}
+
+// VaultConfig enables vault:<mount>/<path>#<field> in creds, which reads the KV version 2 secrets engine
+type VaultConfig struct {
+	Address string `mapstructure:"address"` // e.g. http://127.0.0.1:8200, env VAULT_ADDR by default
+	// env VAULT_TOKEN by default. May refer to a file or env like creds, e.g. file:/run/secrets/vault-token
+	Token     string `mapstructure:"token"`
+	Namespace string `mapstructure:"namespace"` // Optional. Namespace of Vault Enterprise
+}
+
+// AccountsConfig enables user accounts, which replace passwords and require sqlite
+type AccountsConfig struct {
+	Enabled    bool          `mapstructure:"enabled"`
+	SessionTTL time.Duration `mapstructure:"session-ttl"` // Optional. How long a login lasts, 720h by default
+	// Optional. Admin is created on startup if there is no user
+	Admin AdminConfig `mapstructure:"admin"`
+}
+
+type AdminConfig struct {
+	Name     string `mapstructure:"name"`
+	Password string `mapstructure:"password"`
 }
 
 type SpeechToTextConfig struct {
-	Whisper string `mapstructure:"whisper"`
-	Google  string `mapstructure:"google"`
+	Whisper      Creds              `mapstructure:"whisper"`
+	Google       Creds              `mapstructure:"google"`
+	AzureWhisper AzureOpenAIConfig  `mapstructure:"azure-whisper"`
+	LocalWhisper LocalWhisperConfig `mapstructure:"local-whisper"`
+}
+
+// LocalWhisperConfig points to a locally hosted whisper-compatible server
+type LocalWhisperConfig struct {
+	// e.g. http://127.0.0.1:8080/inference for whisper.cpp server,
+	// or http://127.0.0.1:8000/v1/audio/transcriptions for faster-whisper
+	URL string `mapstructure:"url"`
+	// Optional. Models shown on UI, the first one is used by health check
+	Models []string `mapstructure:"models"`
 }
 
 type TextToSpeechConfig struct {
-	ElevenLabs string `mapstructure:"elevenlabs"`
-	Google     string `mapstructure:"google"`
+	ElevenLabs Creds       `mapstructure:"elevenlabs"`
+	Google     Creds       `mapstructure:"google"`
+	Piper      PiperConfig `mapstructure:"piper"`
+	OpenAI     Creds       `mapstructure:"openai"`
+}
+
+// PiperConfig runs a local TTS binary which reads text from stdin and writes WAV to stdout
+type PiperConfig struct {
+	Binary   string   `mapstructure:"binary"`    // name or path of the binary, e.g. piper
+	ModelDir string   `mapstructure:"model-dir"` // directory containing *.onnx voices
+	Args     []string `mapstructure:"args"`      // Optional. Extra arguments, e.g. ["--cuda"]
 }
 
 type LlmConfig struct {
-	ChatGPT string `mapstructure:"chat-gpt"`
-	Gemini  string `mapstructure:"gemini"`
+	ChatGPT      Creds             `mapstructure:"chat-gpt"`
+	AzureChatGPT AzureOpenAIConfig `mapstructure:"azure-chat-gpt"`
+	Gemini       Creds             `mapstructure:"gemini"`
+	Claude       Creds             `mapstructure:"claude"`
+	// OpenAICompatible declares servers that speak the OpenAI chat API, such as Ollama, vLLM and LM Studio
+	OpenAICompatible []OpenAICompatibleConfig `mapstructure:"openai-compatible"`
+}
+
+type OpenAICompatibleConfig struct {
+	Name    string   `mapstructure:"name"`     // unique name, shown on UI
+	BaseURL string   `mapstructure:"base-url"` // e.g. http://localhost:11434/v1
+	Creds   Creds    `mapstructure:"creds"`    // Optional. Key(s) of creds
+	Models  []string `mapstructure:"models"`   // Optional. Only list models containing any of these, list all if empty
 }
 
+type AzureOpenAIConfig struct {
+	Endpoint    string            `mapstructure:"endpoint"`    // e.g. https://my-resource.openai.azure.com
+	APIVersion  string            `mapstructure:"api-version"` // Optional. e.g. 2024-02-01
+	Creds       Creds             `mapstructure:"creds"`       // key(s) of creds
+	Deployments []AzureDeployment `mapstructure:"deployments"`
+}
+
+type AzureDeployment struct {
+	Name  string `mapstructure:"name"`  // deployment name
+	Model string `mapstructure:"model"` // model deployed, e.g. gpt-4o
+}
+
+// FallbackConfig lists providers by the same keys used in llm, text-to-speech and speech-to-text.
+// An OpenAI-compatible endpoint is referred to as openai-compatible/<name>.
+//
+// When a provider fails with a retryable error, such as 429, 5xx and timeouts, the ticket is served by
+// the next provider in the chain. Providers not in the chain don't fall back.
+type FallbackConfig struct {
+	Llm          []string `mapstructure:"llm"`            // e.g. [gemini, chat-gpt]
+	TextToSpeech []string `mapstructure:"text-to-speech"` // e.g. [elevenlabs, google]
+	SpeechToText []string `mapstructure:"speech-to-text"` // e.g. [local-whisper, whisper]
+}
+
+// RetryConfig
+// Default applies to all providers, and is overridden field by field by the entry of a provider,
+// which is keyed the same as in FallbackConfig
+type RetryConfig struct {
+	Default      RetryPolicyConfig            `mapstructure:"default"`
+	Llm          map[string]RetryPolicyConfig `mapstructure:"llm"`
+	TextToSpeech map[string]RetryPolicyConfig `mapstructure:"text-to-speech"`
+	SpeechToText map[string]RetryPolicyConfig `mapstructure:"speech-to-text"`
+}
+
+// RetryPolicyConfig
+// zero values are not set. Durations are written like 500ms, 10s or 1m
+type RetryPolicyConfig struct {
+	MaxAttempts    int           `mapstructure:"max-attempts"`    // including the first attempt, 1 disables retry
+	InitialBackoff time.Duration `mapstructure:"initial-backoff"` // doubled after each attempt
+	MaxBackoff     time.Duration `mapstructure:"max-backoff"`     // give up if Retry-After asks for longer
+	Timeout        time.Duration `mapstructure:"timeout"`         // of each attempt, or until the first content of a stream
+}
+
+// QuotaConfig
+// Default applies to each user, or each password if accounts are disabled, and is overridden field by field
+// by the entry of the identity
+type QuotaConfig struct {
+	Default    QuotaLimits           `mapstructure:"default"`
+	Identities []IdentityQuotaConfig `mapstructure:"identities"`
+}
+
+type IdentityQuotaConfig struct {
+	Name        string `mapstructure:"name"` // name of a user, or a password if accounts are disabled
+	QuotaLimits `mapstructure:",squash"`
+}
+
+// QuotaLimits
+// zero values are not set, -1 lifts a limit of Default
+type QuotaLimits struct {
+	RequestsPerMinute     int64 `mapstructure:"requests-per-minute"`      // of chats
+	LLMTokensPerDay       int64 `mapstructure:"llm-tokens-per-day"`       // estimated from the length of text
+	TTSCharactersPerMonth int64 `mapstructure:"tts-characters-per-month"` // of synthesized text
+	STTSecondsPerDay      int64 `mapstructure:"stt-seconds-per-day"`      // estimated from the size of audio
+}
+
+// Creds
+// refers to credentials by their keys in TalkConfig.Creds, written as a single key or a list of keys.
+// Calls of a provider are spread over its credentials, see providers.NewLLMPool
+type Creds = []string
+
 type TLSPolicy int
 
 type Auto struct {
@@ -1,16 +1,27 @@
 package config
 
 import (
+	"cmp"
+	"context"
 	"errors"
+	"fmt"
+	"os"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/spf13/pflag"
+	"github.com/fsnotify/fsnotify"
+	"github.com/proxoar/talk/internal/secret"
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
 )
 
 const (
 	DefaultServerPort = 8000
+	// editors may write a file several times when saving it
+	watchDebounce = 500 * time.Millisecond
+	// of resolving all creds, see resolveCreds
+	resolveTimeout = 30 * time.Second
 )
 
 func setDefaultValue() {
@@ -32,14 +43,12 @@ func bindEnv() {
 	viper.AutomaticEnv()
 }
 
-func LoadConfig(logger *zap.Logger) (*TalkConfig, error) {
-	path := pflag.String("config", "", "Path to config file. ")
-	pflag.Parse()
-
+// LoadConfig reads the config file at path, or searches for talk.yaml if path is empty
+func LoadConfig(path string, logger *zap.Logger) (*TalkConfig, error) {
 	setDefaultValue()
-	if path != nil && *path != "" {
-		logger.Sugar().Info("reading config file: ", *path)
-		viper.SetConfigFile(*path)
+	if path != "" {
+		logger.Sugar().Info("reading config file: ", path)
+		viper.SetConfigFile(path)
 		err := viper.ReadInConfig()
 		if err != nil {
 			return nil, err
@@ -63,13 +72,77 @@ func LoadConfig(logger *zap.Logger) (*TalkConfig, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := resolveCreds(&c); err != nil {
+		return nil, err
+	}
 	return &c, nil
 }
 
-func MustLoadConfig(logger *zap.Logger) *TalkConfig {
-	c, err := LoadConfig(logger)
+// resolveCreds replaces references in c.Creds with the secrets they refer to
+func resolveCreds(c *TalkConfig) error {
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	r := secret.NewResolver()
+	v := c.Secrets.Vault
+	if address := cmp.Or(v.Address, os.Getenv("VAULT_ADDR")); address != "" {
+		token, err := r.Resolve(ctx, cmp.Or(v.Token, os.Getenv("VAULT_TOKEN")))
+		if err != nil {
+			return fmt.Errorf("secrets.vault.token: %w", err)
+		}
+		r.Register("vault", secret.NewVault(address, token, v.Namespace))
+	} else {
+		// a vault reference is never taken as an inline secret and sent to a provider
+		r.Register("vault", secret.ProviderFunc(func(context.Context, string) (string, error) {
+			return "", errors.New("vault is not configured, set secrets.vault.address")
+		}))
+	}
+	for key, value := range c.Creds {
+		s, err := r.Resolve(ctx, value)
+		if err != nil {
+			return fmt.Errorf("creds.%s: %w", key, err)
+		}
+		c.Creds[key] = s
+	}
+	return nil
+}
+
+func MustLoadConfig(path string, logger *zap.Logger) *TalkConfig {
+	c, err := LoadConfig(path, logger)
 	if err != nil {
 		logger.Sugar().Panic(err)
 	}
 	return c
 }
+
+// WatchConfig calls onChange with the new config each time the config file changes.
+// A config that fails to parse is logged and ignored, so the current one stays in use.
+func WatchConfig(logger *zap.Logger, onChange func(*TalkConfig)) {
+	var mu sync.Mutex
+	var timer *time.Timer
+	var changeMu sync.Mutex
+	viper.OnConfigChange(func(e fsnotify.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		if timer != nil {
+			timer.Stop()
+		}
+		timer = time.AfterFunc(watchDebounce, func() {
+			changeMu.Lock()
+			defer changeMu.Unlock()
+			logger.Sugar().Info("config file has changed: ", e.Name)
+			// viper has read the file again
+			c := TalkConfig{}
+			if err := viper.UnmarshalExact(&c); err != nil {
+				logger.Sugar().Error("failed to reload config, keep the current one: ", err)
+				return
+			}
+			// secrets may have been rotated even if their references are the same
+			if err := resolveCreds(&c); err != nil {
+				logger.Sugar().Error("failed to reload config, keep the current one: ", err)
+				return
+			}
+			onChange(&c)
+		})
+	})
+	viper.WatchConfig()
+}
@@ -0,0 +1,37 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestResolveCreds(t *testing.T) {
+	t.Setenv("VAULT_ADDR", "")
+	t.Setenv("TALK_TEST_KEY", "sk-env")
+	tests := []struct {
+		name    string
+		value   string
+		want    string
+		wantErr string
+	}{
+		{name: "inline", value: "sk-inline", want: "sk-inline"},
+		{name: "env", value: "env:TALK_TEST_KEY", want: "sk-env"},
+		{name: "unset env", value: "env:TALK_TEST_UNSET", wantErr: "env TALK_TEST_UNSET is not set"},
+		{name: "vault without address", value: "vault:secret/talk#openai", wantErr: "vault is not configured, set secrets.vault.address"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := TalkConfig{Creds: map[string]string{"key": tt.value}}
+			err := resolveCreds(&c)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("resolveCreds() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || c.Creds["key"] != tt.want {
+				t.Errorf("resolveCreds() = %q, %v, want %q, nil", c.Creds["key"], err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Problem is a mistake in config, Path is where it is, e.g. llm.chat-gpt
+type Problem struct {
+	Path    string
+	Message string
+}
+
+func (p Problem) String() string {
+	return p.Path + ": " + p.Message
+}
+
+// Validate finds mistakes that don't fail LoadConfig but make providers or the server not work as expected,
+// such as a reference to creds that doesn't exist, which makes the provider silently absent
+func Validate(c TalkConfig) []Problem {
+	var ps []Problem
+	add := func(path, format string, a ...any) {
+		ps = append(ps, Problem{Path: path, Message: fmt.Sprintf(format, a...)})
+	}
+
+	if c.Server.Port < 1 || c.Server.Port > 65535 {
+		add("server.port", "%d is not a valid port, it must be between 1 and 65535", c.Server.Port)
+	}
+
+	t := c.Server.Tls
+	var modes []string
+	if len(t.Auto.Domains) > 0 {
+		modes = append(modes, "auto")
+	}
+	if t.Provided.Cert != "" || t.Provided.Key != "" {
+		modes = append(modes, "provided")
+		if t.Provided.Cert == "" || t.Provided.Key == "" {
+			add("server.tls.provided", "both cert and key are required")
+		}
+	}
+	if t.SelfSigned {
+		modes = append(modes, "self-signed")
+	}
+	if len(modes) > 1 {
+		add("server.tls", "%s are set, but only one of them can be used", strings.Join(modes, ", "))
+	}
+
+	refs := []credsRef{
+		{"llm.chat-gpt", c.Llm.ChatGPT, false},
+		{"llm.azure-chat-gpt.creds", c.Llm.AzureChatGPT.Creds, false},
+		{"llm.gemini", c.Llm.Gemini, false},
+		{"llm.claude", c.Llm.Claude, false},
+		{"text-to-speech.elevenlabs", c.TextToSpeech.ElevenLabs, false},
+		{"text-to-speech.google", c.TextToSpeech.Google, true},
+		{"text-to-speech.openai", c.TextToSpeech.OpenAI, false},
+		{"speech-to-text.whisper", c.SpeechToText.Whisper, false},
+		{"speech-to-text.google", c.SpeechToText.Google, true},
+		{"speech-to-text.azure-whisper.creds", c.SpeechToText.AzureWhisper.Creds, false},
+	}
+	for i, e := range c.Llm.OpenAICompatible {
+		refs = append(refs, credsRef{fmt.Sprintf("llm.openai-compatible[%d].creds", i), e.Creds, false})
+	}
+	for _, r := range refs {
+		for _, key := range r.creds {
+			secret, ok := c.Creds[key]
+			if !ok {
+				add(r.path, "%q is not found in creds, which has %s", key, credsKeys(c.Creds))
+				continue
+			}
+			if r.google {
+				if err := validateServiceAccount(secret); err != nil {
+					add("creds."+key, "not a valid Google service account key: %s", err)
+				}
+			}
+		}
+	}
+	return ps
+}
+
+// credsRef is a field of config referring to creds
+type credsRef struct {
+	path   string
+	creds  Creds
+	google bool // whether creds are Google service account keys
+}
+
+func credsKeys(creds map[string]string) string {
+	if len(creds) == 0 {
+		return "no entries"
+	}
+	keys := make([]string, 0, len(creds))
+	for k := range creds {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return "[" + strings.Join(keys, ", ") + "]"
+}
+
+// validateServiceAccount checks the fields of a JSON key that Google clients require
+func validateServiceAccount(s string) error {
+	var key struct {
+		Type        string `json:"type"`
+		ProjectID   string `json:"project_id"`
+		PrivateKey  string `json:"private_key"`
+		ClientEmail string `json:"client_email"`
+	}
+	if err := json.Unmarshal([]byte(s), &key); err != nil {
+		return fmt.Errorf("%w, paste the content of the JSON file downloaded from Google Cloud Console", err)
+	}
+	if key.Type != "service_account" {
+		return fmt.Errorf("type is %q instead of \"service_account\"", key.Type)
+	}
+	var missing []string
+	for name, v := range map[string]string{"project_id": key.ProjectID, "private_key": key.PrivateKey, "client_email": key.ClientEmail} {
+		if v == "" {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("%s missing", strings.Join(missing, ", "))
+	}
+	return nil
+}
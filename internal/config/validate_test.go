@@ -0,0 +1,72 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	const account = `{"type": "service_account", "project_id": "p", "private_key": "k", "client_email": "e"}`
+	valid := func() TalkConfig {
+		return TalkConfig{
+			Server: ServerConfig{Port: DefaultServerPort},
+			Llm:    LlmConfig{ChatGPT: Creds{"open-ai-01", "open-ai-02"}},
+			TextToSpeech: TextToSpeechConfig{
+				Google: Creds{"google-01"},
+			},
+			Creds: map[string]string{"open-ai-01": "sk-1", "open-ai-02": "sk-2", "google-01": account},
+		}
+	}
+	tests := []struct {
+		name   string
+		modify func(c *TalkConfig)
+		want   []string
+	}{
+		{name: "valid", modify: func(c *TalkConfig) {}, want: nil},
+		{
+			name:   "invalid port",
+			modify: func(c *TalkConfig) { c.Server.Port = 70000 },
+			want:   []string{"server.port"},
+		},
+		{
+			name:   "unknown creds",
+			modify: func(c *TalkConfig) { c.Llm.ChatGPT = Creds{"open-ai-01", "open-ai-03"} },
+			want:   []string{"llm.chat-gpt"},
+		},
+		{
+			name:   "malformed service account",
+			modify: func(c *TalkConfig) { c.Creds["google-01"] = `{"type": "service_account"` },
+			want:   []string{"creds.google-01"},
+		},
+		{
+			name:   "service account missing fields",
+			modify: func(c *TalkConfig) { c.Creds["google-01"] = `{"type": "service_account"}` },
+			want:   []string{"creds.google-01"},
+		},
+		{
+			name: "conflicting tls",
+			modify: func(c *TalkConfig) {
+				c.Server.Tls = TLS{Auto: Auto{Domains: []string{"example.com"}}, SelfSigned: true}
+			},
+			want: []string{"server.tls"},
+		},
+		{
+			name:   "cert without key",
+			modify: func(c *TalkConfig) { c.Server.Tls.Provided.Cert = "cert" },
+			want:   []string{"server.tls.provided"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid()
+			tt.modify(&c)
+			var got []string
+			for _, p := range Validate(c) {
+				got = append(got, p.Path)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Validate() = %v, want %v", Validate(c), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,470 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	. "github.com/proxoar/talk/internal/api"
+	"github.com/proxoar/talk/internal/metrics"
+	"github.com/proxoar/talk/pkg/ability"
+	"github.com/proxoar/talk/pkg/client"
+	"github.com/proxoar/talk/pkg/providers"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// names of providers, the same as keys in config
+const (
+	llmChatGPT              = "chat-gpt"
+	llmAzureChatGPT         = "azure-chat-gpt"
+	llmGemini               = "gemini"
+	llmClaude               = "claude"
+	llmOpenAICompatiblePref = "openai-compatible/"
+
+	kindLLM = "llm"
+	kindTTS = "text-to-speech"
+	kindSTT = "speech-to-text"
+
+	ttsElevenlabs = "elevenlabs"
+	ttsGoogle     = "google"
+	ttsPiper      = "piper"
+	ttsOpenAI     = "openai"
+
+	sttWhisper      = "whisper"
+	sttAzureWhisper = "azure-whisper"
+	sttLocalWhisper = "local-whisper"
+	sttGoogle       = "google"
+)
+
+// Fallback
+// is a provider, along with an option translated for it, that serves a ticket when the selected provider fails
+type Fallback[P any, O any] struct {
+	Name     string
+	Provider P
+	Option   O
+}
+
+// withFallback
+// calls do with current, then with each provider returned by fallbacks, until do succeeds or fails with an error
+// that another provider can't help, see providers.ShouldFallback. fallbacks is called at most once, after the first
+// such failure.
+//
+// do reports sent=true once any output has been sent to client, after which switching provider would
+// duplicate the output, so the error is returned as is.
+//
+// The provider that served last is returned along with the error.
+//
+// Each call of do is recorded in metrics.
+func withFallback[P any, O any](
+	ctx context.Context,
+	c *ChatHandler,
+	meta MessageMeta,
+	kind string,
+	current Fallback[P, O],
+	fallbacks func(from Fallback[P, O]) []Fallback[P, O],
+	do func(f Fallback[P, O]) (sent bool, err error),
+) (Fallback[P, O], error) {
+	var chain []Fallback[P, O]
+	fetched := false
+	for {
+		// the provider that serves the step in the end is kept
+		trace.SpanFromContext(ctx).SetAttributes(attribute.String("provider", current.Name), attribute.String("model", optionModel(current.Option)))
+		start := time.Now()
+		sent, err := do(current)
+		metrics.ObserveProviderCall(kind, current.Name, c.talker.metricModel(ctx, current.Option), time.Since(start), providers.ErrorClass(err))
+		if err == nil || sent || ctx.Err() != nil || !providers.ShouldFallback(err) {
+			return current, err
+		}
+		if !fetched {
+			chain = fallbacks(current)
+			fetched = true
+		}
+		if len(chain) == 0 {
+			return current, err
+		}
+		next := chain[0]
+		chain = chain[1:]
+		c.logger.Sugar().Warnf("%s provider %s failed, fall back to %s: %v", kind, current.Name, next.Name, err)
+		c.publishFallback(meta, kind, current.Name, next.Name)
+		trace.SpanFromContext(ctx).AddEvent("fallback", trace.WithAttributes(
+			attribute.String("from", current.Name), attribute.String("to", next.Name), attribute.String("error", err.Error())))
+		current = next
+	}
+}
+
+func (c *ChatHandler) publishFallback(meta MessageMeta, kind, from, to string) {
+	c.pub.PublishData(c.streamId, EventSystemNotification, ProviderFallback{
+		MessageMeta: meta,
+		Notification: Notification{
+			Level:   "warn",
+			Message: fmt.Sprintf("%s is unavailable, %s is used instead", from, to),
+		},
+		Kind: kind,
+		From: from,
+		To:   to,
+	})
+}
+
+func llmOptionName(o ability.LLMOption) string {
+	switch {
+	case o.ChatGPT != nil:
+		return llmChatGPT
+	case o.AzureChatGPT != nil:
+		return llmAzureChatGPT
+	case o.Gemini != nil:
+		return llmGemini
+	case o.Claude != nil:
+		return llmClaude
+	case o.OpenAICompatible != nil:
+		return llmOpenAICompatiblePref + o.OpenAICompatible.Endpoint
+	default:
+		return ""
+	}
+}
+
+// optionModel returns the model of an option of any kind for metrics, which is empty if the provider has no model
+func optionModel(o any) string {
+	switch o := o.(type) {
+	case ability.LLMOption:
+		switch {
+		case o.ChatGPT != nil:
+			return o.ChatGPT.Model
+		case o.AzureChatGPT != nil:
+			return o.AzureChatGPT.Model
+		case o.Gemini != nil:
+			return o.Gemini.Model
+		case o.Claude != nil:
+			return o.Claude.Model
+		case o.OpenAICompatible != nil:
+			return o.OpenAICompatible.Model
+		}
+	case ability.TTSOption:
+		switch {
+		case o.OpenAI != nil:
+			return o.OpenAI.Model
+		case o.Piper != nil:
+			// each voice of Piper is a model
+			return o.Piper.VoiceId
+		}
+	case ability.STTOption:
+		switch {
+		case o.Whisper != nil:
+			return o.Whisper.Model
+		case o.AzureWhisper != nil:
+			return o.AzureWhisper.Model
+		case o.LocalWhisper != nil:
+			return o.LocalWhisper.Model
+		case o.Google != nil:
+			return o.Google.Recognizer
+		}
+	}
+	return ""
+}
+
+// metricOtherModel labels metrics of models that aren't listed in the ability
+const metricOtherModel = "other"
+
+// metricModel returns the model of an option as a label of metrics. A client can ask for any model, so a model
+// that isn't listed in the ability is labeled metricOtherModel to keep the number of labels bounded.
+func (t *Talker) metricModel(ctx context.Context, o any) string {
+	model := optionModel(o)
+	if model == "" {
+		return ""
+	}
+	// metrics are recorded for cancelled calls too, whose ctx mustn't fail the ability that is cached
+	if slices.Contains(listedModels(t.ability(context.WithoutCancel(ctx)), o), model) {
+		return model
+	}
+	return metricOtherModel
+}
+
+// listedModels returns the models in ab of the provider of an option, in the same way as optionModel
+func listedModels(ab ability.Ability, o any) []string {
+	switch o := o.(type) {
+	case ability.LLMOption:
+		switch {
+		case o.ChatGPT != nil:
+			return modelNames(ab.LLM.ChatGPT.Models)
+		case o.AzureChatGPT != nil:
+			return modelNames(ab.LLM.AzureChatGPT.Models)
+		case o.Gemini != nil:
+			return modelNames(ab.LLM.Gemini.Models)
+		case o.Claude != nil:
+			return modelNames(ab.LLM.Claude.Models)
+		case o.OpenAICompatible != nil:
+			for _, e := range ab.LLM.OpenAICompatible {
+				if e.Name == o.OpenAICompatible.Endpoint {
+					return modelNames(e.Models)
+				}
+			}
+		}
+	case ability.TTSOption:
+		switch {
+		case o.OpenAI != nil:
+			return ab.TTS.OpenAI.Models
+		case o.Piper != nil:
+			return itemIds(ab.TTS.Piper.Voices)
+		}
+	case ability.STTOption:
+		switch {
+		case o.Whisper != nil:
+			return ab.STT.Whisper.Models
+		case o.AzureWhisper != nil:
+			return ab.STT.AzureWhisper.Models
+		case o.LocalWhisper != nil:
+			return ab.STT.LocalWhisper.Models
+		case o.Google != nil:
+			return itemIds(ab.STT.Google.Recognizers)
+		}
+	}
+	return nil
+}
+
+func modelNames(models []ability.Model) []string {
+	names := make([]string, len(models))
+	for i, m := range models {
+		names[i] = m.Name
+	}
+	return names
+}
+
+func itemIds(items []ability.TaggedItem) []string {
+	ids := make([]string, len(items))
+	for i, item := range items {
+		ids[i] = item.Id
+	}
+	return ids
+}
+
+func ttsOptionName(o ability.TTSOption) string {
+	switch {
+	case o.Elevenlabs != nil:
+		return ttsElevenlabs
+	case o.Google != nil:
+		return ttsGoogle
+	case o.Piper != nil:
+		return ttsPiper
+	case o.OpenAI != nil:
+		return ttsOpenAI
+	default:
+		return ""
+	}
+}
+
+func sttOptionName(o ability.STTOption) string {
+	switch {
+	case o.Whisper != nil:
+		return sttWhisper
+	case o.AzureWhisper != nil:
+		return sttAzureWhisper
+	case o.LocalWhisper != nil:
+		return sttLocalWhisper
+	case o.Google != nil:
+		return sttGoogle
+	default:
+		return ""
+	}
+}
+
+// LLMFallbacks returns providers after the one selected by o in the fallback chain, in order
+func (t *Talker) LLMFallbacks(ctx context.Context, o ability.LLMOption) []Fallback[client.LLM, ability.LLMOption] {
+	var fs []Fallback[client.LLM, ability.LLMOption]
+	for _, name := range chainAfter(t.current().fallback.Llm, llmOptionName(o)) {
+		to, ok := t.translateLLMOption(ctx, o, name)
+		if !ok {
+			t.logger.Sugar().Warnf("unable to fall back to LLM provider %s, it may be unavailable", name)
+			continue
+		}
+		if p, ok := t.SelectLLMProvider(&to); ok {
+			fs = append(fs, Fallback[client.LLM, ability.LLMOption]{Name: name, Provider: p, Option: to})
+		}
+	}
+	return fs
+}
+
+// TTSFallbacks returns providers after the one selected by o in the fallback chain, in order
+func (t *Talker) TTSFallbacks(o ability.TTSOption) []Fallback[client.TextToSpeech, ability.TTSOption] {
+	var fs []Fallback[client.TextToSpeech, ability.TTSOption]
+	for _, name := range chainAfter(t.current().fallback.TextToSpeech, ttsOptionName(o)) {
+		to, ok := translateTTSOption(name)
+		if !ok {
+			t.logger.Sugar().Warnf("unable to fall back to text-to-speech provider %s", name)
+			continue
+		}
+		if p, ok := t.SelectTTSProvider(&to); ok {
+			fs = append(fs, Fallback[client.TextToSpeech, ability.TTSOption]{Name: name, Provider: p, Option: to})
+		}
+	}
+	return fs
+}
+
+// STTFallbacks returns providers after the one selected by o in the fallback chain, in order
+func (t *Talker) STTFallbacks(ctx context.Context, o ability.STTOption) []Fallback[client.SpeechToText, ability.STTOption] {
+	var fs []Fallback[client.SpeechToText, ability.STTOption]
+	for _, name := range chainAfter(t.current().fallback.SpeechToText, sttOptionName(o)) {
+		to, ok := t.translateSTTOption(ctx, name)
+		if !ok {
+			t.logger.Sugar().Warnf("unable to fall back to speech-to-text provider %s, it may be unavailable", name)
+			continue
+		}
+		if p, ok := t.SelectSTTProvider(&to); ok {
+			fs = append(fs, Fallback[client.SpeechToText, ability.STTOption]{Name: name, Provider: p, Option: to})
+		}
+	}
+	return fs
+}
+
+// chainAfter returns names after name in chain, or nil if name is not in chain
+func chainAfter(chain []string, name string) []string {
+	for i, n := range chain {
+		if n == name {
+			return chain[i+1:]
+		}
+	}
+	return nil
+}
+
+// llmParams are parameters shared by all LLM providers. Models are not shared.
+type llmParams struct {
+	maxTokens   int
+	temperature float32
+	topP        float32
+}
+
+func llmParamsOf(o ability.LLMOption) (llmParams, bool) {
+	switch {
+	case o.ChatGPT != nil:
+		return llmParams{o.ChatGPT.MaxTokens, o.ChatGPT.Temperature, o.ChatGPT.TopP}, true
+	case o.AzureChatGPT != nil:
+		return llmParams{o.AzureChatGPT.MaxTokens, o.AzureChatGPT.Temperature, o.AzureChatGPT.TopP}, true
+	case o.OpenAICompatible != nil:
+		return llmParams{o.OpenAICompatible.MaxTokens, o.OpenAICompatible.Temperature, o.OpenAICompatible.TopP}, true
+	case o.Gemini != nil:
+		return llmParams{int(o.Gemini.MaxOutputTokens), o.Gemini.Temperature, o.Gemini.TopP}, true
+	case o.Claude != nil:
+		return llmParams{o.Claude.MaxTokens, o.Claude.Temperature, o.Claude.TopP}, true
+	default:
+		return llmParams{}, false
+	}
+}
+
+// translateLLMOption
+// builds an option for provider name from the default option of that provider, carrying over max tokens,
+// temperature and top-p. Providers without a default model use their first listed model.
+func (t *Talker) translateLLMOption(ctx context.Context, from ability.LLMOption, name string) (ability.LLMOption, bool) {
+	p, ok := llmParamsOf(from)
+	if !ok {
+		return ability.LLMOption{}, false
+	}
+	chatGPTOption := func(model string) *ability.ChatGPTOption {
+		o := ability.DefaultChatGPTOption()
+		if model != "" {
+			o.Model = model
+		}
+		o.MaxTokens, o.Temperature, o.TopP = p.maxTokens, p.temperature, p.topP
+		return o
+	}
+
+	switch {
+	case name == llmChatGPT:
+		return ability.LLMOption{ChatGPT: chatGPTOption("")}, true
+	case name == llmAzureChatGPT:
+		model, ok := firstModel(t.ability(ctx).LLM.AzureChatGPT.Models)
+		if !ok {
+			return ability.LLMOption{}, false
+		}
+		return ability.LLMOption{AzureChatGPT: chatGPTOption(model)}, true
+	case strings.HasPrefix(name, llmOpenAICompatiblePref):
+		endpoint := strings.TrimPrefix(name, llmOpenAICompatiblePref)
+		for _, e := range t.ability(ctx).LLM.OpenAICompatible {
+			if e.Name != endpoint {
+				continue
+			}
+			model, ok := firstModel(e.Models)
+			if !ok {
+				return ability.LLMOption{}, false
+			}
+			return ability.LLMOption{OpenAICompatible: &ability.OpenAICompatibleOption{
+				Endpoint:      endpoint,
+				ChatGPTOption: *chatGPTOption(model),
+			}}, true
+		}
+		return ability.LLMOption{}, false
+	case name == llmGemini:
+		o := ability.DefaultGeminiOption()
+		o.MaxOutputTokens, o.Temperature, o.TopP = int32(p.maxTokens), p.temperature, p.topP
+		return ability.LLMOption{Gemini: o}, true
+	case name == llmClaude:
+		o := ability.DefaultClaudeOption()
+		o.MaxTokens, o.Temperature, o.TopP = p.maxTokens, p.temperature, p.topP
+		// Claude accepts temperature up to 1 only
+		if o.Temperature > 1 {
+			o.Temperature = 1
+		}
+		return ability.LLMOption{Claude: o}, true
+	default:
+		return ability.LLMOption{}, false
+	}
+}
+
+// translateTTSOption
+// voices can't be translated between providers, the default option of provider name is used
+func translateTTSOption(name string) (ability.TTSOption, bool) {
+	switch name {
+	case ttsElevenlabs:
+		return ability.TTSOption{Elevenlabs: ability.DefaultElevenlabsTTSOption()}, true
+	case ttsGoogle:
+		return ability.TTSOption{Google: ability.DefaultGoogleTTSOption()}, true
+	case ttsPiper:
+		return ability.TTSOption{Piper: ability.DefaultPiperTTSOption()}, true
+	case ttsOpenAI:
+		return ability.TTSOption{OpenAI: ability.DefaultOpenAITTSOption()}, true
+	default:
+		return ability.TTSOption{}, false
+	}
+}
+
+// translateSTTOption
+// builds an option for provider name, using its first listed model or recognizer
+func (t *Talker) translateSTTOption(ctx context.Context, name string) (ability.STTOption, bool) {
+	switch name {
+	case sttWhisper:
+		return ability.STTOption{Whisper: ability.DefaultWhisperOption()}, true
+	case sttAzureWhisper:
+		models := t.ability(ctx).STT.AzureWhisper.Models
+		if len(models) == 0 {
+			return ability.STTOption{}, false
+		}
+		return ability.STTOption{AzureWhisper: &ability.WhisperOption{Model: models[0]}}, true
+	case sttLocalWhisper:
+		o := &ability.WhisperOption{}
+		if models := t.ability(ctx).STT.LocalWhisper.Models; len(models) > 0 {
+			o.Model = models[0]
+		}
+		return ability.STTOption{LocalWhisper: o}, true
+	case sttGoogle:
+		recs := t.ability(ctx).STT.Google.Recognizers
+		if len(recs) == 0 {
+			return ability.STTOption{}, false
+		}
+		return ability.STTOption{Google: &ability.GoogleSTTOption{Recognizer: recs[0].Id}}, true
+	default:
+		return ability.STTOption{}, false
+	}
+}
+
+// ability returns the cached ability, errors are logged by Ability
+func (t *Talker) ability(ctx context.Context) ability.Ability {
+	_, ab := t.Ability(ctx)
+	return ab
+}
+
+func firstModel(models []ability.Model) (string, bool) {
+	if len(models) == 0 {
+		return "", false
+	}
+	return models[0].Name, true
+}
@@ -8,7 +8,20 @@ import (
 )
 
 func mustDefaultLogger() *zap.Logger {
+	return mustLogger(os.Getenv("LOG_LEVEL"))
+}
+
+// mustCLILogger only logs warnings and errors unless LOG_LEVEL is set, which are written to stderr
+// so that they don't mix with the output of a command
+func mustCLILogger() *zap.Logger {
 	logLevel := os.Getenv("LOG_LEVEL")
+	if logLevel == "" {
+		logLevel = "warn"
+	}
+	return mustLogger(logLevel)
+}
+
+func mustLogger(logLevel string) *zap.Logger {
 	level := zap.NewAtomicLevel()
 	err := level.UnmarshalText([]byte(logLevel))
 	if err != nil {
@@ -0,0 +1,92 @@
+// Package metrics exposes Prometheus metrics of the voice pipeline at /metrics
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "talk"
+
+// speech-to-text and text-to-speech take seconds, completion may take minutes
+var latencyBuckets = []float64{0.1, 0.25, 0.5, 1, 2, 4, 8, 15, 30, 60, 120}
+
+var (
+	providerDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "provider_duration_seconds",
+		Help:      "Duration of calls to providers, including streaming of completion.",
+		Buckets:   latencyBuckets,
+	}, []string{"kind", "provider", "model"})
+
+	providerErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "provider_errors_total",
+		Help:      "Failed calls to providers by error class, see providers.ErrorClass.",
+	}, []string{"kind", "provider", "model", "class"})
+
+	timeToFirstToken = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "llm_time_to_first_token_seconds",
+		Help:      "Time from the request of a completion until its first text arrives.",
+		Buckets:   latencyBuckets,
+	}, []string{"provider", "model"})
+
+	ttsCharacters = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tts_characters_total",
+		Help:      "Characters synthesized by text-to-speech providers.",
+	}, []string{"provider"})
+
+	sttAudioSeconds = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "stt_audio_seconds_total",
+		Help:      "Seconds of audio transcribed by speech-to-text providers, estimated from the size of audio.",
+	}, []string{"provider"})
+
+	sseSubscribers = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "sse_subscribers",
+		Help:      "Active SSE subscribers.",
+	})
+
+	webSocketConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "websocket_connections",
+		Help:      "Active WebSocket connections.",
+	})
+)
+
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// ObserveProviderCall records the duration of a call to a provider, and its error class if it failed
+func ObserveProviderCall(kind, provider, model string, d time.Duration, errClass string) {
+	providerDuration.WithLabelValues(kind, provider, model).Observe(d.Seconds())
+	if errClass != "" {
+		providerErrors.WithLabelValues(kind, provider, model, errClass).Inc()
+	}
+}
+
+func ObserveTimeToFirstToken(provider, model string, d time.Duration) {
+	timeToFirstToken.WithLabelValues(provider, model).Observe(d.Seconds())
+}
+
+func AddTTSCharacters(provider string, n int64) {
+	ttsCharacters.WithLabelValues(provider).Add(float64(n))
+}
+
+func AddSTTAudioSeconds(provider string, n int64) {
+	sttAudioSeconds.WithLabelValues(provider).Add(float64(n))
+}
+
+func SSESubscribed()   { sseSubscribers.Inc() }
+func SSEUnsubscribed() { sseSubscribers.Dec() }
+
+func WebSocketConnected()    { webSocketConnections.Inc() }
+func WebSocketDisconnected() { webSocketConnections.Dec() }
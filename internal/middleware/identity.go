@@ -0,0 +1,23 @@
+package middleware
+
+import "github.com/labstack/echo/v4"
+
+const IdentityKey = "identity"
+
+// Identity is who sent a request, which is set by SPAuth and UserAuth
+type Identity struct {
+	// Key is unique, e.g. user:<user id> or password:<hash of password>
+	Key string
+	// Name looks up limits in config, which is the name of a user, or a password if accounts are disabled
+	Name string
+}
+
+// anonymous is shared by all requests if auth is disabled
+var anonymous = Identity{Key: "anonymous"}
+
+func IdentityOf(c echo.Context) Identity {
+	if id, ok := c.Get(IdentityKey).(Identity); ok {
+		return id
+	}
+	return anonymous
+}
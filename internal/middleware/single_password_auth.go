@@ -5,6 +5,7 @@ import (
 	"encoding/hex"
 	"net/http"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/labstack/echo/v4"
@@ -18,7 +19,7 @@ type (
 		Skipper middleware.Skipper
 
 		Expiration time.Duration
-		Passwords  []string
+		Passwords  *Passwords
 	}
 
 	// SPAuthValidator defines a function to validate SPAuth credentials.
@@ -40,12 +41,46 @@ var (
 	}
 )
 
+// Passwords are the passwords of SPAuth, which can be replaced while the server is running
+type Passwords struct {
+	// hash -> raw password
+	m atomic.Pointer[map[string]string]
+}
+
+func NewPasswords(passwords []string) *Passwords {
+	p := &Passwords{}
+	p.Set(passwords)
+	return p
+}
+
+// Set replaces all passwords
+func (p *Passwords) Set(passwords []string) {
+	m := make(map[string]string, len(passwords))
+	for _, pass := range passwords {
+		sha := sha256.New()
+		sha.Write([]byte(pass))
+		b := sha.Sum(nil)
+		hash := hex.EncodeToString(b)
+		m[hash] = pass
+	}
+	p.m.Store(&m)
+}
+
+func (p *Passwords) lookup(hash string) (string, bool) {
+	pass, ok := (*p.m.Load())[hash]
+	return pass, ok
+}
+
+func (p *Passwords) len() int {
+	return len(*p.m.Load())
+}
+
 // SPAuth returns an SPAuth middleware.
 //
 // Header example: Authorization: Bearer 00THIS00IS00A00HASH
 // For valid credentials it calls the next handler.
 // For missing or invalid credentials, it sends "401 - Unauthorized" response.
-func SPAuth(passwords []string) echo.MiddlewareFunc {
+func SPAuth(passwords *Passwords) echo.MiddlewareFunc {
 	c := DefaultSPAuthConfig
 	c.Passwords = passwords
 	return SPAuthWithConfig(c)
@@ -54,7 +89,7 @@ func SPAuth(passwords []string) echo.MiddlewareFunc {
 // SPAuthWithConfig returns an SPAuth middleware with config.
 // See `SPAuth()`.
 func SPAuthWithConfig(config SPAuthConfig) echo.MiddlewareFunc {
-	if len(config.Passwords) == 0 {
+	if config.Passwords == nil || config.Passwords.len() == 0 {
 		// it's meaningless to use SPAuth middleware if no passwords are present
 		panic("SPAuth middleware requires at least one password")
 	}
@@ -65,17 +100,6 @@ func SPAuthWithConfig(config SPAuthConfig) echo.MiddlewareFunc {
 		config.Expiration = expiration
 	}
 
-	// create a map with k=hash, pass=raw-password
-	passMap := make(map[string]string, len(config.Passwords))
-
-	for _, pass := range config.Passwords {
-		sha := sha256.New()
-		sha.Write([]byte(pass))
-		b := sha.Sum(nil)
-		hash := hex.EncodeToString(b)
-		passMap[hash] = pass
-	}
-
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
 			if config.Skipper(c) {
@@ -98,9 +122,10 @@ func SPAuthWithConfig(config SPAuthConfig) echo.MiddlewareFunc {
 			if len(hash) != hashLength {
 				return echo.NewHTTPError(http.StatusUnauthorized, "single-password-auth hash is incorrect")
 			}
-			password, ok := passMap[hash]
+			password, ok := config.Passwords.lookup(hash)
 			if ok {
 				c.Logger().Debug(maskPassword(password) + " has passed single-password-auth")
+				c.Set(IdentityKey, Identity{Key: "password:" + hash, Name: password})
 				return next(c)
 			} else {
 				return echo.NewHTTPError(http.StatusUnauthorized, "wrong password")
@@ -0,0 +1,66 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/proxoar/talk/internal/storage"
+)
+
+const (
+	UserKey  = "user"
+	TokenKey = "token"
+	// tokenParam carries a token for SSE and WebSocket, since EventSource and WebSocket in js don't support custom headers
+	tokenParam = "token"
+)
+
+// UserAuth
+// authenticates requests by a session token or a personal API token, and sets the user and the token
+// in context, see UserOf.
+//
+// Header example: Authorization: Bearer talk_0123abcd...
+// For missing, invalid, or expired tokens, it sends "401 - Unauthorized" response.
+func UserAuth(store *storage.Storage) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			token := c.QueryParam(tokenParam)
+			if token == "" {
+				auth := c.Request().Header.Get(echo.HeaderAuthorization)
+				l := len(bearer)
+				if len(auth) > l+1 && strings.EqualFold(auth[:l], bearer) {
+					token = auth[l+1:]
+				} else {
+					return echo.NewHTTPError(http.StatusUnauthorized, "token is missing")
+				}
+			}
+			u, t, err := store.UserByToken(c.Request().Context(), token)
+			if errors.Is(err, storage.ErrInvalidCredentials) {
+				return echo.NewHTTPError(http.StatusUnauthorized, "token is invalid or has expired")
+			} else if err != nil {
+				return err
+			}
+			c.Set(UserKey, u)
+			c.Set(TokenKey, t)
+			c.Set(IdentityKey, Identity{Key: "user:" + u.Id, Name: u.Name})
+			return next(c)
+		}
+	}
+}
+
+// RequireAdmin rejects users who aren't admins, it must follow UserAuth
+func RequireAdmin(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if u, ok := UserOf(c); !ok || !u.Admin {
+			return echo.NewHTTPError(http.StatusForbidden, "admin only")
+		}
+		return next(c)
+	}
+}
+
+// UserOf returns the user who sent the request, and false if accounts are disabled
+func UserOf(c echo.Context) (storage.User, bool) {
+	u, ok := c.Get(UserKey).(storage.User)
+	return u, ok
+}
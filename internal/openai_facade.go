@@ -0,0 +1,420 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+	"github.com/proxoar/talk/internal/middleware"
+	"github.com/proxoar/talk/internal/util"
+	"github.com/proxoar/talk/pkg/ability"
+	"github.com/proxoar/talk/pkg/client"
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+)
+
+// OpenAIFacade
+// serves a subset of OpenAI API under /v1 with the configured providers, so that tools built for OpenAI
+// can use Talk's keys and providers.
+//
+// Model names are looked up in ability.Ability, the first provider that advertises the model serves the request.
+// Requests are limited by quotas the same as chats.
+type OpenAIFacade struct {
+	talker *Talker
+	quotas *Quotas
+	logger *zap.Logger
+}
+
+func NewOpenAIFacade(talker *Talker, quotas *Quotas, logger *zap.Logger) *OpenAIFacade {
+	return &OpenAIFacade{
+		talker: talker,
+		quotas: quotas,
+		logger: logger,
+	}
+}
+
+// ChatCompletions serves POST /v1/chat/completions, streaming chunks as SSE if stream is true
+func (f *OpenAIFacade) ChatCompletions(c echo.Context) error {
+	req := new(openai.ChatCompletionRequest)
+	if err := json.NewDecoder(c.Request().Body).Decode(req); err != nil {
+		return openAIError(c, http.StatusBadRequest, "invalid request body: "+err.Error())
+	}
+	if len(req.Messages) == 0 {
+		return openAIError(c, http.StatusBadRequest, "messages is empty")
+	}
+	ctx := c.Request().Context()
+	o, ok := f.llmOption(ctx, *req)
+	if !ok {
+		return openAIError(c, http.StatusNotFound, fmt.Sprintf("model %q is not found", req.Model))
+	}
+	llm, ok := f.talker.SelectLLMProvider(&o)
+	if !ok {
+		return openAIError(c, http.StatusNotFound, fmt.Sprintf("model %q is not available", req.Model))
+	}
+
+	ms := make([]client.Message, len(req.Messages))
+	contents := make([]string, len(req.Messages))
+	for i, m := range req.Messages {
+		ms[i] = client.Message{Role: client.Role(m.Role), Content: messageContent(m)}
+		contents[i] = ms[i].Content
+	}
+	quota := f.quotas.For(middleware.IdentityOf(c))
+	prompt := estimateTokens(contents...)
+	if err := takeRequest(ctx, quota, quotaLLMTokens, prompt); err != nil {
+		return quotaError(c, err)
+	}
+	id := "chatcmpl-" + util.RandomHash16Chars()
+	created := time.Now().Unix()
+
+	if !req.Stream {
+		text, err := llm.Completion(ctx, ms, o)
+		if err != nil {
+			quota.Refund(ctx, quotaLLMTokens, prompt)
+			f.logger.Sugar().Error("failed to complete for OpenAI facade: ", err)
+			return openAIError(c, http.StatusBadGateway, err.Error())
+		}
+		quota.Add(ctx, quotaLLMTokens, estimateTokens(text))
+		return c.JSON(http.StatusOK, openai.ChatCompletionResponse{
+			ID:      id,
+			Object:  "chat.completion",
+			Created: created,
+			Model:   req.Model,
+			Choices: []openai.ChatCompletionChoice{{
+				Message:      openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: text},
+				FinishReason: openai.FinishReasonStop,
+			}},
+		})
+	}
+
+	stream := llm.CompletionStream(ctx, ms, o)
+	stop := context.AfterFunc(ctx, func() { stream.Cancel(context.Cause(ctx)) })
+	defer stop()
+
+	// wait for the first content, so that an error can still be replied with a status code
+	data, err := stream.RecvRaw()
+	if err != nil && !errors.Is(err, io.EOF) {
+		quota.Refund(ctx, quotaLLMTokens, prompt)
+		f.logger.Sugar().Error("failed to stream completion for OpenAI facade: ", err)
+		return openAIError(c, http.StatusBadGateway, err.Error())
+	}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.WriteHeader(http.StatusOK)
+	chunk := func(delta openai.ChatCompletionStreamChoiceDelta, finish openai.FinishReason) {
+		b, _ := json.Marshal(openai.ChatCompletionStreamResponse{
+			ID:      id,
+			Object:  "chat.completion.chunk",
+			Created: created,
+			Model:   req.Model,
+			Choices: []openai.ChatCompletionStreamChoice{{Delta: delta, FinishReason: finish}},
+		})
+		_, _ = fmt.Fprintf(res, "data: %s\n\n", b)
+		res.Flush()
+	}
+
+	chunk(openai.ChatCompletionStreamChoiceDelta{Role: openai.ChatMessageRoleAssistant}, "")
+	var completion []rune
+	for err == nil {
+		chunk(openai.ChatCompletionStreamChoiceDelta{Content: string(data)}, "")
+		completion = append(completion, data)
+		data, err = stream.RecvRaw()
+	}
+	quota.Add(ctx, quotaLLMTokens, estimateTokens(string(completion)))
+	if !errors.Is(err, io.EOF) {
+		// headers have been sent, the error can only be reported in the stream
+		f.logger.Sugar().Error("failed to stream completion for OpenAI facade: ", err)
+		b, _ := json.Marshal(openai.ErrorResponse{Error: &openai.APIError{Message: err.Error(), Type: "server_error"}})
+		_, _ = fmt.Fprintf(res, "data: %s\n\n", b)
+		res.Flush()
+		return nil
+	}
+	chunk(openai.ChatCompletionStreamChoiceDelta{}, openai.FinishReasonStop)
+	_, _ = fmt.Fprint(res, "data: [DONE]\n\n")
+	res.Flush()
+	return nil
+}
+
+// Transcriptions serves POST /v1/audio/transcriptions, response_format can be json or text
+func (f *OpenAIFacade) Transcriptions(c echo.Context) error {
+	model := c.FormValue("model")
+	ctx := c.Request().Context()
+	o, ok := f.sttOption(ctx, model, c.FormValue("language"))
+	if !ok {
+		return openAIError(c, http.StatusNotFound, fmt.Sprintf("model %q is not found", model))
+	}
+	stt, ok := f.talker.SelectSTTProvider(&o)
+	if !ok {
+		return openAIError(c, http.StatusNotFound, fmt.Sprintf("model %q is not available", model))
+	}
+
+	audioFile, err := c.FormFile("file")
+	if err != nil {
+		return openAIError(c, http.StatusBadRequest, "file is missing: "+err.Error())
+	}
+	reader, err := audioFile.Open()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = reader.Close() }()
+	audio, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	quota := f.quotas.For(middleware.IdentityOf(c))
+	seconds := estimateAudioSeconds(audio, audioFile.Filename)
+	if err = takeRequest(ctx, quota, quotaSTTSeconds, seconds); err != nil {
+		return quotaError(c, err)
+	}
+
+	text, err := stt.SpeechToText(ctx, bytes.NewReader(audio), audioFile.Filename, o)
+	if err != nil {
+		quota.Refund(ctx, quotaSTTSeconds, seconds)
+		f.logger.Sugar().Error("failed to transcribe for OpenAI facade: ", err)
+		return openAIError(c, http.StatusBadGateway, err.Error())
+	}
+	switch c.FormValue("response_format") {
+	case "", "json":
+		return c.JSON(http.StatusOK, openai.AudioResponse{Text: text})
+	case "text":
+		return c.String(http.StatusOK, text)
+	default:
+		return openAIError(c, http.StatusBadRequest, "response_format must be json or text")
+	}
+}
+
+// Speech serves POST /v1/audio/speech
+//
+// model is an OpenAI text-to-speech model, or any other string if voice is a voice of another provider.
+func (f *OpenAIFacade) Speech(c echo.Context) error {
+	req := new(openai.CreateSpeechRequest)
+	if err := json.NewDecoder(c.Request().Body).Decode(req); err != nil {
+		return openAIError(c, http.StatusBadRequest, "invalid request body: "+err.Error())
+	}
+	if req.Input == "" {
+		return openAIError(c, http.StatusBadRequest, "input is empty")
+	}
+	ctx := c.Request().Context()
+	o, ok := f.ttsOption(ctx, *req)
+	if !ok {
+		return openAIError(c, http.StatusNotFound, fmt.Sprintf("model %q with voice %q is not found", req.Model, req.Voice))
+	}
+	tts, ok := f.talker.SelectTTSProvider(&o)
+	if !ok {
+		return openAIError(c, http.StatusNotFound, fmt.Sprintf("model %q is not available", req.Model))
+	}
+
+	quota := f.quotas.For(middleware.IdentityOf(c))
+	chars := int64(utf8.RuneCountInString(req.Input))
+	if err := takeRequest(ctx, quota, quotaTTSCharacters, chars); err != nil {
+		return quotaError(c, err)
+	}
+
+	audio, err := tts.TextToSpeech(ctx, req.Input, req.Input, o)
+	if err != nil {
+		quota.Refund(ctx, quotaTTSCharacters, chars)
+		f.logger.Sugar().Error("failed to synthesize speech for OpenAI facade: ", err)
+		return openAIError(c, http.StatusBadGateway, err.Error())
+	}
+	return c.Blob(http.StatusOK, audioContentType(audio), audio)
+}
+
+// llmOption builds an option for the first provider that advertises the model of req
+func (f *OpenAIFacade) llmOption(ctx context.Context, req openai.ChatCompletionRequest) (ability.LLMOption, bool) {
+	ab := f.talker.ability(ctx).LLM
+	has := func(models []ability.Model) bool {
+		return slices.ContainsFunc(models, func(m ability.Model) bool { return m.Name == req.Model })
+	}
+	chatGPTOption := func() *ability.ChatGPTOption {
+		o := ability.DefaultChatGPTOption()
+		o.Model = req.Model
+		if req.MaxTokens > 0 {
+			o.MaxTokens = req.MaxTokens
+		}
+		if req.Temperature > 0 {
+			o.Temperature = req.Temperature
+		}
+		if req.TopP > 0 {
+			o.TopP = req.TopP
+		}
+		o.PresencePenalty, o.FrequencyPenalty = req.PresencePenalty, req.FrequencyPenalty
+		return o
+	}
+
+	switch {
+	case ab.ChatGPT.Available && has(ab.ChatGPT.Models):
+		return ability.LLMOption{ChatGPT: chatGPTOption()}, true
+	case ab.AzureChatGPT.Available && has(ab.AzureChatGPT.Models):
+		return ability.LLMOption{AzureChatGPT: chatGPTOption()}, true
+	case ab.Gemini.Available && has(ab.Gemini.Models):
+		o := ability.DefaultGeminiOption()
+		o.Model = req.Model
+		if req.MaxTokens > 0 {
+			o.MaxOutputTokens = int32(req.MaxTokens)
+		}
+		if req.Temperature > 0 {
+			o.Temperature = req.Temperature
+		}
+		if req.TopP > 0 {
+			o.TopP = req.TopP
+		}
+		o.StopSequences = req.Stop
+		return ability.LLMOption{Gemini: o}, true
+	case ab.Claude.Available && has(ab.Claude.Models):
+		o := ability.DefaultClaudeOption()
+		o.Model = req.Model
+		if req.MaxTokens > 0 {
+			o.MaxTokens = req.MaxTokens
+		}
+		if req.Temperature > 0 {
+			// Claude accepts temperature up to 1 only
+			o.Temperature = min(req.Temperature, 1)
+		}
+		if req.TopP > 0 {
+			o.TopP = req.TopP
+		}
+		o.StopSequences = req.Stop
+		return ability.LLMOption{Claude: o}, true
+	}
+	for _, e := range ab.OpenAICompatible {
+		if e.Available && has(e.Models) {
+			return ability.LLMOption{OpenAICompatible: &ability.OpenAICompatibleOption{
+				Endpoint:      e.Name,
+				ChatGPTOption: *chatGPTOption(),
+			}}, true
+		}
+	}
+	return ability.LLMOption{}, false
+}
+
+// sttOption builds an option for the first provider that advertises model, Google recognizers are models
+func (f *OpenAIFacade) sttOption(ctx context.Context, model, language string) (ability.STTOption, bool) {
+	ab := f.talker.ability(ctx).STT
+	switch {
+	case ab.Whisper.Available && slices.Contains(ab.Whisper.Models, model):
+		return ability.STTOption{Whisper: &ability.WhisperOption{Model: model}}, true
+	case ab.AzureWhisper.Available && slices.Contains(ab.AzureWhisper.Models, model):
+		return ability.STTOption{AzureWhisper: &ability.WhisperOption{Model: model}}, true
+	case ab.LocalWhisper.Available && slices.Contains(ab.LocalWhisper.Models, model):
+		return ability.STTOption{LocalWhisper: &ability.WhisperOption{Model: model}}, true
+	case ab.Google.Available && hasTaggedItem(ab.Google.Recognizers, model):
+		return ability.STTOption{Google: &ability.GoogleSTTOption{Recognizer: model, Language: language}}, true
+	}
+	return ability.STTOption{}, false
+}
+
+// ttsOption
+// builds an option for OpenAI if it advertises the model of req, otherwise for the first provider that
+// advertises the voice of req
+func (f *OpenAIFacade) ttsOption(ctx context.Context, req openai.CreateSpeechRequest) (ability.TTSOption, bool) {
+	ab := f.talker.ability(ctx).TTS
+	voice := string(req.Voice)
+	switch {
+	case ab.OpenAI.Available && slices.Contains(ab.OpenAI.Models, string(req.Model)):
+		o := ability.DefaultOpenAITTSOption()
+		o.Model = string(req.Model)
+		if voice != "" {
+			o.Voice = voice
+		}
+		if req.Speed > 0 {
+			o.Speed = req.Speed
+		}
+		if req.ResponseFormat != "" {
+			o.ResponseFormat = string(req.ResponseFormat)
+		}
+		return ability.TTSOption{OpenAI: o}, true
+	case voice == "":
+		return ability.TTSOption{}, false
+	case ab.Elevenlabs.Available && hasTaggedItem(ab.Elevenlabs.Voices, voice):
+		o := ability.DefaultElevenlabsTTSOption()
+		o.VoiceId = voice
+		return ability.TTSOption{Elevenlabs: o}, true
+	case ab.Google.Available && hasTaggedItem(ab.Google.Voices, voice):
+		o := ability.DefaultGoogleTTSOption()
+		o.VoiceId = voice
+		if req.Speed > 0 {
+			o.SpeakingRate = req.Speed
+		}
+		return ability.TTSOption{Google: o}, true
+	case ab.Piper.Available && hasTaggedItem(ab.Piper.Voices, voice):
+		o := ability.DefaultPiperTTSOption()
+		o.VoiceId = voice
+		return ability.TTSOption{Piper: o}, true
+	}
+	return ability.TTSOption{}, false
+}
+
+func hasTaggedItem(items []ability.TaggedItem, id string) bool {
+	return slices.ContainsFunc(items, func(i ability.TaggedItem) bool { return i.Id == id })
+}
+
+// messageContent joins text parts of m, images are not supported
+func messageContent(m openai.ChatCompletionMessage) string {
+	if m.Content != "" || len(m.MultiContent) == 0 {
+		return m.Content
+	}
+	var texts []string
+	for _, p := range m.MultiContent {
+		if p.Type == openai.ChatMessagePartTypeText {
+			texts = append(texts, p.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// audioContentType sniffs the format of audio, providers return mp3 unless told otherwise
+func audioContentType(audio []byte) string {
+	ct := http.DetectContentType(audio)
+	if strings.HasPrefix(ct, "audio/") {
+		return ct
+	}
+	return "audio/mpeg"
+}
+
+// takeRequest takes a request and amount of metric, or neither if either doesn't fit in the quota
+func takeRequest(ctx context.Context, quota *Quota, metric string, amount int64) error {
+	if err := quota.Take(ctx, metric, amount); err != nil {
+		return err
+	}
+	if err := quota.Take(ctx, quotaRequests, 1); err != nil {
+		quota.Refund(ctx, metric, amount)
+		return err
+	}
+	return nil
+}
+
+// quotaError replies 429 with Retry-After, like OpenAI does when a rate limit is reached
+func quotaError(c echo.Context, err error) error {
+	var qe *QuotaError
+	if !errors.As(err, &qe) {
+		return err
+	}
+	retryAfter := max(1, int(math.Ceil(time.Until(qe.ResetAt).Seconds())))
+	c.Response().Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	return c.JSON(http.StatusTooManyRequests, openai.ErrorResponse{Error: &openai.APIError{
+		Message: qe.Error(),
+		Type:    "rate_limit_error",
+		Code:    qe.Metric,
+	}})
+}
+
+// openAIError replies an error in the format of OpenAI API
+func openAIError(c echo.Context, status int, msg string) error {
+	typ := "invalid_request_error"
+	if status >= http.StatusInternalServerError {
+		typ = "server_error"
+	}
+	return c.JSON(status, openai.ErrorResponse{Error: &openai.APIError{Message: msg, Type: typ}})
+}
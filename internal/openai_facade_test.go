@@ -0,0 +1,152 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/proxoar/talk/pkg/ability"
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+)
+
+// newFakeFacade returns a facade whose talker advertises a fixed ability, which is removed by the returned func
+func newFakeFacade() (*OpenAIFacade, func()) {
+	talker := &Talker{logger: zap.NewNop()}
+	talker.set.Store(&providerSet{})
+	TalkCache.PutAbility(ability.Ability{
+		LLM: ability.LLMAblt{
+			Available: true,
+			ChatGPT:   ability.ChatGPTAblt{Available: true, Models: []ability.Model{{Name: "gpt-4o"}}},
+			OpenAICompatible: []ability.OpenAICompatibleAblt{
+				{Name: "ollama", Available: true, Models: []ability.Model{{Name: "llama3"}}},
+			},
+		},
+		TTS: ability.TTSAblt{
+			Available:  true,
+			OpenAI:     ability.OpenAITTSAblt{Available: true, Models: []string{"tts-1"}},
+			Elevenlabs: ability.ElevenlabsTTSAblt{Available: true, Voices: []ability.TaggedItem{{Id: "rachel"}}},
+		},
+		STT: ability.STTAblt{
+			Available: true,
+			Google:    ability.GoogleSTTAb{Available: true, Recognizers: []ability.TaggedItem{{Id: "latest_long"}}},
+		},
+	})
+	return NewOpenAIFacade(talker, nil, zap.NewNop()), TalkCache.DeleteAbility
+}
+
+func TestOpenAIFacadeOption(t *testing.T) {
+	f, cleanup := newFakeFacade()
+	defer cleanup()
+	ctx := context.Background()
+
+	chatGPT := ability.DefaultChatGPTOption()
+	chatGPT.Model, chatGPT.MaxTokens = "gpt-4o", 100
+	compatible := ability.DefaultChatGPTOption()
+	compatible.Model = "llama3"
+	openAITTS := ability.DefaultOpenAITTSOption()
+	openAITTS.Voice = "nova"
+	elevenlabs := ability.DefaultElevenlabsTTSOption()
+	elevenlabs.VoiceId = "rachel"
+
+	tests := []struct {
+		name   string
+		option func() (any, bool)
+		want   any
+		wantOK bool
+	}{
+		{
+			name: "ChatGPT model",
+			option: func() (any, bool) {
+				return f.llmOption(ctx, openai.ChatCompletionRequest{Model: "gpt-4o", MaxTokens: 100})
+			},
+			want:   ability.LLMOption{ChatGPT: chatGPT},
+			wantOK: true,
+		},
+		{
+			name:   "model of an OpenAI-compatible endpoint",
+			option: func() (any, bool) { return f.llmOption(ctx, openai.ChatCompletionRequest{Model: "llama3"}) },
+			want:   ability.LLMOption{OpenAICompatible: &ability.OpenAICompatibleOption{Endpoint: "ollama", ChatGPTOption: *compatible}},
+			wantOK: true,
+		},
+		{
+			name:   "unknown model",
+			option: func() (any, bool) { return f.llmOption(ctx, openai.ChatCompletionRequest{Model: "gpt-0"}) },
+			want:   ability.LLMOption{},
+		},
+		{
+			name: "OpenAI speech model",
+			option: func() (any, bool) {
+				return f.ttsOption(ctx, openai.CreateSpeechRequest{Model: "tts-1", Voice: "nova"})
+			},
+			want:   ability.TTSOption{OpenAI: openAITTS},
+			wantOK: true,
+		},
+		{
+			name: "voice of ElevenLabs",
+			option: func() (any, bool) {
+				return f.ttsOption(ctx, openai.CreateSpeechRequest{Model: "eleven_multilingual_v2", Voice: "rachel"})
+			},
+			want:   ability.TTSOption{Elevenlabs: elevenlabs},
+			wantOK: true,
+		},
+		{
+			name: "unknown voice",
+			option: func() (any, bool) {
+				return f.ttsOption(ctx, openai.CreateSpeechRequest{Model: "eleven_multilingual_v2", Voice: "alloy"})
+			},
+			want: ability.TTSOption{},
+		},
+		{
+			name:   "Google recognizer",
+			option: func() (any, bool) { return f.sttOption(ctx, "latest_long", "en-US") },
+			want:   ability.STTOption{Google: &ability.GoogleSTTOption{Recognizer: "latest_long", Language: "en-US"}},
+			wantOK: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := tt.option()
+			if ok != tt.wantOK || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("option = %+v, %v, want %+v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestOpenAIFacadeNotFound(t *testing.T) {
+	f, cleanup := newFakeFacade()
+	defer cleanup()
+
+	tests := []struct {
+		name        string
+		handler     echo.HandlerFunc
+		contentType string
+		body        string
+	}{
+		{name: "chat completions", handler: f.ChatCompletions, contentType: echo.MIMEApplicationJSON,
+			body: `{"model":"gpt-0","messages":[{"role":"user","content":"hi"}]}`},
+		{name: "speech", handler: f.Speech, contentType: echo.MIMEApplicationJSON,
+			body: `{"model":"tts-0","input":"hi","voice":"alloy"}`},
+		{name: "transcriptions", handler: f.Transcriptions, contentType: echo.MIMEApplicationForm,
+			body: url.Values{"model": {"whisper-0"}}.Encode()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			req.Header.Set(echo.HeaderContentType, tt.contentType)
+			rec := httptest.NewRecorder()
+			if err := tt.handler(echo.New().NewContext(req, rec)); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != http.StatusNotFound || !strings.Contains(rec.Body.String(), "invalid_request_error") {
+				t.Errorf("response = %d %s, want %d", rec.Code, rec.Body.String(), http.StatusNotFound)
+			}
+		})
+	}
+}
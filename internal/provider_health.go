@@ -0,0 +1,152 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/proxoar/talk/internal/api"
+	"github.com/proxoar/talk/pkg/client"
+	"go.uber.org/zap"
+)
+
+const healthCheckTimeout = 30 * time.Second
+
+// Broadcaster sends an event to every connected client, which is implemented by SSE and WebSocket
+type Broadcaster interface {
+	Broadcast(eventName string, data interface{})
+}
+
+// ProviderHealth
+// keeps the latest health check result of each provider, which is refreshed periodically if interval > 0.
+//
+// Once a check finds that the status of a provider has changed, it's logged and sent to every client
+// as api.ProviderStatusChanged in EventSystemNotification.
+type ProviderHealth struct {
+	talker       *Talker
+	interval     time.Duration
+	broadcasters []Broadcaster
+	// checkMu makes concurrent checks wait for the running one, instead of sending requests again
+	checkMu  sync.Mutex
+	mu       sync.Mutex
+	statuses []api.ProviderStatus // nil until the first check
+	logger   *zap.Logger
+}
+
+func NewProviderHealth(talker *Talker, interval time.Duration, logger *zap.Logger, broadcasters ...Broadcaster) *ProviderHealth {
+	return &ProviderHealth{
+		talker:       talker,
+		interval:     interval,
+		broadcasters: broadcasters,
+		logger:       logger,
+	}
+}
+
+// Run checks providers on startup if checkNow is true, and then every interval until ctx is done
+func (h *ProviderHealth) Run(ctx context.Context, checkNow bool) {
+	if checkNow {
+		h.Check(ctx)
+	}
+	if h.interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			h.Check(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Statuses returns the cached result, and checks providers if they have never been checked
+func (h *ProviderHealth) Statuses(ctx context.Context) []api.ProviderStatus {
+	h.mu.Lock()
+	statuses := h.statuses
+	h.mu.Unlock()
+	if statuses != nil {
+		return statuses
+	}
+	return h.Check(ctx)
+}
+
+// Reset drops the cached result, e.g. once providers are reloaded
+func (h *ProviderHealth) Reset() {
+	h.mu.Lock()
+	h.statuses = nil
+	h.mu.Unlock()
+}
+
+// Check checks all providers now, and notifies clients of changed status
+func (h *ProviderHealth) Check(ctx context.Context) []api.ProviderStatus {
+	started := time.Now()
+	h.checkMu.Lock()
+	defer h.checkMu.Unlock()
+	h.mu.Lock()
+	prev := h.statuses
+	h.mu.Unlock()
+	// another check has finished while waiting for it
+	if len(prev) > 0 && prev[0].CheckedAt.After(started) {
+		return prev
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	statuses := h.talker.CheckHealth(ctx)
+
+	h.mu.Lock()
+	h.statuses = statuses
+	h.mu.Unlock()
+
+	for _, s := range statuses {
+		p, found := findProviderStatus(prev, s.Kind, s.Name)
+		if found && p.Status == s.Status {
+			continue
+		}
+		h.log(s)
+		if !found {
+			// clients are told about providers by EventSystemAbility, and about their status by changes afterwards
+			continue
+		}
+		n := api.ProviderStatusChanged{Notification: notificationOf(s), ProviderStatus: s}
+		for _, b := range h.broadcasters {
+			b.Broadcast(api.EventSystemNotification, n)
+		}
+	}
+	return statuses
+}
+
+func (h *ProviderHealth) log(s api.ProviderStatus) {
+	switch s.Status {
+	case client.StatusHealthy:
+		h.logger.Sugar().Infof("[%s] is healthy", s.Name)
+	case client.StatusDegraded:
+		h.logger.Sugar().Warnf("[%s] bad smell: %s", s.Name, s.Message)
+	default:
+		h.logger.Sugar().Errorf("[%s] %s", s.Name, s.Message)
+	}
+}
+
+func findProviderStatus(statuses []api.ProviderStatus, kind, name string) (api.ProviderStatus, bool) {
+	for _, s := range statuses {
+		if s.Kind == kind && s.Name == name {
+			return s, true
+		}
+	}
+	return api.ProviderStatus{}, false
+}
+
+func notificationOf(s api.ProviderStatus) api.Notification {
+	switch s.Status {
+	case client.StatusHealthy:
+		return api.Notification{Level: "info", Message: fmt.Sprintf("%s has recovered", s.Name)}
+	case client.StatusDegraded:
+		return api.Notification{Level: "warn", Message: fmt.Sprintf("%s may not work well: %s", s.Name, s.Message)}
+	default:
+		return api.Notification{Level: "error", Message: fmt.Sprintf("%s is unavailable: %s", s.Name, s.Message)}
+	}
+}
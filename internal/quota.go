@@ -0,0 +1,238 @@
+package internal
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/proxoar/talk/internal/config"
+	"github.com/proxoar/talk/internal/middleware"
+	"github.com/proxoar/talk/internal/storage"
+	"go.uber.org/zap"
+)
+
+const (
+	quotaRequests      = "requests"
+	quotaLLMTokens     = "llm-tokens"
+	quotaTTSCharacters = "tts-characters"
+	quotaSTTSeconds    = "stt-seconds"
+
+	// bitrate of audio recorded by browsers, e.g. webm/opus, to estimate duration from size
+	assumedAudioBytesPerSecond = 32_000 / 8
+)
+
+// QuotaError is returned when a call would exceed the quota of an identity
+type QuotaError struct {
+	Metric  string
+	Limit   int64
+	Used    int64
+	ResetAt time.Time
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("quota of %s is exceeded, %d of %d has been used, it resets at %s",
+		e.Metric, e.Used, e.Limit, e.ResetAt.Format(time.RFC3339))
+}
+
+// Quotas
+// counts usage of each identity, and refuses calls beyond limits in config.
+//
+// Requests are counted in memory by minute. Other usage is counted by day or month, in storage if it's
+// available so that it survives restarts, or in memory otherwise. Periods are in UTC.
+type Quotas struct {
+	conf  config.QuotaConfig
+	store *storage.Storage
+	mu    sync.Mutex
+	// identity|metric|period -> amount
+	mem    map[string]int64
+	logger *zap.Logger
+}
+
+func NewQuotas(conf config.QuotaConfig, store *storage.Storage, logger *zap.Logger) *Quotas {
+	return &Quotas{
+		conf:   conf,
+		store:  store,
+		mem:    map[string]int64{},
+		logger: logger,
+	}
+}
+
+// Quota is Quotas of an identity
+type Quota struct {
+	quotas *Quotas
+	id     middleware.Identity
+	limits config.QuotaLimits
+}
+
+// For returns the quota of id, which is nil if no limit applies to id
+func (q *Quotas) For(id middleware.Identity) *Quota {
+	l := q.conf.Default
+	for _, iq := range q.conf.Identities {
+		if iq.Name != "" && iq.Name == id.Name {
+			l = overrideLimits(l, iq.QuotaLimits)
+		}
+	}
+	if l == (config.QuotaLimits{}) {
+		return nil
+	}
+	return &Quota{quotas: q, id: id, limits: l}
+}
+
+func overrideLimits(l, o config.QuotaLimits) config.QuotaLimits {
+	pick := func(v, o int64) int64 {
+		switch {
+		case o < 0:
+			return 0
+		case o > 0:
+			return o
+		default:
+			return v
+		}
+	}
+	return config.QuotaLimits{
+		RequestsPerMinute:     pick(l.RequestsPerMinute, o.RequestsPerMinute),
+		LLMTokensPerDay:       pick(l.LLMTokensPerDay, o.LLMTokensPerDay),
+		TTSCharactersPerMonth: pick(l.TTSCharactersPerMonth, o.TTSCharactersPerMonth),
+		STTSecondsPerDay:      pick(l.STTSecondsPerDay, o.STTSecondsPerDay),
+	}
+}
+
+// Take counts amount in the quota of metric, or returns a QuotaError if it doesn't fit in the rest of the quota.
+// Both are done in one step, so that concurrent calls can't exceed the quota together. A nil Quota has no limit.
+//
+// Usage that is unknown until a call finishes is taken as estimated before the call, and adjusted by Add or Refund
+// after the call.
+func (q *Quota) Take(ctx context.Context, metric string, amount int64) error {
+	if q == nil || amount <= 0 {
+		return nil
+	}
+	limit := q.limit(metric)
+	if limit <= 0 {
+		return nil
+	}
+	period, resetAt := quotaPeriod(metric, time.Now().UTC())
+	used, ok, err := q.quotas.add(ctx, q.id.Key, metric, period, amount, limit)
+	if err != nil {
+		// don't block users because of a broken counter
+		q.quotas.logger.Sugar().Error("failed to count usage: ", err)
+		return nil
+	}
+	if !ok {
+		return &QuotaError{Metric: metric, Limit: limit, Used: used, ResetAt: resetAt}
+	}
+	return nil
+}
+
+// Add counts amount in the quota of metric after a call, even if it exceeds the quota.
+// It's counted even if ctx has been cancelled, e.g. by a cancel of the ticket or a disconnect of the client.
+func (q *Quota) Add(ctx context.Context, metric string, amount int64) {
+	q.adjust(ctx, metric, amount)
+}
+
+// Refund gives back amount taken by Take, e.g. when the call fails
+func (q *Quota) Refund(ctx context.Context, metric string, amount int64) {
+	q.adjust(ctx, metric, -amount)
+}
+
+func (q *Quota) adjust(ctx context.Context, metric string, amount int64) {
+	if q == nil || amount == 0 || q.limit(metric) <= 0 {
+		return
+	}
+	period, _ := quotaPeriod(metric, time.Now().UTC())
+	// usage of a cancelled call has been made all the same
+	ctx = context.WithoutCancel(ctx)
+	if _, _, err := q.quotas.add(ctx, q.id.Key, metric, period, amount, 0); err != nil {
+		q.quotas.logger.Sugar().Error("failed to count usage: ", err)
+	}
+}
+
+func (q *Quota) limit(metric string) int64 {
+	switch metric {
+	case quotaRequests:
+		return q.limits.RequestsPerMinute
+	case quotaLLMTokens:
+		return q.limits.LLMTokensPerDay
+	case quotaTTSCharacters:
+		return q.limits.TTSCharactersPerMonth
+	case quotaSTTSeconds:
+		return q.limits.STTSecondsPerDay
+	default:
+		return 0
+	}
+}
+
+// persistent returns false for requests, which are counted by minute and not worth keeping
+func (q *Quotas) persistent(metric string) bool {
+	return q.store != nil && metric != quotaRequests
+}
+
+// add adds amount to the usage of metric unless the total would exceed limit, and returns the total and whether
+// amount is added. limit <= 0 means no limit
+func (q *Quotas) add(ctx context.Context, identity, metric, period string, amount, limit int64) (int64, bool, error) {
+	if q.persistent(metric) {
+		return q.store.AddUsage(ctx, identity, metric, period, amount, limit)
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	// drop counters of past periods
+	for k := range q.mem {
+		if strings.HasPrefix(k, identity+"|"+metric+"|") && !strings.HasSuffix(k, "|"+period) {
+			delete(q.mem, k)
+		}
+	}
+	key := identity + "|" + metric + "|" + period
+	used := q.mem[key]
+	if limit > 0 && used+amount > limit {
+		return used, false, nil
+	}
+	q.mem[key] = max(0, used+amount)
+	return q.mem[key], true, nil
+}
+
+// quotaPeriod returns the period of metric that contains now, and when the next period starts
+func quotaPeriod(metric string, now time.Time) (string, time.Time) {
+	switch metric {
+	case quotaRequests:
+		start := now.Truncate(time.Minute)
+		return start.Format("2006-01-02T15:04"), start.Add(time.Minute)
+	case quotaTTSCharacters:
+		start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return start.Format("2006-01"), start.AddDate(0, 1, 0)
+	default:
+		start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		return start.Format("2006-01-02"), start.AddDate(0, 0, 1)
+	}
+}
+
+// estimateTokens
+// is a rough estimate that works for both English, about 4 characters per token, and CJK, about 1 character
+// per token, without a tokenizer of each provider
+func estimateTokens(ms ...string) int64 {
+	var n int64
+	for _, m := range ms {
+		runes := utf8.RuneCountInString(m)
+		ascii := 0
+		for i := 0; i < len(m); i++ {
+			if m[i] < utf8.RuneSelf {
+				ascii++
+			}
+		}
+		n += int64(ascii+3)/4 + int64(runes-ascii)
+	}
+	return n
+}
+
+// estimateAudioSeconds reads the duration of WAV from its header, and estimates it from size for other formats
+func estimateAudioSeconds(audio []byte, fileName string) int64 {
+	if strings.EqualFold(filepath.Ext(fileName), ".wav") && len(audio) > 44 && string(audio[8:12]) == "WAVE" {
+		if byteRate := binary.LittleEndian.Uint32(audio[28:32]); byteRate > 0 {
+			return max(1, int64(len(audio)-44)/int64(byteRate))
+		}
+	}
+	return max(1, int64(len(audio))/assumedAudioBytesPerSecond)
+}
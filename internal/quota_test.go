@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/proxoar/talk/internal/config"
+	"github.com/proxoar/talk/internal/middleware"
+	"github.com/proxoar/talk/internal/storage"
+	"go.uber.org/zap"
+)
+
+func TestQuota(t *testing.T) {
+	store, err := storage.Open(filepath.Join(t.TempDir(), "talk.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = store.Close() }()
+	limits := config.QuotaConfig{Default: config.QuotaLimits{RequestsPerMinute: 5, LLMTokensPerDay: 100}}
+
+	tests := []struct {
+		name   string
+		store  *storage.Storage
+		metric string
+		limit  int64
+	}{
+		{name: "in memory", metric: quotaRequests, limit: 5},
+		{name: "in storage", store: store, metric: quotaLLMTokens, limit: 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := NewQuotas(limits, tt.store, zap.NewNop()).For(middleware.Identity{Key: "alice"})
+			ctx := context.Background()
+
+			// a burst of calls can't exceed the limit together
+			var mu sync.Mutex
+			taken := int64(0)
+			var wg sync.WaitGroup
+			for i := int64(0); i < tt.limit*3; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if q.Take(ctx, tt.metric, 1) == nil {
+						mu.Lock()
+						taken++
+						mu.Unlock()
+					}
+				}()
+			}
+			wg.Wait()
+			if taken != tt.limit {
+				t.Fatalf("Take() succeeded %d times, want %d", taken, tt.limit)
+			}
+
+			// usage is given back and counted even if the call has been cancelled
+			cancelled, cancel := context.WithCancel(ctx)
+			cancel()
+			q.Refund(cancelled, tt.metric, 2)
+			if err := q.Take(ctx, tt.metric, 2); err != nil {
+				t.Errorf("Take() after Refund() error = %v", err)
+			}
+			q.Add(cancelled, tt.metric, 1)
+			var qe *QuotaError
+			if err := q.Take(ctx, tt.metric, 1); !errors.As(err, &qe) || qe.Used != tt.limit+1 {
+				t.Errorf("Take() after Add() error = %v, want QuotaError with %d used", err, tt.limit+1)
+			}
+		})
+	}
+}
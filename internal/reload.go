@@ -0,0 +1,57 @@
+package internal
+
+import (
+	"context"
+	"reflect"
+	"time"
+
+	"github.com/proxoar/talk/internal/api"
+	"github.com/proxoar/talk/internal/config"
+	middleware2 "github.com/proxoar/talk/internal/middleware"
+	"go.uber.org/zap"
+)
+
+// reloader
+// applies a changed config to the running server, see config.WatchConfig.
+//
+// Providers, creds, fallback chains, retry policies and server.passwords take effect at once, while tickets that
+// have started keep running on their providers. Other changes, such as port, accounts and quota, need a restart.
+type reloader struct {
+	conf         config.TalkConfig
+	talker       *Talker
+	passwords    *middleware2.Passwords
+	health       *ProviderHealth
+	broadcasters []Broadcaster
+	logger       *zap.Logger
+}
+
+func (r *reloader) reload(c *config.TalkConfig) {
+	if err := r.talker.Reload(*c); err != nil {
+		r.logger.Sugar().Error("failed to reload providers, keep the current ones: ", err)
+		return
+	}
+	r.conf.Creds, r.conf.SpeechToText, r.conf.TextToSpeech, r.conf.Llm = c.Creds, c.SpeechToText, c.TextToSpeech, c.Llm
+	r.conf.Fallback, r.conf.Retry = c.Fallback, c.Retry
+
+	// the auth middleware is chosen on startup, so passwords can be changed but not added or removed altogether
+	if (len(r.conf.Server.Passwords) == 0) == (len(c.Server.Passwords) == 0) {
+		r.passwords.Set(c.Server.Passwords)
+		r.conf.Server.Passwords = c.Server.Passwords
+	}
+	if !reflect.DeepEqual(r.conf.Server, c.Server) || !reflect.DeepEqual(r.conf.Quota, c.Quota) {
+		r.logger.Warn("changes of server and quota other than passwords take effect after a restart")
+	}
+
+	TalkCache.DeleteAbility()
+	r.health.Reset()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	errs, ab := r.talker.Ability(ctx)
+	for i, v := range errs {
+		r.logger.Sugar().Errorf("error-%d when getting Ability: %s", i, v)
+	}
+	for _, b := range r.broadcasters {
+		b.Broadcast(api.EventSystemAbility, ab)
+	}
+	r.logger.Info("config is reloaded")
+}
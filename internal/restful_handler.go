@@ -1,28 +1,42 @@
 package internal
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"net/http"
+	"strconv"
 
 	"github.com/labstack/echo/v4"
 	"github.com/proxoar/talk/internal/api"
 	"github.com/proxoar/talk/internal/middleware"
+	"github.com/proxoar/talk/internal/storage"
+	"github.com/proxoar/talk/internal/util"
 	"github.com/tidwall/pretty"
 	"go.uber.org/zap"
 )
 
 type RestfulEHandler struct {
-	sse    *SSE
-	talker *Talker
-	logger *zap.Logger
+	sse     *SSE
+	talker  *Talker
+	tickets *Tickets
+	// storage is nil if persistence is disabled
+	storage *storage.Storage
+	quotas  *Quotas
+	health  *ProviderHealth
+	logger  *zap.Logger
 }
 
-func NewRestfulEHandler(talker *Talker, sse *SSE, logger *zap.Logger) *RestfulEHandler {
+func NewRestfulEHandler(talker *Talker, sse *SSE, tickets *Tickets, storage *storage.Storage, quotas *Quotas, health *ProviderHealth,
+	logger *zap.Logger) *RestfulEHandler {
 	return &RestfulEHandler{
-		sse:    sse,
-		talker: talker,
-		logger: logger,
+		sse:     sse,
+		talker:  talker,
+		tickets: tickets,
+		storage: storage,
+		quotas:  quotas,
+		health:  health,
+		logger:  logger,
 	}
 }
 
@@ -38,7 +52,7 @@ func (h *RestfulEHandler) PostChat(c echo.Context) error {
 	}
 	id := c.Get(middleware.StreamIdKey).(string)
 	h.logger.Sugar().Debug("option from client req", prettyJson(chat.TalkOption))
-	handler := NewChatHandler(id, chat.ChatId, chat.TicketId, chat.TalkOption, h.sse, h.talker, h.logger)
+	handler := h.newChatHandler(c, id, chat, h.sse)
 	go func() {
 		handler.Start(chat.Ms, nil)
 	}()
@@ -46,48 +60,189 @@ func (h *RestfulEHandler) PostChat(c echo.Context) error {
 }
 
 func (h *RestfulEHandler) PostAudioChat(c echo.Context) error {
-	// there are 2 files in the form: "chat" and "file"
+	chat, ar, err := h.bindAudioChat(c)
+	if err != nil {
+		return err
+	}
+	id := c.Get(middleware.StreamIdKey).(string)
+	handler := h.newChatHandler(c, id, chat, h.sse)
+	go func() {
+		handler.Start(chat.Ms, ar)
+	}()
+	return c.NoContent(http.StatusOK)
+}
+
+// PostChatSync is PostChat that replies with the result of the chat once it finishes, instead of sending
+// events to a stream
+func (h *RestfulEHandler) PostChatSync(c echo.Context) error {
+	chat := new(api.Chat)
+	err := c.Bind(chat)
+	if err != nil {
+		return err
+	}
+	err = api.RestfulValidator.Struct(chat)
+	if err != nil {
+		return err
+	}
+	h.logger.Sugar().Debug("option from client req", prettyJson(chat.TalkOption))
+	return h.chatSync(c, chat, nil)
+}
+
+// PostAudioChatSync is PostAudioChat that replies with the result of the chat once it finishes,
+// see PostChatSync
+func (h *RestfulEHandler) PostAudioChatSync(c echo.Context) error {
+	chat, ar, err := h.bindAudioChat(c)
+	if err != nil {
+		return err
+	}
+	return h.chatSync(c, chat, ar)
+}
+
+func (h *RestfulEHandler) chatSync(c echo.Context, chat *api.Chat, ar *AudioReader) error {
+	// the stream is private to the request, nobody else can cancel its ticket
+	streamId := util.RandomHash16Chars()
+	col := newChatCollector(chat.ChatId, chat.TicketId)
+	handler := h.newChatHandler(c, streamId, chat, col)
+	// stop the chat once client disconnects
+	stop := context.AfterFunc(c.Request().Context(), func() { h.tickets.Cancel(streamId, chat.TicketId) })
+	defer stop()
+	handler.Start(chat.Ms, ar)
+	return c.JSON(http.StatusOK, col.Result())
+}
+
+// newChatHandler returns a ChatHandler limited by the quota of the sender of c
+func (h *RestfulEHandler) newChatHandler(c echo.Context, streamId string, chat *api.Chat, pub Publisher) *ChatHandler {
+	id := middleware.IdentityOf(c)
+	return NewChatHandler(streamId, chat.ChatId, id.Key, chat.TicketId, chat.TalkOption, pub, h.talker, h.tickets, h.storage,
+		h.quotas.For(id), h.logger)
+}
+
+// bindAudioChat reads the form of an audio chat, which has 2 fields: "chat" and "audio"
+func (h *RestfulEHandler) bindAudioChat(c echo.Context) (*api.Chat, *AudioReader, error) {
 	chatStr := c.FormValue("chat")
 	if len(chatStr) == 0 {
 		h.logger.Sugar().Error("chat is empty")
-		return errors.New("chat is empty")
+		return nil, nil, errors.New("chat is empty")
 	}
 
 	chat := new(api.Chat)
 	err := json.Unmarshal([]byte(chatStr), chat)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 	err = api.RestfulValidator.Struct(chat)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 	h.logger.Sugar().Debug("option from client req", prettyJson(chat.TalkOption))
 
 	audioFile, err := c.FormFile("audio")
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 	reader, err := audioFile.Open()
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	filename := audioFile.Filename
-	id := c.Get(middleware.StreamIdKey).(string)
-	ar := AudioReader{
+	ar := &AudioReader{
 		Reader:   reader,
-		FileName: filename,
+		FileName: audioFile.Filename,
 	}
-	handler := NewChatHandler(id, chat.ChatId, chat.TicketId, chat.TalkOption, h.sse, h.talker, h.logger)
-	go func() {
-		handler.Start(chat.Ms, &ar)
-	}()
+	return chat, ar, nil
+}
+
+// CancelChat aborts provider calls of an in-flight ticket, and notifies client with EventMessageCancelled
+func (h *RestfulEHandler) CancelChat(c echo.Context) error {
+	ticketId := c.Param("ticketId")
+	id := c.Get(middleware.StreamIdKey).(string)
+	chatId, ok := h.tickets.Cancel(id, ticketId)
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "ticket is not found or has finished")
+	}
+	h.logger.Sugar().Debug("ticket cancelled: ", ticketId)
+	h.sse.PublishData(id, api.EventMessageCancelled, api.Cancelled{
+		ChatId:   chatId,
+		TicketId: ticketId,
+	})
 	return c.NoContent(http.StatusOK)
 }
 
+// ListChats lists recorded chats of the sender, the most recently updated first
+func (h *RestfulEHandler) ListChats(c echo.Context) error {
+	chats, err := h.storage.Chats(c.Request().Context(), middleware.IdentityOf(c).Key)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, chats)
+}
+
+// GetChat returns a recorded chat and its messages, audio is fetched by GetChatAudio
+func (h *RestfulEHandler) GetChat(c echo.Context) error {
+	chat, ms, err := h.storage.Chat(c.Request().Context(), middleware.IdentityOf(c).Key, c.Param("chatId"))
+	if err != nil {
+		return storageError(err)
+	}
+	return c.JSON(http.StatusOK, api.RecordedChat{Chat: chat, Messages: ms})
+}
+
+// GetChatAudio returns a chunk of audio of a message, seq defaults to 0
+func (h *RestfulEHandler) GetChatAudio(c echo.Context) error {
+	seq := 0
+	if s := c.QueryParam("seq"); s != "" {
+		var err error
+		if seq, err = strconv.Atoi(s); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "seq must be an integer")
+		}
+	}
+	audio, err := h.storage.Audio(c.Request().Context(), middleware.IdentityOf(c).Key, c.Param("chatId"),
+		c.Param("messageId"), seq)
+	if err != nil {
+		return storageError(err)
+	}
+	return c.Blob(http.StatusOK, http.DetectContentType(audio), audio)
+}
+
+func (h *RestfulEHandler) RenameChat(c echo.Context) error {
+	rename := new(api.RenameChat)
+	err := c.Bind(rename)
+	if err != nil {
+		return err
+	}
+	err = api.RestfulValidator.Struct(rename)
+	if err != nil {
+		return err
+	}
+	err = h.storage.RenameChat(c.Request().Context(), middleware.IdentityOf(c).Key, c.Param("chatId"), rename.Title)
+	if err != nil {
+		return storageError(err)
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+func (h *RestfulEHandler) DeleteChat(c echo.Context) error {
+	err := h.storage.DeleteChat(c.Request().Context(), middleware.IdentityOf(c).Key, c.Param("chatId"))
+	if err != nil {
+		return storageError(err)
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+func storageError(err error) error {
+	if errors.Is(err, storage.ErrNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, "chat or message is not found")
+	}
+	return err
+}
+
+// ProvidersStatus returns the latest health check result of each provider, or checks them now if refresh is true
 func (h *RestfulEHandler) ProvidersStatus(c echo.Context) error {
-	// todo test each providers
-	return c.String(http.StatusOK, "")
+	var statuses []api.ProviderStatus
+	if refresh, _ := strconv.ParseBool(c.QueryParam("refresh")); refresh {
+		statuses = h.health.Check(c.Request().Context())
+	} else {
+		statuses = h.health.Statuses(c.Request().Context())
+	}
+	return c.JSON(http.StatusOK, statuses)
 }
 
 func (h *RestfulEHandler) Health(c echo.Context) error {
@@ -0,0 +1,76 @@
+// Package secret resolves references to secrets kept outside the config file, such as
+// file:/run/secrets/openai, env:OPENAI_KEY and vault:secret/talk#openai.
+//
+// Errors mention references but never secrets, so that they can be logged.
+package secret
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Provider resolves a reference to a secret, i.e. the part after "<scheme>:"
+type Provider interface {
+	Resolve(ctx context.Context, ref string) (string, error)
+}
+
+// ProviderFunc is a Provider of a function
+type ProviderFunc func(ctx context.Context, ref string) (string, error)
+
+func (f ProviderFunc) Resolve(ctx context.Context, ref string) (string, error) {
+	return f(ctx, ref)
+}
+
+// Resolver resolves a value with the Provider registered for its scheme
+type Resolver struct {
+	providers map[string]Provider
+}
+
+// NewResolver returns a Resolver with file and env registered
+func NewResolver() *Resolver {
+	r := &Resolver{providers: map[string]Provider{}}
+	r.Register("file", ProviderFunc(readFile))
+	r.Register("env", ProviderFunc(lookupEnv))
+	return r
+}
+
+func (r *Resolver) Register(scheme string, p Provider) {
+	r.providers[scheme] = p
+}
+
+// Resolve returns the secret value refers to, or value itself if it doesn't start with a registered scheme,
+// e.g. an API key written inline
+func (r *Resolver) Resolve(ctx context.Context, value string) (string, error) {
+	scheme, ref, found := strings.Cut(value, ":")
+	if !found {
+		return value, nil
+	}
+	p, ok := r.providers[scheme]
+	if !ok {
+		return value, nil
+	}
+	s, err := p.Resolve(ctx, ref)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", value, err)
+	}
+	return s, nil
+}
+
+func readFile(_ context.Context, path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	// files written by editors and `echo` end with a newline
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+func lookupEnv(_ context.Context, name string) (string, error) {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("env %s is not set", name)
+	}
+	return v, nil
+}
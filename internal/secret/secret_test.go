@@ -0,0 +1,121 @@
+package secret
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolver(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "openai")
+	if err := os.WriteFile(file, []byte("sk-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TALK_TEST_OPENAI_KEY", "sk-env")
+
+	tests := []struct {
+		name    string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{name: "inline", value: "sk-inline", want: "sk-inline"},
+		{name: "inline json", value: `{"type": "service_account"}`, want: `{"type": "service_account"}`},
+		{name: "unknown scheme", value: "https://example.com", want: "https://example.com"},
+		{name: "file", value: "file:" + file, want: "sk-file"},
+		{name: "missing file", value: "file:" + file + "-missing", wantErr: true},
+		{name: "env", value: "env:TALK_TEST_OPENAI_KEY", want: "sk-env"},
+		{name: "missing env", value: "env:TALK_TEST_MISSING", wantErr: true},
+	}
+	r := NewResolver()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := r.Resolve(context.Background(), tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Resolve() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Resolve() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeVault serves secret/talk of a KV version 2 engine mounted at secret/
+func fakeVault(t *testing.T, token string) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != token {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.URL.Path != "/v1/secret/data/talk" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(`{"data": {"data": {"openai": "sk-vault", "port": 8000}, "metadata": {"version": 1}}}`))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestVault(t *testing.T) {
+	s := fakeVault(t, "root")
+	tests := []struct {
+		name    string
+		token   string
+		ref     string
+		want    string
+		wantErr bool
+	}{
+		{name: "found", token: "root", ref: "secret/talk#openai", want: "sk-vault"},
+		{name: "missing field", token: "root", ref: "secret/talk#claude", wantErr: true},
+		{name: "not a string", token: "root", ref: "secret/talk#port", wantErr: true},
+		{name: "missing secret", token: "root", ref: "secret/other#openai", wantErr: true},
+		{name: "no field", token: "root", ref: "secret/talk", wantErr: true},
+		{name: "no path", token: "root", ref: "secret#openai", wantErr: true},
+		{name: "denied", token: "wrong", ref: "secret/talk#openai", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewVault(s.URL, tt.token, "").Resolve(context.Background(), tt.ref)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Resolve() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Resolve() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestVaultDevServer runs against a dev server started by `vault server -dev -dev-root-token-id=root`
+// with VAULT_ADDR=http://127.0.0.1:8200 and VAULT_TOKEN=root
+func TestVaultDevServer(t *testing.T) {
+	address, token := os.Getenv("VAULT_ADDR"), os.Getenv("VAULT_TOKEN")
+	if address == "" || token == "" {
+		t.Skip("VAULT_ADDR and VAULT_TOKEN are not set")
+	}
+	body, _ := json.Marshal(map[string]any{"data": map[string]string{"openai": "sk-dev"}})
+	req, _ := http.NewRequest(http.MethodPost, address+"/v1/secret/data/talk-test", bytes.NewReader(body))
+	req.Header.Set("X-Vault-Token", token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("failed to write secret: %s", resp.Status)
+	}
+
+	r := NewResolver()
+	r.Register("vault", NewVault(address, token, ""))
+	got, err := r.Resolve(context.Background(), "vault:secret/talk-test#openai")
+	if err != nil || got != "sk-dev" {
+		t.Errorf("Resolve() = %q, %v, want %q, nil", got, err, "sk-dev")
+	}
+}
@@ -0,0 +1,86 @@
+package secret
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Vault
+// reads secrets from the KV version 2 secrets engine of HashiCorp Vault.
+// A reference is written as <mount>/<path>#<field>, e.g. secret/talk#openai reads field openai of secret talk
+// in the engine mounted at secret/.
+type Vault struct {
+	address   string
+	token     string
+	namespace string
+	client    *http.Client
+}
+
+// NewVault returns a Vault of the server at address, e.g. http://127.0.0.1:8200, namespace is optional
+func NewVault(address, token, namespace string) *Vault {
+	return &Vault{
+		address:   strings.TrimSuffix(address, "/"),
+		token:     token,
+		namespace: namespace,
+		client:    http.DefaultClient,
+	}
+}
+
+func (v *Vault) Resolve(ctx context.Context, ref string) (string, error) {
+	p, field, found := strings.Cut(ref, "#")
+	if !found || field == "" {
+		return "", fmt.Errorf("field is missing, write it as <mount>/<path>#<field>")
+	}
+	mount, path, found := strings.Cut(strings.Trim(p, "/"), "/")
+	if !found || path == "" {
+		return "", fmt.Errorf("path is missing, write it as <mount>/<path>#<field>")
+	}
+
+	u := fmt.Sprintf("%s/v1/%s/data/%s", v.address, url.PathEscape(mount), path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	if v.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.namespace)
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return "", fmt.Errorf("secret %s is not found in Vault", p)
+	case http.StatusForbidden:
+		return "", fmt.Errorf("permission denied by Vault, check the token and its policies")
+	default:
+		// the body is not included, in case it echoes anything sensitive
+		return "", fmt.Errorf("unexpected status from Vault: %s", resp.Status)
+	}
+
+	var body struct {
+		Data struct {
+			Data map[string]any `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("failed to decode response from Vault: %w", err)
+	}
+	value, ok := body.Data.Data[field]
+	if !ok {
+		return "", fmt.Errorf("secret %s has no field %s", p, field)
+	}
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("field %s of secret %s is not a string", field, p)
+	}
+	return s, nil
+}
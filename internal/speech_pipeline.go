@@ -0,0 +1,158 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+
+	. "github.com/proxoar/talk/internal/api"
+	"github.com/proxoar/talk/internal/metrics"
+	"github.com/proxoar/talk/internal/storage"
+	"github.com/proxoar/talk/internal/tracing"
+	"github.com/proxoar/talk/internal/util"
+	"github.com/proxoar/talk/pkg/ability"
+	"github.com/proxoar/talk/pkg/client"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// it's not a commercial project, and feel free to utilise ample capacity
+const sentenceChanCap = 1000
+
+// speechPipeline
+// synthesizes streamed text sentence by sentence, and publishes each sentence as an ordered chunk of one audio message.
+//
+// Sentences are synthesized one after another, so the client can start playback after the first chunk
+// while the following ones are being synthesized.
+type speechPipeline struct {
+	c    *ChatHandler
+	ctx  context.Context
+	meta MessageMeta
+	// textMessageId is the message whose text is synthesized, chunks are recorded as its audio
+	textMessageId string
+	// tts is the provider in use, which is switched for the rest of sentences once it falls back
+	tts       Fallback[client.TextToSpeech, ability.TTSOption]
+	splitter  util.SentenceSplitter
+	sentences chan string
+	closed    atomic.Bool
+	aborted   atomic.Bool
+	done      chan struct{}
+}
+
+// newSpeechPipeline returns nil if there is no available text-to-speech provider
+func (c *ChatHandler) newSpeechPipeline(ctx context.Context, role client.Role, textMessageId string) *speechPipeline {
+	meta := MessageMeta{
+		ChatId:    c.chatId,
+		TicketId:  c.ticketId,
+		MessageID: util.RandomHash16Chars(),
+		Role:      role,
+	}
+
+	tts, ok := c.talker.SelectTTSProvider(c.o.TTSOption)
+	if !ok {
+		c.publishError(ctx, meta, kindTTS, "No text-to-speech providers are available")
+		return nil
+	}
+
+	go func() { c.pub.PublishData(c.streamId, EventMessageThinking, meta) }()
+
+	p := &speechPipeline{
+		c:             c,
+		ctx:           ctx,
+		meta:          meta,
+		textMessageId: textMessageId,
+		tts:           Fallback[client.TextToSpeech, ability.TTSOption]{Name: ttsOptionName(*c.o.TTSOption), Provider: tts, Option: *c.o.TTSOption},
+		sentences:     make(chan string, sentenceChanCap),
+		done:          make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// Write is not safe for concurrent use
+func (p *speechPipeline) Write(r rune) {
+	if sentence, ok := p.splitter.Write(r); ok {
+		p.sentences <- sentence
+	}
+}
+
+// Close synthesizes the remaining text and waits until all chunks are published
+func (p *speechPipeline) Close() {
+	if rest := p.splitter.Flush(); rest != "" {
+		p.sentences <- rest
+	}
+	p.closed.Store(true)
+	close(p.sentences)
+	<-p.done
+}
+
+// Abort drops sentences that haven't been synthesized and waits until the pipeline stops.
+// The message still ends with a chunk marked Final.
+func (p *speechPipeline) Abort() {
+	p.aborted.Store(true)
+	p.closed.Store(true)
+	close(p.sentences)
+	<-p.done
+}
+
+func (p *speechPipeline) run() {
+	defer close(p.done)
+	seq := 0
+	final := false
+	failed := false
+	for sentence := range p.sentences {
+		if failed || p.aborted.Load() || p.ctx.Err() != nil {
+			continue
+		}
+		text := strings.TrimSpace(util.RemoveCodeFromText(sentence))
+		if !util.Speakable(text) {
+			continue
+		}
+		chars := int64(utf8.RuneCountInString(text))
+		if p.c.refusedByQuota(p.ctx, p.meta, p.c.quota.Take(p.ctx, quotaTTSCharacters, chars)) {
+			failed = true
+			continue
+		}
+		var audio []byte
+		var err error
+		ctx, span := tracing.Start(p.ctx, "toSpeech", attribute.Int("seq", seq), attribute.Int64("characters", chars))
+		p.tts, err = withFallback(ctx, p.c, p.meta, kindTTS, p.tts, p.c.ttsFallbacks,
+			func(f Fallback[client.TextToSpeech, ability.TTSOption]) (bool, error) {
+				var err error
+				audio, err = f.Provider.TextToSpeech(ctx, text, sentence, f.Option)
+				return false, err
+			})
+		tracing.End(span, err)
+		if err != nil {
+			p.c.quota.Refund(p.ctx, quotaTTSCharacters, chars)
+			p.c.logger.Sugar().Error(err)
+			p.c.publishError(p.ctx, p.meta, kindTTS, fmt.Sprintf("Empty content from text-to-speech sever: \n%s", err))
+			failed = true
+			continue
+		}
+		metrics.AddTTSCharacters(p.tts.Name, chars)
+		// it's the last chunk if no more sentence will come
+		final = p.closed.Load() && len(p.sentences) == 0
+		p.c.pub.PublishData(p.c.streamId, EventMessageAudio, Audio{
+			MessageMeta: p.meta,
+			Audio:       audio,
+			Seq:         seq,
+			Final:       final,
+		})
+		chunkSeq := seq
+		p.c.record(func(s *storage.Storage) error {
+			return s.SaveAudio(context.Background(), p.textMessageId, chunkSeq, audio)
+		})
+		seq++
+	}
+	if !final {
+		// the text ended after the last chunk had been published, there was nothing to speak, or the pipeline
+		// was aborted or failed. Either way client stops waiting for chunks
+		p.c.pub.PublishData(p.c.streamId, EventMessageAudio, Audio{
+			MessageMeta: p.meta,
+			Seq:         seq,
+			Final:       true,
+		})
+	}
+}
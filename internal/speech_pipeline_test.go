@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/proxoar/talk/internal/api"
+	"github.com/proxoar/talk/pkg/ability"
+	"github.com/proxoar/talk/pkg/client"
+	"go.uber.org/zap"
+)
+
+// audioPublisher keeps audio chunks that are published
+type audioPublisher struct {
+	mu     sync.Mutex
+	audios []api.Audio
+}
+
+func (p *audioPublisher) PublishData(_, _ string, data interface{}) {
+	if a, ok := data.(api.Audio); ok {
+		p.mu.Lock()
+		p.audios = append(p.audios, a)
+		p.mu.Unlock()
+	}
+}
+
+// fakeTTS returns err, or the text as audio
+type fakeTTS struct {
+	err error
+}
+
+func (f fakeTTS) TextToSpeech(_ context.Context, text string, _ string, _ ability.TTSOption) ([]byte, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return []byte(text), nil
+}
+
+func (f fakeTTS) CheckHealth(_ context.Context) client.Health {
+	return client.Healthy()
+}
+
+func (f fakeTTS) SetAbility(_ context.Context, _ *ability.TTSAblt) error {
+	return nil
+}
+
+func (f fakeTTS) Support(_ ability.TTSOption) bool {
+	return true
+}
+
+func TestSpeechPipelineFinal(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		abort      bool
+		text       string
+		wantChunks int
+	}{
+		{name: "closed", text: "Hello there. How are you?", wantChunks: 2},
+		{name: "nothing to speak", text: "```go\n```", wantChunks: 1},
+		{name: "all sentences fail", err: errors.New("boom"), text: "Hello there. How are you?", wantChunks: 1},
+		{name: "aborted before any sentence", abort: true, text: "Hello there", wantChunks: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			talker := &Talker{logger: zap.NewNop()}
+			talker.set.Store(&providerSet{ttsProviders: []client.TextToSpeech{fakeTTS{err: tt.err}}})
+			o := api.TalkOption{TTSOption: &ability.TTSOption{OpenAI: &ability.OpenAITTSOption{}}}
+			pub := &audioPublisher{}
+			h := NewChatHandler("stream", "chat", "alice", "ticket", o, pub, talker, NewTickets(), nil, nil, zap.NewNop())
+			defer h.done()
+
+			p := h.newSpeechPipeline(h.ctx, client.RoleAssistant, "message")
+			for _, r := range tt.text {
+				p.Write(r)
+			}
+			if tt.abort {
+				p.Abort()
+			} else {
+				p.Close()
+			}
+
+			pub.mu.Lock()
+			defer pub.mu.Unlock()
+			if len(pub.audios) != tt.wantChunks {
+				t.Errorf("published %d chunks, want %d", len(pub.audios), tt.wantChunks)
+			}
+			// client stops waiting for chunks of the message at the one marked Final
+			for i, a := range pub.audios {
+				if a.Seq != i || a.Final != (i == len(pub.audios)-1) {
+					t.Errorf("chunk %d has seq %d and final %v", i, a.Seq, a.Final)
+				}
+			}
+		})
+	}
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/labstack/echo/v4"
 	"github.com/proxoar/talk/internal/api"
+	"github.com/proxoar/talk/internal/metrics"
 	"github.com/proxoar/talk/internal/util"
 	"github.com/r3labs/sse/v2"
 	"go.uber.org/zap"
@@ -17,11 +18,18 @@ const (
 	keepAliveInterval = 15 * time.Second
 )
 
+// Publisher sends events of api to the client of a stream, which is implemented by SSE and each WebSocket connection
+type Publisher interface {
+	PublishData(streamId, eventName string, data interface{})
+}
+
 type SSE struct {
 	*sse.Server
 	talker         *Talker
 	logger         *zap.Logger
 	keepAliveStops sync.Map
+	// stream id -> struct{}, streams that have subscribers
+	streams sync.Map
 }
 
 func NewSSE(talker *Talker, logger *zap.Logger) *SSE {
@@ -46,6 +54,8 @@ func (s *SSE) HandleEcho(c echo.Context) error {
 
 // emit an Ability to on client subscription, and keepalive
 func (s *SSE) onSubscribe(streamID string, _ *sse.Subscriber) {
+	metrics.SSESubscribed()
+	s.streams.Store(streamID, struct{}{})
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 	errs, ab := s.talker.Ability(ctx)
@@ -64,6 +74,8 @@ func (s *SSE) onSubscribe(streamID string, _ *sse.Subscriber) {
 }
 
 func (s *SSE) onUnsubscribe(streamID string, _ *sse.Subscriber) {
+	metrics.SSEUnsubscribed()
+	s.streams.Delete(streamID)
 	stop, ok := s.keepAliveStops.LoadAndDelete(streamID)
 	if ok {
 		stop.(chan bool) <- true
@@ -91,3 +103,11 @@ func (s *SSE) PublishData(streamId, eventName string, data interface{}) {
 	}
 	s.Publish(streamId, event)
 }
+
+// Broadcast publishes an event to every stream that has subscribers
+func (s *SSE) Broadcast(eventName string, data interface{}) {
+	s.streams.Range(func(k, _ any) bool {
+		s.PublishData(k.(string), eventName, data)
+		return true
+	})
+}
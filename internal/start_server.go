@@ -1,10 +1,14 @@
 package internal
 
 import (
+	"context"
 	"fmt"
 	etag "github.com/pablor21/echo-etag/v4"
 	"io/fs"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/brpaz/echozap"
@@ -14,15 +18,37 @@ import (
 	"github.com/labstack/gommon/log"
 	talk "github.com/proxoar/talk"
 	"github.com/proxoar/talk/internal/config"
+	"github.com/proxoar/talk/internal/metrics"
 	middleware2 "github.com/proxoar/talk/internal/middleware"
+	"github.com/proxoar/talk/internal/storage"
+	"github.com/proxoar/talk/internal/tracing"
 	"github.com/suyashkumar/ssl-proxy/gen"
 	"go.uber.org/zap"
 )
 
-func StartServer() {
+// StartServer serves the API and the web UI with the config file at configPath, see config.LoadConfig
+func StartServer(configPath string) {
 	logger := mustDefaultLogger()
 
-	conf := config.MustLoadConfig(logger)
+	conf := config.MustLoadConfig(configPath, logger)
+
+	// before providers are created, so that their HTTP clients are traced
+	shutdownTracing, err := tracing.Setup(context.Background(), conf.Server.Tracing)
+	if err != nil {
+		logger.Sugar().Panic("failed to set up tracing:", err)
+	}
+	if conf.Server.Tracing.Exporter != "" {
+		// the server stops without returning, so flush spans on Ctrl-C or docker stop
+		go func() {
+			sig := make(chan os.Signal, 1)
+			signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+			<-sig
+			if err := shutdownTracing(context.Background()); err != nil {
+				logger.Sugar().Error("failed to flush spans: ", err)
+			}
+			os.Exit(0)
+		}()
+	}
 
 	logger.Info("initialise talker...")
 	talker, err := NewTalker(*conf, logger)
@@ -30,6 +56,16 @@ func StartServer() {
 		logger.Sugar().Panic("failed to create a talker:", err)
 	}
 
+	var store *storage.Storage
+	if conf.Server.SQLite != "" {
+		logger.Info("open storage...")
+		store, err = storage.Open(conf.Server.SQLite)
+		if err != nil {
+			logger.Sugar().Panic("failed to open storage:", err)
+		}
+		defer func() { _ = store.Close() }()
+	}
+
 	logger.Info("initialise SSE server...")
 	sse := NewSSE(talker, logger)
 
@@ -44,17 +80,78 @@ func StartServer() {
 	e.Use(middleware2.AllowAllCors)
 
 	// API
-	h := NewRestfulEHandler(talker, sse, logger)
+	tickets := NewTickets()
+	quotas := NewQuotas(conf.Quota, store, logger)
+	ws := NewWebSocket(talker, tickets, store, quotas, logger)
+	health := NewProviderHealth(talker, conf.Server.HealthCheckInterval, logger, sse, ws)
+	go health.Run(context.Background(), conf.Server.CheckHealthOnStartup)
+	h := NewRestfulEHandler(talker, sse, tickets, store, quotas, health, logger)
 	api := e.Group("/api")
-	if len(conf.Server.Passwords) != 0 {
-		api.Use(middleware2.SPAuth(conf.Server.Passwords))
+	passwords := middleware2.NewPasswords(conf.Server.Passwords)
+	auth := authMiddleware(conf.Server, passwords, store, logger)
+	r := &reloader{
+		conf:         *conf,
+		talker:       talker,
+		passwords:    passwords,
+		health:       health,
+		broadcasters: []Broadcaster{sse, ws},
+		logger:       logger,
+	}
+	config.WatchConfig(logger, r.reload)
+	if conf.Server.Accounts.Enabled {
+		ah := NewAccountHandler(store, conf.Server.Accounts, logger)
+		if err = ah.Bootstrap(context.Background(), conf.Server.Accounts.Admin); err != nil {
+			logger.Sugar().Panic("failed to bootstrap accounts:", err)
+		}
+		// login is the only route that doesn't need a token
+		api.POST("/login", ah.Login)
+		api.Use(auth)
+		api.POST("/logout", ah.Logout)
+		api.GET("/me", ah.Me)
+		api.PUT("/me/password", ah.ChangePassword)
+		api.GET("/tokens", ah.ListTokens)
+		api.POST("/tokens", ah.CreateToken)
+		api.DELETE("/tokens/:tokenId", ah.RevokeToken)
+		api.GET("/users", ah.ListUsers, middleware2.RequireAdmin)
+		api.POST("/users", ah.CreateUser, middleware2.RequireAdmin)
+		api.DELETE("/users/:userId", ah.DeleteUser, middleware2.RequireAdmin)
+	} else if auth != nil {
+		api.Use(auth)
 	}
 	api.GET("/health", h.Health)
+	api.GET("/providers/status", h.ProvidersStatus)
 	api.Any("/events", sse.HandleEcho)
+	api.GET("/ws", ws.HandleEcho)
+	api.POST("/chat/sync", h.PostChatSync)
+	api.POST("/audio-chat/sync", h.PostAudioChatSync)
 	api.Use(middleware2.StreamId)
 	api.POST("/chat", h.PostChat)
 	api.POST("/audio-chat", h.PostAudioChat)
-	api.GET("/providers/status", h.ProvidersStatus)
+	api.POST("/chat/:ticketId/cancel", h.CancelChat)
+	if store != nil {
+		api.GET("/chats", h.ListChats)
+		api.GET("/chats/:chatId", h.GetChat)
+		api.GET("/chats/:chatId/messages/:messageId/audio", h.GetChatAudio)
+		api.PATCH("/chats/:chatId", h.RenameChat)
+		api.DELETE("/chats/:chatId", h.DeleteChat)
+	}
+
+	// Prometheus
+	if auth != nil {
+		e.GET("/metrics", echo.WrapHandler(metrics.Handler()), auth)
+	} else {
+		e.GET("/metrics", echo.WrapHandler(metrics.Handler()))
+	}
+
+	// OpenAI-compatible API
+	oai := NewOpenAIFacade(talker, quotas, logger)
+	v1 := e.Group("/v1")
+	if auth != nil {
+		v1.Use(auth)
+	}
+	v1.POST("/chat/completions", oai.ChatCompletions)
+	v1.POST("/audio/transcriptions", oai.Transcriptions)
+	v1.POST("/audio/speech", oai.Speech)
 
 	// route static files
 	w, err := fs.Sub(talk.Web, "web/html")
@@ -71,6 +168,24 @@ func StartServer() {
 	serve(conf.Server.Tls, e, conf.Server.Port, logger)
 }
 
+// authMiddleware
+// returns UserAuth if accounts are enabled, SPAuth if passwords are set, or nil if neither is configured
+func authMiddleware(sc config.ServerConfig, passwords *middleware2.Passwords, store *storage.Storage, logger *zap.Logger) echo.MiddlewareFunc {
+	if sc.Accounts.Enabled {
+		if store == nil {
+			logger.Panic("server.accounts requires server.sqlite to keep users")
+		}
+		if len(sc.Passwords) != 0 {
+			logger.Warn("server.passwords is ignored since server.accounts is enabled")
+		}
+		return middleware2.UserAuth(store)
+	}
+	if len(sc.Passwords) != 0 {
+		return middleware2.SPAuth(passwords)
+	}
+	return nil
+}
+
 func serve(t config.TLS, e *echo.Echo, port int, logger *zap.Logger) {
 	serveRedirect := func() {
 		e := echo.New()
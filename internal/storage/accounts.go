@@ -0,0 +1,259 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/proxoar/talk/internal/util"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrInvalidCredentials is returned when a password or token is wrong, or a token has expired
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// ErrConflict is returned when a user name has been taken
+var ErrConflict = errors.New("already exists")
+
+// tokenPrefix makes tokens recognizable, e.g. by secret scanners
+const tokenPrefix = "talk_"
+
+type TokenKind string
+
+const (
+	// TokenSession is issued by logging in, and always expires
+	TokenSession TokenKind = "session"
+	// TokenAPI is a personal token for scripts and tools, which is created and revoked by its user
+	TokenAPI TokenKind = "api"
+)
+
+type User struct {
+	Id        string    `json:"id"`
+	Name      string    `json:"name"`
+	Admin     bool      `json:"admin"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type Token struct {
+	Id        string    `json:"id"`
+	UserId    string    `json:"userId"`
+	Kind      TokenKind `json:"kind"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"createdAt"`
+	// ExpiresAt is zero if the token never expires
+	ExpiresAt time.Time `json:"expiresAt,omitzero"`
+}
+
+// CreateUser saves a user with a salted hash of password
+func (s *Storage) CreateUser(ctx context.Context, name, password string, admin bool) (User, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return User{}, err
+	}
+	u := User{Id: util.RandomHash16Chars(), Name: name, Admin: admin, CreatedAt: time.UnixMilli(time.Now().UnixMilli())}
+	_, err = s.db.ExecContext(ctx, `INSERT INTO users (id, name, password_hash, admin, created_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (name) DO NOTHING`, u.Id, u.Name, string(hash), u.Admin, u.CreatedAt.UnixMilli())
+	if err != nil {
+		return User{}, err
+	}
+	if _, err = s.User(ctx, u.Id); errors.Is(err, ErrNotFound) {
+		return User{}, ErrConflict
+	}
+	return u, err
+}
+
+func (s *Storage) User(ctx context.Context, userId string) (User, error) {
+	u, _, err := scanUser(s.db.QueryRowContext(ctx,
+		`SELECT id, name, admin, created_at, password_hash FROM users WHERE id = ?`, userId))
+	return u, err
+}
+
+// Users lists users, the earliest created first
+func (s *Storage) Users(ctx context.Context) ([]User, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, name, admin, created_at, password_hash FROM users ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	users := []User{}
+	for rows.Next() {
+		u, _, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// DeleteUser deletes a user along with the tokens of the user
+func (s *Storage) DeleteUser(ctx context.Context, userId string) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM users WHERE id = ?`, userId)
+	if err != nil {
+		return err
+	}
+	return affectedOne(res)
+}
+
+// SetPassword replaces the password of a user, and revokes the sessions of the user
+func (s *Storage) SetPassword(ctx context.Context, userId, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	res, err := tx.ExecContext(ctx, `UPDATE users SET password_hash = ? WHERE id = ?`, string(hash), userId)
+	if err != nil {
+		return err
+	}
+	if err = affectedOne(res); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE user_id = ? AND kind = ?`, userId, TokenSession)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Authenticate returns the user of name if password is correct
+func (s *Storage) Authenticate(ctx context.Context, name, password string) (User, error) {
+	u, hash, err := scanUser(s.db.QueryRowContext(ctx,
+		`SELECT id, name, admin, created_at, password_hash FROM users WHERE name = ?`, name))
+	if errors.Is(err, ErrNotFound) {
+		return User{}, ErrInvalidCredentials
+	} else if err != nil {
+		return User{}, err
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return User{}, ErrInvalidCredentials
+	}
+	return u, nil
+}
+
+// CreateToken
+// issues a token for a user, which never expires if ttl is 0. The returned secret is not kept, and can't be
+// retrieved afterwards.
+func (s *Storage) CreateToken(ctx context.Context, userId string, kind TokenKind, name string, ttl time.Duration) (secret string, t Token, err error) {
+	b := make([]byte, 32)
+	if _, err = rand.Read(b); err != nil {
+		return "", Token{}, err
+	}
+	secret = tokenPrefix + hex.EncodeToString(b)
+	now := time.UnixMilli(time.Now().UnixMilli())
+	t = Token{Id: util.RandomHash16Chars(), UserId: userId, Kind: kind, Name: name, CreatedAt: now}
+	var expiresAt int64
+	if ttl > 0 {
+		t.ExpiresAt = now.Add(ttl)
+		expiresAt = t.ExpiresAt.UnixMilli()
+	}
+	_, err = s.db.ExecContext(ctx, `INSERT INTO tokens (id, hash, user_id, kind, name, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`, t.Id, hashToken(secret), userId, string(kind), name, now.UnixMilli(), expiresAt)
+	if err != nil {
+		return "", Token{}, err
+	}
+	return secret, t, nil
+}
+
+// UserByToken returns the user of a token and the token, unless the token is wrong or has expired
+func (s *Storage) UserByToken(ctx context.Context, secret string) (User, Token, error) {
+	if !strings.HasPrefix(secret, tokenPrefix) {
+		return User{}, Token{}, ErrInvalidCredentials
+	}
+	var t Token
+	var kind string
+	var createdAt, expiresAt int64
+	err := s.db.QueryRowContext(ctx, `SELECT id, user_id, kind, name, created_at, expires_at FROM tokens WHERE hash = ?`,
+		hashToken(secret)).Scan(&t.Id, &t.UserId, &kind, &t.Name, &createdAt, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, Token{}, ErrInvalidCredentials
+	} else if err != nil {
+		return User{}, Token{}, err
+	}
+	t.Kind, t.CreatedAt = TokenKind(kind), time.UnixMilli(createdAt)
+	if expiresAt != 0 {
+		t.ExpiresAt = time.UnixMilli(expiresAt)
+		if time.Now().After(t.ExpiresAt) {
+			return User{}, Token{}, ErrInvalidCredentials
+		}
+	}
+	u, err := s.User(ctx, t.UserId)
+	if err != nil {
+		return User{}, Token{}, err
+	}
+	return u, t, nil
+}
+
+// Tokens lists tokens of a user of kind, the earliest created first
+func (s *Storage) Tokens(ctx context.Context, userId string, kind TokenKind) ([]Token, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, name, created_at, expires_at FROM tokens
+		WHERE user_id = ? AND kind = ? ORDER BY created_at`, userId, string(kind))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	tokens := []Token{}
+	for rows.Next() {
+		t := Token{UserId: userId, Kind: kind}
+		var createdAt, expiresAt int64
+		if err = rows.Scan(&t.Id, &t.Name, &createdAt, &expiresAt); err != nil {
+			return nil, err
+		}
+		t.CreatedAt = time.UnixMilli(createdAt)
+		if expiresAt != 0 {
+			t.ExpiresAt = time.UnixMilli(expiresAt)
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// RevokeToken deletes a token of a user
+func (s *Storage) RevokeToken(ctx context.Context, userId, tokenId string) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM tokens WHERE id = ? AND user_id = ?`, tokenId, userId)
+	if err != nil {
+		return err
+	}
+	return affectedOne(res)
+}
+
+// DeleteExpiredTokens deletes tokens that have expired
+func (s *Storage) DeleteExpiredTokens(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM tokens WHERE expires_at != 0 AND expires_at < ?`, time.Now().UnixMilli())
+	return err
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanUser(row rowScanner) (u User, passwordHash string, err error) {
+	var createdAt int64
+	err = row.Scan(&u.Id, &u.Name, &u.Admin, &createdAt, &passwordHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, "", ErrNotFound
+	} else if err != nil {
+		return User{}, "", err
+	}
+	u.CreatedAt = time.UnixMilli(createdAt)
+	return u, passwordHash, nil
+}
+
+// hashToken
+// tokens are random enough that a fast hash is sufficient, unlike passwords
+func hashToken(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAccounts(t *testing.T) {
+	ctx := context.Background()
+	s, err := Open(filepath.Join(t.TempDir(), "talk.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = s.Close() }()
+
+	u, err := s.CreateUser(ctx, "alice", "secret-1", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.CreateUser(ctx, "alice", "secret-2", false); !errors.Is(err, ErrConflict) {
+		t.Errorf("CreateUser() with a taken name = %v, want ErrConflict", err)
+	}
+	if _, err = s.Authenticate(ctx, "alice", "wrong"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Authenticate() with a wrong password = %v, want ErrInvalidCredentials", err)
+	}
+	if got, err := s.Authenticate(ctx, "alice", "secret-1"); err != nil || got.Id != u.Id || !got.Admin {
+		t.Errorf("Authenticate() = %+v, %v", got, err)
+	}
+
+	session, _, err := s.CreateToken(ctx, u.Id, TokenSession, "browser", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, _, err := s.CreateToken(ctx, u.Id, TokenSession, "browser", time.Nanosecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api, apiToken, err := s.CreateToken(ctx, u.Id, TokenAPI, "script", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+
+	tests := []struct {
+		name   string
+		secret string
+		valid  bool
+	}{
+		{"session", session, true},
+		{"api", api, true},
+		{"expired", expired, false},
+		{"unknown", tokenPrefix + "0000", false},
+		{"malformed", "not-a-token", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _, err := s.UserByToken(ctx, tt.secret)
+			if tt.valid && (err != nil || got.Id != u.Id) {
+				t.Errorf("UserByToken() = %+v, %v, want user %s", got, err, u.Id)
+			}
+			if !tt.valid && !errors.Is(err, ErrInvalidCredentials) {
+				t.Errorf("UserByToken() = %v, want ErrInvalidCredentials", err)
+			}
+		})
+	}
+
+	if err = s.RevokeToken(ctx, u.Id, apiToken.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = s.UserByToken(ctx, api); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("UserByToken() of a revoked token = %v, want ErrInvalidCredentials", err)
+	}
+	// changing password ends sessions
+	if err = s.SetPassword(ctx, u.Id, "secret-3"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = s.UserByToken(ctx, session); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("UserByToken() after SetPassword() = %v, want ErrInvalidCredentials", err)
+	}
+}
@@ -0,0 +1,309 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/proxoar/talk/pkg/client"
+	_ "modernc.org/sqlite"
+)
+
+// ErrNotFound is returned when a chat or message doesn't exist
+var ErrNotFound = errors.New("not found")
+
+// maximum number of runes of a title derived from the first message of a chat
+const titleMaxLen = 50
+
+const schema = `
+-- user_id is the identity key of the owner, see middleware.Identity
+CREATE TABLE IF NOT EXISTS chats (
+	id         TEXT PRIMARY KEY,
+	user_id    TEXT NOT NULL,
+	title      TEXT NOT NULL,
+	created_at INTEGER NOT NULL,
+	updated_at INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS messages (
+	id          TEXT PRIMARY KEY,
+	chat_id     TEXT NOT NULL REFERENCES chats (id) ON DELETE CASCADE,
+	ticket_id   TEXT NOT NULL,
+	role        TEXT NOT NULL,
+	text        TEXT NOT NULL,
+	transcribed INTEGER NOT NULL,
+	created_at  INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS messages_chat_id ON messages (chat_id, created_at);
+-- audio may be saved before its message, e.g. when completion is synthesized sentence by sentence,
+-- so there is no foreign key
+CREATE TABLE IF NOT EXISTS audios (
+	message_id TEXT NOT NULL,
+	seq        INTEGER NOT NULL,
+	data       BLOB NOT NULL,
+	PRIMARY KEY (message_id, seq)
+);
+CREATE TABLE IF NOT EXISTS users (
+	id            TEXT PRIMARY KEY,
+	name          TEXT NOT NULL UNIQUE,
+	password_hash TEXT NOT NULL,
+	admin         INTEGER NOT NULL,
+	created_at    INTEGER NOT NULL
+);
+-- only hashes of tokens are kept, expires_at is 0 if a token never expires
+CREATE TABLE IF NOT EXISTS tokens (
+	id         TEXT PRIMARY KEY,
+	hash       TEXT NOT NULL UNIQUE,
+	user_id    TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	kind       TEXT NOT NULL,
+	name       TEXT NOT NULL,
+	created_at INTEGER NOT NULL,
+	expires_at INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS tokens_user_id ON tokens (user_id, kind);
+-- period is the window usage is counted in, e.g. 2024-05 for a month, or 2024-05-01 for a day
+CREATE TABLE IF NOT EXISTS usage (
+	identity TEXT NOT NULL,
+	metric   TEXT NOT NULL,
+	period   TEXT NOT NULL,
+	amount   INTEGER NOT NULL,
+	PRIMARY KEY (identity, metric, period)
+);
+`
+
+type Chat struct {
+	Id        string    `json:"id"`
+	Title     string    `json:"title"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type Message struct {
+	Id       string      `json:"id"`
+	ChatId   string      `json:"chatId"`
+	TicketId string      `json:"ticketId"`
+	Role     client.Role `json:"role"`
+	Text     string      `json:"text"`
+	// Transcribed is true if Text is the transcription of user's voice
+	Transcribed bool      `json:"transcribed"`
+	CreatedAt   time.Time `json:"createdAt"`
+	// AudioChunks is the number of audio chunks, see api.Audio.Seq
+	AudioChunks int `json:"audioChunks"`
+}
+
+// migration adds chats.user_id to files created before chats had owners. Those chats are given to anonymous,
+// who is every sender if auth is disabled, since their owners are unknown
+const migration = `
+ALTER TABLE chats ADD COLUMN user_id TEXT NOT NULL DEFAULT 'anonymous';
+`
+
+// index is created after migration, which adds the column it needs
+const index = `
+CREATE INDEX IF NOT EXISTS chats_user_id ON chats (user_id, updated_at);
+`
+
+// Storage
+// records chats, messages and audio in a SQLite file, so that a conversation survives a browser reset
+// and can move between devices
+type Storage struct {
+	db *sql.DB
+}
+
+// Open opens the SQLite file at path, creating it and its tables if they don't exist
+func Open(path string) (*Storage, error) {
+	// foreign keys are disabled by default in SQLite, which are needed by ON DELETE CASCADE
+	db, err := sql.Open("sqlite", fmt.Sprintf("file:%s?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)", path))
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows only one writer at a time
+	db.SetMaxOpenConns(1)
+	if err = migrate(db); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to create tables in %s: %w", path, err)
+	}
+	return &Storage{db: db}, nil
+}
+
+func migrate(db *sql.DB) error {
+	if _, err := db.Exec(schema); err != nil {
+		return err
+	}
+	var owned bool
+	err := db.QueryRow(`SELECT COUNT(*) > 0 FROM pragma_table_info('chats') WHERE name = 'user_id'`).Scan(&owned)
+	if err != nil {
+		return err
+	}
+	if !owned {
+		if _, err = db.Exec(migration); err != nil {
+			return err
+		}
+	}
+	_, err = db.Exec(index)
+	return err
+}
+
+func (s *Storage) Close() error {
+	return s.db.Close()
+}
+
+// SaveMessage
+// creates the chat of m owned by userId if it doesn't exist, titled by the text of m, and touches the chat otherwise.
+// It returns ErrNotFound if the chat is owned by someone else.
+func (s *Storage) SaveMessage(ctx context.Context, userId string, m Message) error {
+	now := time.Now().UnixMilli()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	res, err := tx.ExecContext(ctx, `INSERT INTO chats (id, user_id, title, created_at, updated_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET updated_at = excluded.updated_at WHERE user_id = excluded.user_id`,
+		m.ChatId, userId, titleOf(m.Text), now, now)
+	if err != nil {
+		return err
+	}
+	if err = affectedOne(res); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO messages (id, chat_id, ticket_id, role, text, transcribed, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		m.Id, m.ChatId, m.TicketId, string(m.Role), m.Text, m.Transcribed, now)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SaveAudio saves a chunk of audio of message messageId
+func (s *Storage) SaveAudio(ctx context.Context, messageId string, seq int, audio []byte) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO audios (message_id, seq, data) VALUES (?, ?, ?)
+		ON CONFLICT (message_id, seq) DO UPDATE SET data = excluded.data`,
+		messageId, seq, audio)
+	return err
+}
+
+// Chats lists chats owned by userId, the most recently updated first
+func (s *Storage) Chats(ctx context.Context, userId string) ([]Chat, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, title, created_at, updated_at FROM chats WHERE user_id = ?
+		ORDER BY updated_at DESC`, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	chats := []Chat{}
+	for rows.Next() {
+		var c Chat
+		var createdAt, updatedAt int64
+		if err = rows.Scan(&c.Id, &c.Title, &createdAt, &updatedAt); err != nil {
+			return nil, err
+		}
+		c.CreatedAt, c.UpdatedAt = time.UnixMilli(createdAt), time.UnixMilli(updatedAt)
+		chats = append(chats, c)
+	}
+	return chats, rows.Err()
+}
+
+// Chat returns a chat owned by userId and its messages in order
+func (s *Storage) Chat(ctx context.Context, userId, chatId string) (Chat, []Message, error) {
+	c := Chat{Id: chatId}
+	var createdAt, updatedAt int64
+	err := s.db.QueryRowContext(ctx, `SELECT title, created_at, updated_at FROM chats WHERE id = ? AND user_id = ?`,
+		chatId, userId).
+		Scan(&c.Title, &createdAt, &updatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Chat{}, nil, ErrNotFound
+	} else if err != nil {
+		return Chat{}, nil, err
+	}
+	c.CreatedAt, c.UpdatedAt = time.UnixMilli(createdAt), time.UnixMilli(updatedAt)
+
+	rows, err := s.db.QueryContext(ctx, `SELECT m.id, m.ticket_id, m.role, m.text, m.transcribed, m.created_at,
+		(SELECT COUNT(*) FROM audios a WHERE a.message_id = m.id)
+		FROM messages m WHERE m.chat_id = ? ORDER BY m.created_at, m.rowid`, chatId)
+	if err != nil {
+		return Chat{}, nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	ms := []Message{}
+	for rows.Next() {
+		m := Message{ChatId: chatId}
+		var role string
+		if err = rows.Scan(&m.Id, &m.TicketId, &role, &m.Text, &m.Transcribed, &createdAt, &m.AudioChunks); err != nil {
+			return Chat{}, nil, err
+		}
+		m.Role = client.Role(role)
+		m.CreatedAt = time.UnixMilli(createdAt)
+		ms = append(ms, m)
+	}
+	return c, ms, rows.Err()
+}
+
+// Audio returns a chunk of audio of a message in chat chatId owned by userId
+func (s *Storage) Audio(ctx context.Context, userId, chatId, messageId string, seq int) ([]byte, error) {
+	var audio []byte
+	err := s.db.QueryRowContext(ctx, `SELECT a.data FROM audios a JOIN messages m ON m.id = a.message_id
+		JOIN chats c ON c.id = m.chat_id
+		WHERE c.user_id = ? AND m.chat_id = ? AND a.message_id = ? AND a.seq = ?`,
+		userId, chatId, messageId, seq).Scan(&audio)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return audio, err
+}
+
+func (s *Storage) RenameChat(ctx context.Context, userId, chatId, title string) error {
+	res, err := s.db.ExecContext(ctx, `UPDATE chats SET title = ?, updated_at = ? WHERE id = ? AND user_id = ?`,
+		title, time.Now().UnixMilli(), chatId, userId)
+	if err != nil {
+		return err
+	}
+	return affectedOne(res)
+}
+
+// DeleteChat deletes a chat owned by userId along with its messages and audio
+func (s *Storage) DeleteChat(ctx context.Context, userId, chatId string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM audios WHERE message_id IN (SELECT m.id FROM messages m
+		JOIN chats c ON c.id = m.chat_id WHERE c.id = ? AND c.user_id = ?)`, chatId, userId)
+	if err != nil {
+		return err
+	}
+	// messages are deleted by ON DELETE CASCADE
+	res, err := tx.ExecContext(ctx, `DELETE FROM chats WHERE id = ? AND user_id = ?`, chatId, userId)
+	if err != nil {
+		return err
+	}
+	if err = affectedOne(res); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func affectedOne(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func titleOf(text string) string {
+	rs := []rune(text)
+	if len(rs) > titleMaxLen {
+		return string(rs[:titleMaxLen]) + "…"
+	}
+	return string(rs)
+}
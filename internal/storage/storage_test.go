@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/proxoar/talk/pkg/client"
+)
+
+func TestStorage(t *testing.T) {
+	ctx := context.Background()
+	s, err := Open(filepath.Join(t.TempDir(), "talk.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = s.Close() }()
+
+	// audio of a completion arrives before the completion is recorded
+	if err = s.SaveAudio(ctx, "m2", 0, []byte("chunk")); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []Message{
+		{Id: "m1", ChatId: "c1", TicketId: "t1", Role: client.RoleUser, Text: "Hello", Transcribed: true},
+		{Id: "m2", ChatId: "c1", TicketId: "t1", Role: client.RoleAssistant, Text: "Hi"},
+	} {
+		if err = s.SaveMessage(ctx, "alice", m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	chat, ms, err := s.Chat(ctx, "alice", "c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chat.Title != "Hello" || len(ms) != 2 || ms[0].Id != "m1" || !ms[0].Transcribed || ms[1].AudioChunks != 1 {
+		t.Errorf("Chat() = %+v, %+v", chat, ms)
+	}
+	if audio, err := s.Audio(ctx, "alice", "c1", "m2", 0); err != nil || string(audio) != "chunk" {
+		t.Errorf("Audio() = %q, %v, want \"chunk\", nil", audio, err)
+	}
+
+	// chats of others are not found
+	if chats, err := s.Chats(ctx, "bob"); err != nil || len(chats) != 0 {
+		t.Errorf("Chats() of bob = %+v, %v, want none", chats, err)
+	}
+	if _, _, err = s.Chat(ctx, "bob", "c1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Chat() of bob error = %v, want %v", err, ErrNotFound)
+	}
+	if _, err = s.Audio(ctx, "bob", "c1", "m2", 0); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Audio() of bob error = %v, want %v", err, ErrNotFound)
+	}
+	if err = s.RenameChat(ctx, "bob", "c1", "Mine"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("RenameChat() of bob error = %v, want %v", err, ErrNotFound)
+	}
+	if err = s.DeleteChat(ctx, "bob", "c1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("DeleteChat() of bob error = %v, want %v", err, ErrNotFound)
+	}
+	m := Message{Id: "m3", ChatId: "c1", TicketId: "t2", Role: client.RoleUser, Text: "Mine"}
+	if err = s.SaveMessage(ctx, "bob", m); !errors.Is(err, ErrNotFound) {
+		t.Errorf("SaveMessage() of bob error = %v, want %v", err, ErrNotFound)
+	}
+
+	if err = s.RenameChat(ctx, "alice", "c1", "Greeting"); err != nil {
+		t.Fatal(err)
+	}
+	if chats, err := s.Chats(ctx, "alice"); err != nil || len(chats) != 1 || chats[0].Title != "Greeting" {
+		t.Errorf("Chats() = %+v, %v", chats, err)
+	}
+
+	if err = s.DeleteChat(ctx, "alice", "c1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = s.Chat(ctx, "alice", "c1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Chat() error = %v after DeleteChat(), want %v", err, ErrNotFound)
+	}
+	if _, err = s.Audio(ctx, "alice", "c1", "m2", 0); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Audio() error = %v after DeleteChat(), want %v", err, ErrNotFound)
+	}
+	if err = s.DeleteChat(ctx, "alice", "c1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("DeleteChat() error = %v, want %v", err, ErrNotFound)
+	}
+}
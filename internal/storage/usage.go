@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math"
+)
+
+// AddUsage
+// adds amount to the usage of metric by identity in period unless the total would exceed limit, and returns the total
+// and whether amount is added. Both are done in one statement, so that concurrent calls can't exceed limit together.
+// limit <= 0 means no limit.
+func (s *Storage) AddUsage(ctx context.Context, identity, metric, period string, amount, limit int64) (int64, bool, error) {
+	if limit <= 0 {
+		limit = math.MaxInt64
+	} else if amount > limit {
+		used, err := s.Usage(ctx, identity, metric, period)
+		return used, false, err
+	}
+	var total int64
+	// no row is returned if the update is skipped by WHERE
+	err := s.db.QueryRowContext(ctx, `INSERT INTO usage (identity, metric, period, amount) VALUES (?, ?, ?, MAX(?, 0))
+		ON CONFLICT (identity, metric, period) DO UPDATE SET amount = MAX(usage.amount + ?, 0)
+		WHERE usage.amount + ? <= ?
+		RETURNING amount`, identity, metric, period, amount, amount, amount, limit).Scan(&total)
+	if errors.Is(err, sql.ErrNoRows) {
+		used, err := s.Usage(ctx, identity, metric, period)
+		return used, false, err
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return total, true, nil
+}
+
+// Usage returns the usage of metric by identity in period, which is 0 if nothing has been used
+func (s *Storage) Usage(ctx context.Context, identity, metric, period string) (int64, error) {
+	var amount int64
+	err := s.db.QueryRowContext(ctx, `SELECT amount FROM usage WHERE identity = ? AND metric = ? AND period = ?`,
+		identity, metric, period).Scan(&amount)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return amount, err
+}
@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestAddUsage(t *testing.T) {
+	ctx := context.Background()
+	s, err := Open(filepath.Join(t.TempDir(), "talk.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = s.Close() }()
+
+	// a burst of calls can't exceed the limit together
+	var added atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, ok, err := s.AddUsage(ctx, "alice", "tts-characters", "2024-05", 1, 10)
+			if err != nil {
+				t.Error(err)
+			}
+			if ok {
+				added.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if added.Load() != 10 {
+		t.Errorf("AddUsage() succeeded %d times, want 10", added.Load())
+	}
+
+	tests := []struct {
+		name      string
+		amount    int64
+		limit     int64
+		wantTotal int64
+		wantOk    bool
+	}{
+		{name: "beyond limit", amount: 1, limit: 10, wantTotal: 10, wantOk: false},
+		{name: "larger than limit", amount: 11, limit: 10, wantTotal: 10, wantOk: false},
+		{name: "no limit", amount: 5, limit: 0, wantTotal: 15, wantOk: true},
+		{name: "refund", amount: -7, limit: 0, wantTotal: 8, wantOk: true},
+		{name: "within limit", amount: 2, limit: 10, wantTotal: 10, wantOk: true},
+		{name: "refund below zero", amount: -20, limit: 0, wantTotal: 0, wantOk: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			total, ok, err := s.AddUsage(ctx, "alice", "tts-characters", "2024-05", tt.amount, tt.limit)
+			if err != nil || total != tt.wantTotal || ok != tt.wantOk {
+				t.Errorf("AddUsage() = %d, %v, %v, want %d, %v, nil", total, ok, err, tt.wantTotal, tt.wantOk)
+			}
+		})
+	}
+}
@@ -2,10 +2,14 @@ package internal
 
 import (
 	"context"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	demo "github.com/proxoar/talk-demo-resource/v2"
+	"github.com/proxoar/talk/internal/api"
 	"github.com/proxoar/talk/internal/config"
 	"github.com/proxoar/talk/pkg/ability"
 	"github.com/proxoar/talk/pkg/client"
@@ -13,18 +17,68 @@ import (
 	"go.uber.org/zap"
 )
 
+// Talker selects providers for each step of a chat
 type Talker struct {
+	// set is replaced as a whole by Reload, see Pinned
+	set    atomic.Pointer[providerSet]
+	logger *zap.Logger
+}
+
+// providerSet is the providers built from a config, which doesn't change once built
+type providerSet struct {
 	llmProviders []client.LLM
 	sstProviders []client.SpeechToText
 	ttsProviders []client.TextToSpeech
-	demo         bool
-	logger       *zap.Logger
+	// all providers above, with their names for health checks
+	named    []namedClient
+	fallback config.FallbackConfig
+	demo     bool
+}
+
+// namedClient is a provider and its name in config
+type namedClient struct {
+	kind string
+	name string
+	client.Client
 }
 
 func NewTalker(tc config.TalkConfig, logger *zap.Logger) (*Talker, error) {
+	s, err := newProviderSet(tc, logger)
+	if err != nil {
+		return nil, err
+	}
+	t := &Talker{logger: logger}
+	t.set.Store(s)
+	return t, nil
+}
+
+// Reload replaces providers with the ones in tc. Providers in use are kept by whoever has pinned them.
+func (t *Talker) Reload(tc config.TalkConfig) error {
+	s, err := newProviderSet(tc, t.logger)
+	if err != nil {
+		return err
+	}
+	t.set.Store(s)
+	return nil
+}
+
+// Pinned returns a Talker that keeps the current providers even if t is reloaded,
+// so that a ticket runs on the providers it started with
+func (t *Talker) Pinned() *Talker {
+	p := &Talker{logger: t.logger}
+	p.set.Store(t.current())
+	return p
+}
+
+func (t *Talker) current() *providerSet {
+	return t.set.Load()
+}
+
+func newProviderSet(tc config.TalkConfig, logger *zap.Logger) (*providerSet, error) {
 	var llms []client.LLM
 	var ttss []client.TextToSpeech
 	var stts []client.SpeechToText
+	var named []namedClient
 	if tc.Server.DemoMode {
 		pool, err := demo.NewResourcePool()
 		if err != nil {
@@ -36,85 +90,205 @@ func NewTalker(tc config.TalkConfig, logger *zap.Logger) (*Talker, error) {
 		ttss = append(ttss, tts)
 		stt := providers.NewWhisperDemo(logger)
 		stts = append(stts, stt)
+		named = append(named, namedClient{kindLLM, llmChatGPT, llm}, namedClient{kindTTS, ttsElevenlabs, tts},
+			namedClient{kindSTT, sttWhisper, stt})
 	} else {
-
-		if apiKey, ok := tc.Creds[tc.Llm.ChatGPT]; ok {
-			llm := providers.NewChatGPT(apiKey, logger)
-			llms = append(llms, llm)
+		// each provider is wrapped to retry transient errors, with the policy configured under its name
+		retryLLM := func(name string, llm client.LLM) client.LLM {
+			r := providers.NewRetryingLLM(llm, name, retryPolicy(tc.Retry.Default, tc.Retry.Llm[name]), logger)
+			named = append(named, namedClient{kindLLM, name, r})
+			return r
+		}
+		retryTTS := func(name string, tts client.TextToSpeech) client.TextToSpeech {
+			r := providers.NewRetryingTTS(tts, name, retryPolicy(tc.Retry.Default, tc.Retry.TextToSpeech[name]), logger)
+			named = append(named, namedClient{kindTTS, name, r})
+			return r
+		}
+		retrySTT := func(name string, stt client.SpeechToText) client.SpeechToText {
+			r := providers.NewRetryingSTT(stt, name, retryPolicy(tc.Retry.Default, tc.Retry.SpeechToText[name]), logger)
+			named = append(named, namedClient{kindSTT, name, r})
+			return r
 		}
 
-		if apiKey, ok := tc.Creds[tc.Llm.Gemini]; ok {
-			llm := providers.NewGemini(apiKey, logger)
-			llms = append(llms, llm)
+		// each provider spreads calls over its credentials, see providers.NewLLMPool
+		addLLM := func(name string, refs []string, newLLM func(secret string) (client.LLM, error)) error {
+			members, err := poolMembers(tc.Creds, refs, newLLM)
+			if err != nil || len(members) == 0 {
+				return err
+			}
+			llms = append(llms, retryLLM(name, providers.NewLLMPool(name, members, logger)))
+			return nil
 		}
+		addTTS := func(name string, refs []string, newTTS func(secret string) (client.TextToSpeech, error)) error {
+			members, err := poolMembers(tc.Creds, refs, newTTS)
+			if err != nil || len(members) == 0 {
+				return err
+			}
+			ttss = append(ttss, retryTTS(name, providers.NewTTSPool(name, members, logger)))
+			return nil
+		}
+		addSTT := func(name string, refs []string, newSTT func(secret string) (client.SpeechToText, error)) error {
+			members, err := poolMembers(tc.Creds, refs, newSTT)
+			if err != nil || len(members) == 0 {
+				return err
+			}
+			stts = append(stts, retrySTT(name, providers.NewSTTPool(name, members, logger)))
+			return nil
+		}
+
+		_ = addLLM(llmChatGPT, tc.Llm.ChatGPT, func(apiKey string) (client.LLM, error) {
+			return providers.NewChatGPT(apiKey, logger), nil
+		})
 
-		if apiKey, ok := tc.Creds[tc.TextToSpeech.ElevenLabs]; ok {
-			tts := providers.NewElevenLabs(apiKey, logger)
-			ttss = append(ttss, tts)
+		if az := tc.Llm.AzureChatGPT; az.Endpoint != "" {
+			_ = addLLM(llmAzureChatGPT, az.Creds, func(apiKey string) (client.LLM, error) {
+				return providers.NewAzureChatGPT(az.Endpoint, az.APIVersion, apiKey, azureDeployments(az), logger), nil
+			})
 		}
 
-		if accountJson, ok := tc.Creds[tc.TextToSpeech.Google]; ok {
-			tts, err := providers.NewGoogleTTS(accountJson, logger)
-			if err != nil {
-				return nil, err
+		_ = addLLM(llmGemini, tc.Llm.Gemini, func(apiKey string) (client.LLM, error) {
+			return providers.NewGemini(apiKey, logger), nil
+		})
+
+		_ = addLLM(llmClaude, tc.Llm.Claude, func(apiKey string) (client.LLM, error) {
+			return providers.NewClaude(apiKey, logger), nil
+		})
+
+		for _, e := range tc.Llm.OpenAICompatible {
+			if e.Name == "" || e.BaseURL == "" {
+				logger.Sugar().Warnf("ignore OpenAI-compatible endpoint without name or base-url: %+v", e)
+				continue
+			}
+			newLLM := func(apiKey string) (client.LLM, error) {
+				return providers.NewOpenAICompatible(e.Name, e.BaseURL, apiKey, e.Models, logger), nil
 			}
-			ttss = append(ttss, tts)
+			// local servers usually don't need an API key
+			if len(e.Creds) == 0 {
+				llm, _ := newLLM("")
+				llms = append(llms, retryLLM(llmOpenAICompatiblePref+e.Name, llm))
+				continue
+			}
+			_ = addLLM(llmOpenAICompatiblePref+e.Name, e.Creds, newLLM)
 		}
 
-		if apiKey, ok := tc.Creds[tc.SpeechToText.Whisper]; ok {
-			whisper := providers.NewWhisper(apiKey, logger)
-			stts = append(stts, whisper)
+		_ = addTTS(ttsElevenlabs, tc.TextToSpeech.ElevenLabs, func(apiKey string) (client.TextToSpeech, error) {
+			return providers.NewElevenLabs(apiKey, logger), nil
+		})
+
+		err := addTTS(ttsGoogle, tc.TextToSpeech.Google, func(accountJson string) (client.TextToSpeech, error) {
+			return providers.NewGoogleTTS(accountJson, logger)
+		})
+		if err != nil {
+			return nil, err
 		}
 
-		if accountJson, ok := tc.Creds[tc.SpeechToText.Google]; ok {
-			stt, err := providers.NewGoogleSTT(accountJson, logger)
+		_ = addTTS(ttsOpenAI, tc.TextToSpeech.OpenAI, func(apiKey string) (client.TextToSpeech, error) {
+			return providers.NewOpenAITTS(apiKey, logger), nil
+		})
+
+		if pc := tc.TextToSpeech.Piper; pc.Binary != "" {
+			tts, err := providers.NewPiper(pc.Binary, pc.ModelDir, pc.Args, logger)
 			if err != nil {
 				return nil, err
 			}
-			stts = append(stts, stt)
+			ttss = append(ttss, retryTTS(ttsPiper, tts))
 		}
-	}
 
-	talker := Talker{llms, stts, ttss, tc.Server.DemoMode, logger}
-	if tc.Server.CheckHealthOnStartup {
-		go func() { talker.checkProvidersHealth() }()
+		_ = addSTT(sttWhisper, tc.SpeechToText.Whisper, func(apiKey string) (client.SpeechToText, error) {
+			return providers.NewWhisper(apiKey, logger), nil
+		})
+
+		if az := tc.SpeechToText.AzureWhisper; az.Endpoint != "" {
+			_ = addSTT(sttAzureWhisper, az.Creds, func(apiKey string) (client.SpeechToText, error) {
+				return providers.NewAzureWhisper(az.Endpoint, az.APIVersion, apiKey, azureDeployments(az), logger), nil
+			})
+		}
+
+		if lw := tc.SpeechToText.LocalWhisper; lw.URL != "" {
+			stt := providers.NewLocalWhisper(lw.URL, lw.Models, logger)
+			stts = append(stts, retrySTT(sttLocalWhisper, stt))
+		}
+
+		err = addSTT(sttGoogle, tc.SpeechToText.Google, func(accountJson string) (client.SpeechToText, error) {
+			return providers.NewGoogleSTT(accountJson, logger)
+		})
+		if err != nil {
+			return nil, err
+		}
 	}
-	return &talker, nil
+
+	return &providerSet{
+		llmProviders: llms,
+		sstProviders: stts,
+		ttsProviders: ttss,
+		named:        named,
+		fallback:     tc.Fallback,
+		demo:         tc.Server.DemoMode,
+	}, nil
 }
 
-// checkProvidersHealth performs a request to each provider in the process server initialization.
-//
-//	Log an error if there are any, such as invalid API key or connection error.
-//	Log a warning if there are any issues, such as quota exhaustion or incorrect transcriptions, indicating a potential problem
-//	These requests consume a minimal amount of quota or even no quota.
-func (t *Talker) checkProvidersHealth() {
-	var clients []client.Client
-	for _, v := range t.llmProviders {
-		clients = append(clients, v)
+// poolMembers creates a client with each credential referred to by refs, refs missing in creds are ignored
+func poolMembers[C client.Client](creds map[string]string, refs []string, newClient func(secret string) (C, error)) ([]providers.PoolMember[C], error) {
+	var members []providers.PoolMember[C]
+	for _, ref := range refs {
+		secret, ok := creds[ref]
+		if !ok {
+			continue
+		}
+		c, err := newClient(secret)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, providers.PoolMember[C]{Key: ref, Client: c})
 	}
-	for _, v := range t.ttsProviders {
-		clients = append(clients, v)
+	return members, nil
+}
+
+// retryPolicy overrides providers.DefaultRetryPolicy with non-zero fields of cs in order
+func retryPolicy(cs ...config.RetryPolicyConfig) providers.RetryPolicy {
+	p := providers.DefaultRetryPolicy()
+	for _, c := range cs {
+		if c.MaxAttempts > 0 {
+			p.MaxAttempts = c.MaxAttempts
+		}
+		if c.InitialBackoff > 0 {
+			p.InitialBackoff = c.InitialBackoff
+		}
+		if c.MaxBackoff > 0 {
+			p.MaxBackoff = c.MaxBackoff
+		}
+		if c.Timeout > 0 {
+			p.Timeout = c.Timeout
+		}
 	}
-	for _, v := range t.sstProviders {
-		clients = append(clients, v)
+	return p
+}
+
+func azureDeployments(c config.AzureOpenAIConfig) []providers.AzureDeployment {
+	ds := make([]providers.AzureDeployment, len(c.Deployments))
+	for i, d := range c.Deployments {
+		ds[i] = providers.AzureDeployment{Name: d.Name, Model: d.Model}
 	}
+	return ds
+}
 
+// CheckHealth performs a request to each provider concurrently, and returns their status in the order of config.
+//
+// These requests consume a minimal amount of quota or even no quota.
+func (t *Talker) CheckHealth(ctx context.Context) []api.ProviderStatus {
+	named := t.current().named
+	statuses := make([]api.ProviderStatus, len(named))
 	var wg sync.WaitGroup
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-	for _, c := range clients {
+	for i, c := range named {
 		wg.Add(1)
-		go func(c_ client.Client) {
+		go func() {
 			defer wg.Done()
-			c_.CheckHealth(ctx)
-		}(c)
+			h := client.CheckHealth(ctx, c.Client)
+			statuses[i] = api.ProviderStatus{Kind: c.kind, Name: c.name, Health: h, CheckedAt: time.Now()}
+		}()
 	}
-
 	wg.Wait()
-	err := ctx.Err()
-	if err != nil {
-		t.logger.Sugar().Error("", err)
-	}
+	return statuses
 }
 
 // Ability
@@ -127,24 +301,28 @@ func (t *Talker) Ability(ctx context.Context) ([]error, ability.Ability) {
 	if ok {
 		return nil, ab
 	}
-	ab = ability.Ability{Demo: t.demo}
+	s := t.current()
+	ab = ability.Ability{Demo: s.demo}
 	var errs []error
 	var errsMu sync.Mutex
 	var wg sync.WaitGroup
-	for _, p := range t.llmProviders {
+	for _, p := range s.llmProviders {
 		wg.Add(1)
 		go func(p_ client.LLM) {
 			defer wg.Done()
-			err := p_.SetAbility(ctx, &ab.LLM)
+			// OpenAI-compatible endpoints add to the same slice, so each provider sets its own copy to be merged
+			var a ability.LLMAblt
+			err := p_.SetAbility(ctx, &a)
+			errsMu.Lock()
+			defer errsMu.Unlock()
+			mergeLLMAbility(&ab.LLM, a)
 			if err != nil {
-				errsMu.Lock()
 				errs = append(errs, err)
-				errsMu.Unlock()
 				t.logger.Sugar().Error("failed to get LLM Ability: ", err)
 			}
 		}(p)
 	}
-	for _, p := range t.ttsProviders {
+	for _, p := range s.ttsProviders {
 		wg.Add(1)
 		go func(p_ client.TextToSpeech) {
 			defer wg.Done()
@@ -157,7 +335,7 @@ func (t *Talker) Ability(ctx context.Context) ([]error, ability.Ability) {
 			}
 		}(p)
 	}
-	for _, p := range t.sstProviders {
+	for _, p := range s.sstProviders {
 		wg.Add(1)
 		go func(p_ client.SpeechToText) {
 			defer wg.Done()
@@ -171,15 +349,40 @@ func (t *Talker) Ability(ctx context.Context) ([]error, ability.Ability) {
 		}(p)
 	}
 	wg.Wait()
+	// providers finish in any order
+	slices.SortFunc(ab.LLM.OpenAICompatible, func(a, b ability.OpenAICompatibleAblt) int {
+		return strings.Compare(a.Name, b.Name)
+	})
 	TalkCache.PutAbility(ab)
 	return errs, ab
 }
 
+// mergeLLMAbility adds what a provider has set in src to dst
+func mergeLLMAbility(dst *ability.LLMAblt, src ability.LLMAblt) {
+	if !src.Available {
+		return
+	}
+	dst.Available = true
+	if src.ChatGPT.Available {
+		dst.ChatGPT = src.ChatGPT
+	}
+	if src.AzureChatGPT.Available {
+		dst.AzureChatGPT = src.AzureChatGPT
+	}
+	if src.Gemini.Available {
+		dst.Gemini = src.Gemini
+	}
+	if src.Claude.Available {
+		dst.Claude = src.Claude
+	}
+	dst.OpenAICompatible = append(dst.OpenAICompatible, src.OpenAICompatible...)
+}
+
 func (t *Talker) SelectLLMProvider(o *ability.LLMOption) (llm client.LLM, ok bool) {
 	if o == nil {
 		return nil, false
 	}
-	for _, p := range t.llmProviders {
+	for _, p := range t.current().llmProviders {
 		if p.Support(*o) {
 			return p, true
 		}
@@ -191,7 +394,7 @@ func (t *Talker) SelectTTSProvider(o *ability.TTSOption) (tts client.TextToSpeec
 	if o == nil {
 		return nil, false
 	}
-	for _, p := range t.ttsProviders {
+	for _, p := range t.current().ttsProviders {
 		if p.Support(*o) {
 			return p, true
 		}
@@ -203,7 +406,7 @@ func (t *Talker) SelectSTTProvider(o *ability.STTOption) (tts client.SpeechToTex
 	if o == nil {
 		return nil, false
 	}
-	for _, p := range t.sstProviders {
+	for _, p := range t.current().sstProviders {
 		if p.Support(*o) {
 			return p, true
 		}
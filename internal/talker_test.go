@@ -0,0 +1,81 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/proxoar/talk/pkg/ability"
+	"github.com/proxoar/talk/pkg/client"
+	"github.com/proxoar/talk/pkg/providers"
+	"go.uber.org/zap"
+)
+
+func TestTalkerAbility(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"object":"list","data":[{"id":"llama3","object":"model"}]}`))
+	}))
+	defer srv.Close()
+
+	var llms []client.LLM
+	for _, name := range []string{"vllm", "ollama", "lm-studio"} {
+		llms = append(llms, providers.NewOpenAICompatible(name, srv.URL, "", nil, zap.NewNop()))
+	}
+	talker := &Talker{logger: zap.NewNop()}
+	talker.set.Store(&providerSet{llmProviders: llms})
+	TalkCache.DeleteAbility()
+	defer TalkCache.DeleteAbility()
+
+	errs, ab := talker.Ability(context.Background())
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	var names []string
+	for _, e := range ab.LLM.OpenAICompatible {
+		names = append(names, e.Name)
+	}
+	if want := []string{"lm-studio", "ollama", "vllm"}; !slices.Equal(names, want) || !ab.LLM.Available {
+		t.Errorf("OpenAICompatible = %v, available = %v, want %v, true", names, ab.LLM.Available, want)
+	}
+}
+
+func TestTalkerMetricModel(t *testing.T) {
+	talker := &Talker{logger: zap.NewNop()}
+	talker.set.Store(&providerSet{})
+	TalkCache.PutAbility(ability.Ability{
+		LLM: ability.LLMAblt{
+			ChatGPT:          ability.ChatGPTAblt{Models: []ability.Model{{Name: "gpt-4o"}}},
+			OpenAICompatible: []ability.OpenAICompatibleAblt{{Name: "ollama", Models: []ability.Model{{Name: "llama3"}}}},
+		},
+		TTS: ability.TTSAblt{Piper: ability.PiperTTSAblt{Voices: []ability.TaggedItem{{Id: "en_US-amy-medium"}}}},
+	})
+	defer TalkCache.DeleteAbility()
+
+	tests := []struct {
+		name   string
+		option any
+		want   string
+	}{
+		{name: "listed", option: ability.LLMOption{ChatGPT: &ability.ChatGPTOption{Model: "gpt-4o"}}, want: "gpt-4o"},
+		{name: "not listed", option: ability.LLMOption{ChatGPT: &ability.ChatGPTOption{Model: "gpt-4o-0000"}}, want: metricOtherModel},
+		{name: "listed by endpoint",
+			option: ability.LLMOption{OpenAICompatible: &ability.OpenAICompatibleOption{Endpoint: "ollama", ChatGPTOption: ability.ChatGPTOption{Model: "llama3"}}},
+			want:   "llama3"},
+		{name: "listed by another endpoint",
+			option: ability.LLMOption{OpenAICompatible: &ability.OpenAICompatibleOption{Endpoint: "vllm", ChatGPTOption: ability.ChatGPTOption{Model: "llama3"}}},
+			want:   metricOtherModel},
+		{name: "voice as model", option: ability.TTSOption{Piper: &ability.PiperTTSOption{VoiceId: "en_US-amy-medium"}}, want: "en_US-amy-medium"},
+		{name: "no model", option: ability.TTSOption{Elevenlabs: &ability.ElevenlabsTTSOption{VoiceId: "any"}}, want: ""},
+		{name: "unavailable provider", option: ability.STTOption{Google: &ability.GoogleSTTOption{Recognizer: "any"}}, want: metricOtherModel},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := talker.metricModel(context.Background(), tt.option); got != tt.want {
+				t.Errorf("metricModel() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
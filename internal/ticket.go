@@ -0,0 +1,68 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+)
+
+// ErrTicketCancelled is the cause of the context of a cancelled ticket
+var ErrTicketCancelled = errors.New("ticket has been cancelled by client")
+
+type ticket struct {
+	chatId string
+	cancel context.CancelCauseFunc
+}
+
+// Tickets
+// keeps a cancellable context for each in-flight ticket, so that a client can abort the provider calls of its ticket.
+//
+// Tickets are keyed by stream id and ticket id, a client can't cancel tickets of other clients.
+type Tickets struct {
+	m sync.Map
+}
+
+func NewTickets() *Tickets {
+	return &Tickets{}
+}
+
+// Register returns a context which is done when the ticket is cancelled,
+// and a func that must be called when the ticket finishes.
+func (t *Tickets) Register(streamId, chatId, ticketId string) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	key := ticketKey(streamId, ticketId)
+	tk := &ticket{chatId: chatId, cancel: cancel}
+	t.m.Store(key, tk)
+	return ctx, func() {
+		t.m.CompareAndDelete(key, tk)
+		cancel(nil)
+	}
+}
+
+// Cancel returns the chat id of the ticket, and false if the ticket doesn't exist or has finished
+func (t *Tickets) Cancel(streamId, ticketId string) (chatId string, ok bool) {
+	v, ok := t.m.LoadAndDelete(ticketKey(streamId, ticketId))
+	if !ok {
+		return "", false
+	}
+	tk := v.(*ticket)
+	tk.cancel(ErrTicketCancelled)
+	return tk.chatId, true
+}
+
+// CancelStream cancels all in-flight tickets of a stream, e.g. when its client disconnects
+func (t *Tickets) CancelStream(streamId string) {
+	prefix := ticketKey(streamId, "")
+	t.m.Range(func(key, v any) bool {
+		if strings.HasPrefix(key.(string), prefix) {
+			t.m.Delete(key)
+			v.(*ticket).cancel(ErrTicketCancelled)
+		}
+		return true
+	})
+}
+
+func ticketKey(streamId, ticketId string) string {
+	return streamId + "/" + ticketId
+}
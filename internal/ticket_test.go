@@ -0,0 +1,35 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/proxoar/talk/internal/api"
+	"go.uber.org/zap"
+)
+
+type nopPublisher struct{}
+
+func (nopPublisher) PublishData(string, string, interface{}) {}
+
+func TestTicketCancelBeforeStart(t *testing.T) {
+	tickets := NewTickets()
+	talker := &Talker{logger: zap.NewNop()}
+	talker.set.Store(&providerSet{})
+	h := NewChatHandler("stream", "chat", "alice", "ticket", api.TalkOption{}, nopPublisher{}, talker, tickets, nil, nil, zap.NewNop())
+
+	// client may cancel as soon as the request is answered, before Start runs
+	if chatId, ok := tickets.Cancel("stream", "ticket"); !ok || chatId != "chat" {
+		t.Fatalf("Cancel() = %q, %v, want chat, true", chatId, ok)
+	}
+	if err := context.Cause(h.ctx); !errors.Is(err, ErrTicketCancelled) {
+		t.Errorf("cause = %v, want %v", err, ErrTicketCancelled)
+	}
+
+	h = NewChatHandler("stream", "chat", "alice", "ticket", api.TalkOption{}, nopPublisher{}, talker, tickets, nil, nil, zap.NewNop())
+	h.Start(nil, nil)
+	if _, ok := tickets.Cancel("stream", "ticket"); ok {
+		t.Error("Cancel() = true after the ticket has finished, want false")
+	}
+}
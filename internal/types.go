@@ -5,4 +5,7 @@ import "io"
 type AudioReader struct {
 	Reader   io.Reader
 	FileName string
+	// Streaming is true if audio is still being recorded, in which case it's transcribed as it arrives
+	// by providers that support streaming
+	Streaming bool
 }
@@ -0,0 +1,61 @@
+package util
+
+import (
+	"strings"
+	"unicode"
+)
+
+const codeFence = "```"
+
+// SentenceSplitter
+// splits streamed text into sentences, so that each sentence can be synthesized while the rest is still streaming.
+//
+// A sentence ends with a line break, a CJK terminal punctuation, or a terminal punctuation followed by a space.
+// Code blocks are never split.
+type SentenceSplitter struct {
+	buf []rune
+}
+
+// Write appends r and returns a sentence if r completes one
+func (s *SentenceSplitter) Write(r rune) (string, bool) {
+	s.buf = append(s.buf, r)
+	if !s.endsSentence(r) || s.inCodeBlock() {
+		return "", false
+	}
+	sentence := string(s.buf)
+	s.buf = s.buf[:0]
+	return sentence, true
+}
+
+// Flush returns the remaining text, which is the last sentence
+func (s *SentenceSplitter) Flush() string {
+	sentence := string(s.buf)
+	s.buf = s.buf[:0]
+	return sentence
+}
+
+func (s *SentenceSplitter) endsSentence(r rune) bool {
+	switch r {
+	case '\n', '。', '！', '？', '；':
+		return true
+	}
+	if !unicode.IsSpace(r) || len(s.buf) < 2 {
+		return false
+	}
+	switch s.buf[len(s.buf)-2] {
+	case '.', '!', '?', ';', ':':
+		return true
+	}
+	return false
+}
+
+func (s *SentenceSplitter) inCodeBlock() bool {
+	return strings.Count(string(s.buf), codeFence)%2 == 1
+}
+
+// Speakable reports whether text contains anything worth synthesizing, such as a letter or a digit
+func Speakable(text string) bool {
+	return strings.IndexFunc(text, func(r rune) bool {
+		return unicode.IsLetter(r) || unicode.IsDigit(r)
+	}) >= 0
+}
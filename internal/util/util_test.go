@@ -1,6 +1,9 @@
 package util
 
-import "testing"
+import (
+	"reflect"
+	"testing"
+)
 
 func TestRemoveCodeFromText(t *testing.T) {
 	type args struct {
@@ -26,3 +29,36 @@ func TestRemoveCodeFromText(t *testing.T) {
 		})
 	}
 }
+
+func TestSentenceSplitter(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want []string
+	}{
+		{name: "empty", text: "", want: nil},
+		{name: "no terminal", text: "ab", want: []string{"ab"}},
+		{name: "sentences", text: "Hi. How are you? Fine!", want: []string{"Hi. ", "How are you? ", "Fine!"}},
+		{name: "decimal", text: "Pi is 3.14 or so.", want: []string{"Pi is 3.14 or so."}},
+		{name: "line break", text: "a\nb", want: []string{"a\n", "b"}},
+		{name: "cjk", text: "你好。再见！", want: []string{"你好。", "再见！"}},
+		{name: "code block", text: "See:\n```go\na := 1\nb := 2\n```\nDone.", want: []string{"See:\n", "```go\na := 1\nb := 2\n```\n", "Done."}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s SentenceSplitter
+			var got []string
+			for _, r := range tt.text {
+				if sentence, ok := s.Write(r); ok {
+					got = append(got, sentence)
+				}
+			}
+			if rest := s.Flush(); rest != "" {
+				got = append(got, rest)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("SentenceSplitter = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
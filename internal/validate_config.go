@@ -0,0 +1,77 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/proxoar/talk/internal/config"
+	"github.com/proxoar/talk/pkg/client"
+	"go.uber.org/zap"
+)
+
+// ValidateConfig
+// prints mistakes in the config file at configPath, and checks each credential with a request to its provider
+// if live is true. It returns an error if anything is wrong.
+func ValidateConfig(configPath string, live bool) error {
+	logger := mustCLILogger()
+
+	conf, err := config.LoadConfig(configPath, logger)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	problems := config.Validate(*conf)
+	for _, p := range problems {
+		fmt.Println("✗", p)
+	}
+	failed := len(problems) > 0
+	if live {
+		failed = !checkCredentials(*conf, logger) || failed
+	}
+	if failed {
+		return errors.New("config is invalid")
+	}
+	fmt.Println("config is valid")
+	return nil
+}
+
+// checkCredentials prints the health of each provider and each of its credentials, and returns whether all are usable
+func checkCredentials(conf config.TalkConfig, logger *zap.Logger) bool {
+	ps, err := newProviderSet(conf, logger)
+	if err != nil {
+		fmt.Println("✗ failed to create providers:", err)
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+
+	ok := true
+	for _, c := range ps.named {
+		h := client.CheckHealth(ctx, c.Client)
+		if len(h.Keys) == 0 {
+			ok = printHealth(fmt.Sprintf("%s %s", c.kind, c.name), h) && ok
+			continue
+		}
+		for _, k := range h.Keys {
+			ok = printHealth(fmt.Sprintf("%s %s (creds.%s)", c.kind, c.name, k.Key), k.Health) && ok
+		}
+	}
+	return ok
+}
+
+func printHealth(name string, h client.Health) bool {
+	mark := "✓"
+	switch h.Status {
+	case client.StatusDegraded:
+		mark = "!"
+	case client.StatusUnhealthy:
+		mark = "✗"
+	}
+	line := fmt.Sprintf("%s %s: %s in %dms", mark, name, h.Status, h.LatencyMs)
+	if h.Message != "" {
+		line += ", " + h.Message
+	}
+	fmt.Println(line)
+	return h.Status != client.StatusUnhealthy
+}
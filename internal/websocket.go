@@ -0,0 +1,346 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+	"github.com/proxoar/talk/internal/api"
+	"github.com/proxoar/talk/internal/metrics"
+	"github.com/proxoar/talk/internal/middleware"
+	"github.com/proxoar/talk/internal/storage"
+	"github.com/proxoar/talk/internal/util"
+	"go.uber.org/zap"
+)
+
+const (
+	wsWriteWait = 10 * time.Second
+	// client must answer a ping within wsPongWait
+	wsPongWait = 2 * keepAliveInterval
+	// audio recorded by browsers is far smaller than this
+	wsMaxMessageSize = 32 << 20
+)
+
+// WebSocket
+// serves /api/ws, which carries events, chat requests, and cancellations over one connection,
+// see api.WSEvent for the framing.
+//
+// Each connection has its own stream id, so clients don't need to send one.
+type WebSocket struct {
+	upgrader websocket.Upgrader
+	talker   *Talker
+	tickets  *Tickets
+	storage  *storage.Storage
+	quotas   *Quotas
+	logger   *zap.Logger
+	// *wsSession -> struct{}, connected sessions
+	sessions sync.Map
+}
+
+func NewWebSocket(talker *Talker, tickets *Tickets, storage *storage.Storage, quotas *Quotas, logger *zap.Logger) *WebSocket {
+	return &WebSocket{
+		upgrader: websocket.Upgrader{
+			// the same as middleware.AllowAllCors
+			CheckOrigin: func(_ *http.Request) bool { return true },
+		},
+		talker:  talker,
+		tickets: tickets,
+		storage: storage,
+		quotas:  quotas,
+		logger:  logger,
+	}
+}
+
+func (w *WebSocket) HandleEcho(c echo.Context) error {
+	conn, err := w.upgrader.Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		// upgrader has replied to client
+		w.logger.Sugar().Debug("failed to upgrade to WebSocket: ", err)
+		return nil
+	}
+	id := middleware.IdentityOf(c)
+	s := &wsSession{
+		ws:       w,
+		conn:     conn,
+		streamId: util.RandomHash16Chars(),
+		owner:    id.Key,
+		quota:    w.quotas.For(id),
+		done:     make(chan struct{}),
+	}
+	s.serve()
+	return nil
+}
+
+// Broadcast sends an event to every connected session
+func (w *WebSocket) Broadcast(eventName string, data interface{}) {
+	w.sessions.Range(func(k, _ any) bool {
+		s := k.(*wsSession)
+		s.PublishData(s.streamId, eventName, data)
+		return true
+	})
+}
+
+// wsSession is a WebSocket connection, which implements Publisher
+type wsSession struct {
+	ws       *WebSocket
+	conn     *websocket.Conn
+	streamId string
+	owner    string // identity key of the sender, see ChatHandler.owner
+	quota    *Quota
+	// gorilla/websocket supports one concurrent writer only
+	writeMu sync.Mutex
+	done    chan struct{}
+	// ticket id -> *audioStream, audio that is being recorded
+	streams sync.Map
+}
+
+func (s *wsSession) serve() {
+	logger := s.ws.logger
+	logger.Sugar().Debug("WebSocket connected, stream id: ", s.streamId)
+	metrics.WebSocketConnected()
+	s.ws.sessions.Store(s, struct{}{})
+	defer func() {
+		metrics.WebSocketDisconnected()
+		s.ws.sessions.Delete(s)
+		close(s.done)
+		// nobody will receive events of the tickets
+		s.ws.tickets.CancelStream(s.streamId)
+		s.streams.Range(func(_, v any) bool {
+			v.(*audioStream).Close(context.Canceled)
+			return true
+		})
+		_ = s.conn.Close()
+		logger.Sugar().Debug("WebSocket disconnected, stream id: ", s.streamId)
+	}()
+
+	s.conn.SetReadLimit(wsMaxMessageSize)
+	_ = s.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	s.conn.SetPongHandler(func(string) error {
+		return s.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	go s.keepAlive()
+	go s.publishAbility()
+
+	for {
+		typ, data, err := s.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				logger.Sugar().Warn("failed to read from WebSocket: ", err)
+			}
+			return
+		}
+		switch typ {
+		case websocket.TextMessage:
+			err = s.onRequest(data)
+		case websocket.BinaryMessage:
+			err = s.onBinary(data)
+		}
+		if err != nil {
+			logger.Sugar().Warn("bad request from WebSocket: ", err)
+			s.PublishData(s.streamId, api.EventMessageError, api.Error{ErrMsg: err.Error()})
+		}
+	}
+}
+
+// publishAbility emits an Ability on connection, the same as SSE
+func (s *wsSession) publishAbility() {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	errs, ab := s.ws.talker.Ability(ctx)
+	for i, v := range errs {
+		s.ws.logger.Sugar().Errorf("error-%d when getting Ability: %s", i, v)
+	}
+	s.PublishData(s.streamId, api.EventSystemAbility, ab)
+}
+
+func (s *wsSession) keepAlive() {
+	ticker := time.NewTicker(keepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.writeMu.Lock()
+			err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait))
+			s.writeMu.Unlock()
+			if err != nil {
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *wsSession) onRequest(data []byte) error {
+	req := new(api.WSRequest)
+	if err := json.Unmarshal(data, req); err != nil {
+		return err
+	}
+	if err := api.RestfulValidator.Struct(req); err != nil {
+		return err
+	}
+	switch req.Type {
+	case api.WSRequestChat:
+		s.ws.logger.Sugar().Debug("option from client req", prettyJson(req.Chat.TalkOption))
+		handler := s.newChatHandler(*req.Chat)
+		go handler.Start(req.Chat.Ms, nil)
+	case api.WSRequestAudioStart:
+		return s.onAudioStart(*req.Chat, req.FileName)
+	case api.WSRequestAudioEnd:
+		v, ok := s.streams.LoadAndDelete(req.TicketId)
+		if !ok {
+			return fmt.Errorf("audio of ticket %s is not found", req.TicketId)
+		}
+		v.(*audioStream).Close(nil)
+	case api.WSRequestCancel:
+		if v, ok := s.streams.LoadAndDelete(req.TicketId); ok {
+			v.(*audioStream).Close(context.Canceled)
+		}
+		chatId, ok := s.ws.tickets.Cancel(s.streamId, req.TicketId)
+		if !ok {
+			return fmt.Errorf("ticket %s is not found or has finished", req.TicketId)
+		}
+		s.ws.logger.Sugar().Debug("ticket cancelled: ", req.TicketId)
+		s.PublishData(s.streamId, api.EventMessageCancelled, api.Cancelled{
+			ChatId:   chatId,
+			TicketId: req.TicketId,
+		})
+	}
+	return nil
+}
+
+func (s *wsSession) onBinary(data []byte) error {
+	header, audio, err := splitBinaryFrame(data)
+	if err != nil {
+		return err
+	}
+	var typ struct {
+		Type string `json:"type"`
+	}
+	if err = json.Unmarshal(header, &typ); err != nil {
+		return err
+	}
+	if typ.Type == api.WSAudioChunkType {
+		return s.onAudioChunk(header, audio)
+	}
+	return s.onAudioChat(header, audio)
+}
+
+func (s *wsSession) onAudioChat(header, audio []byte) error {
+	req := new(api.WSAudioChat)
+	if err := json.Unmarshal(header, req); err != nil {
+		return err
+	}
+	if err := api.RestfulValidator.Struct(req); err != nil {
+		return err
+	}
+	s.ws.logger.Sugar().Debug("option from client req", prettyJson(req.Chat.TalkOption))
+	ar := AudioReader{
+		Reader:   bytes.NewReader(audio),
+		FileName: req.FileName,
+	}
+	handler := s.newChatHandler(req.Chat)
+	go handler.Start(req.Chat.Ms, &ar)
+	return nil
+}
+
+// onAudioStart starts a chat whose audio is sent chunk by chunk, and is transcribed as it arrives
+func (s *wsSession) onAudioStart(chat api.Chat, fileName string) error {
+	stream := newAudioStream()
+	if _, loaded := s.streams.LoadOrStore(chat.TicketId, stream); loaded {
+		return fmt.Errorf("audio of ticket %s has started", chat.TicketId)
+	}
+	s.ws.logger.Sugar().Debug("option from client req", prettyJson(chat.TalkOption))
+	ar := AudioReader{
+		Reader:    stream,
+		FileName:  fileName,
+		Streaming: true,
+	}
+	handler := s.newChatHandler(chat)
+	go handler.Start(chat.Ms, &ar)
+	return nil
+}
+
+func (s *wsSession) onAudioChunk(header, audio []byte) error {
+	req := new(api.WSAudioChunk)
+	if err := json.Unmarshal(header, req); err != nil {
+		return err
+	}
+	if err := api.RestfulValidator.Struct(req); err != nil {
+		return err
+	}
+	v, ok := s.streams.Load(req.TicketId)
+	if !ok {
+		return fmt.Errorf("audio of ticket %s is not found or has ended", req.TicketId)
+	}
+	if _, err := v.(*audioStream).Write(audio); err != nil {
+		// the stream has been closed by the error, later chunks are refused as the ones of an ended stream
+		s.streams.Delete(req.TicketId)
+		return err
+	}
+	return nil
+}
+
+func (s *wsSession) newChatHandler(chat api.Chat) *ChatHandler {
+	w := s.ws
+	return NewChatHandler(s.streamId, chat.ChatId, s.owner, chat.TicketId, chat.TalkOption, s, w.talker, w.tickets, w.storage, s.quota, w.logger)
+}
+
+// PublishData sends audio as a binary frame, and other events as text frames. streamId is ignored
+// since the connection has only one stream.
+func (s *wsSession) PublishData(_, eventName string, data interface{}) {
+	var typ int
+	var frame []byte
+	var err error
+	if audio, ok := data.(api.Audio); ok {
+		bin := audio.Audio
+		audio.Audio = nil
+		typ = websocket.BinaryMessage
+		frame, err = joinBinaryFrame(api.WSEvent{Event: eventName, Data: audio}, bin)
+	} else {
+		typ = websocket.TextMessage
+		frame, err = json.Marshal(api.WSEvent{Event: eventName, Data: data})
+	}
+	if err != nil {
+		s.ws.logger.Error(err.Error())
+		return
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	_ = s.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	if err = s.conn.WriteMessage(typ, frame); err != nil {
+		s.ws.logger.Sugar().Debugf("failed to write %s to WebSocket: %v", eventName, err)
+	}
+}
+
+// joinBinaryFrame encodes header as JSON, and prefixes payload with it and its length
+func joinBinaryFrame(header interface{}, payload []byte) ([]byte, error) {
+	h, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	frame := make([]byte, 4, 4+len(h)+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(h)))
+	frame = append(frame, h...)
+	return append(frame, payload...), nil
+}
+
+func splitBinaryFrame(frame []byte) (header, payload []byte, err error) {
+	if len(frame) < 4 {
+		return nil, nil, errors.New("binary frame is too short")
+	}
+	n := binary.BigEndian.Uint32(frame)
+	if uint64(n) > uint64(len(frame)-4) {
+		return nil, nil, fmt.Errorf("header length %d exceeds binary frame", n)
+	}
+	return frame[4 : 4+n], frame[4+n:], nil
+}
@@ -0,0 +1,37 @@
+package internal
+
+import (
+	"testing"
+)
+
+func TestBinaryFrame(t *testing.T) {
+	joined, err := joinBinaryFrame(map[string]string{"type": "chunk"}, []byte("audio"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		frame       []byte
+		wantHeader  string
+		wantPayload string
+		wantErr     bool
+	}{
+		{name: "joined", frame: joined, wantHeader: `{"type":"chunk"}`, wantPayload: "audio"},
+		{name: "no payload", frame: []byte("\x00\x00\x00\x02{}"), wantHeader: "{}"},
+		{name: "empty", frame: nil, wantErr: true},
+		{name: "short", frame: []byte("\x00\x00\x00"), wantErr: true},
+		{name: "header overflows", frame: []byte("\x00\x00\x00\x03{}"), wantErr: true},
+		{name: "max header length", frame: []byte("\xff\xff\xff\xff{}"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header, payload, err := splitBinaryFrame(tt.frame)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("splitBinaryFrame() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if string(header) != tt.wantHeader || string(payload) != tt.wantPayload {
+				t.Errorf("splitBinaryFrame() = %q, %q, want %q, %q", header, payload, tt.wantHeader, tt.wantPayload)
+			}
+		})
+	}
+}
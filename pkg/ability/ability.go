@@ -14,6 +14,8 @@ type TTSAblt struct {
 	Available  bool              `json:"available"`
 	Google     GoogleTTSAblt     `json:"google"`
 	Elevenlabs ElevenlabsTTSAblt `json:"elevenlabs"`
+	Piper      PiperTTSAblt      `json:"piper"`
+	OpenAI     OpenAITTSAblt     `json:"openAI"`
 }
 
 type GoogleTTSAblt struct {
@@ -26,12 +28,28 @@ type ElevenlabsTTSAblt struct {
 	Voices    []TaggedItem `json:"voices"`
 }
 
+type OpenAITTSAblt struct {
+	Available bool         `json:"available"`
+	Voices    []TaggedItem `json:"voices"`
+	Models    []string     `json:"models"`
+	Formats   []string     `json:"formats"`
+}
+
+type PiperTTSAblt struct {
+	Available bool         `json:"available"`
+	Voices    []TaggedItem `json:"voices"`
+}
+
 // STTAblt speech to text
 
 type STTAblt struct {
 	Available bool         `json:"available"`
 	Whisper   WhisperSTTAb `json:"whisper"`
 	Google    GoogleSTTAb  `json:"google"`
+	// AzureWhisper lists deployments as models
+	AzureWhisper WhisperSTTAb `json:"azureWhisper"`
+	// LocalWhisper lists models from config
+	LocalWhisper WhisperSTTAb `json:"localWhisper"`
 }
 
 type WhisperSTTAb struct {
@@ -50,6 +68,11 @@ type LLMAblt struct {
 	Available bool        `json:"available"`
 	ChatGPT   ChatGPTAblt `json:"chatGPT"`
 	Gemini    GeminiAblt  `json:"gemini"`
+	Claude    ClaudeAblt  `json:"claude"`
+	// OpenAICompatible contains an entry for each available OpenAI-compatible endpoint
+	OpenAICompatible []OpenAICompatibleAblt `json:"openAICompatible"`
+	// AzureChatGPT lists deployments as models
+	AzureChatGPT ChatGPTAblt `json:"azureChatGPT"`
 }
 
 type ChatGPTAblt struct {
@@ -57,11 +80,22 @@ type ChatGPTAblt struct {
 	Models    []Model `json:"models"`
 }
 
+type OpenAICompatibleAblt struct {
+	Name      string  `json:"name"`
+	Available bool    `json:"available"`
+	Models    []Model `json:"models"`
+}
+
 type GeminiAblt struct {
 	Available bool    `json:"available"`
 	Models    []Model `json:"models"`
 }
 
+type ClaudeAblt struct {
+	Available bool    `json:"available"`
+	Models    []Model `json:"models"`
+}
+
 // other
 
 type TaggedItem struct {
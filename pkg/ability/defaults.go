@@ -22,3 +22,55 @@ func DefaultGeminiOption() *GeminiOption {
 		TopK:            32,
 	}
 }
+
+func DefaultClaudeOption() *ClaudeOption {
+	// https://docs.anthropic.com/en/api/messages
+	return &ClaudeOption{
+		Model:         "claude-sonnet-4-5",
+		StopSequences: nil,
+		MaxTokens:     4096,
+		Temperature:   1,
+		TopP:          1,
+		TopK:          0,
+	}
+}
+
+func DefaultOpenAITTSOption() *OpenAITTSOption {
+	// https://platform.openai.com/docs/api-reference/audio/createSpeech
+	return &OpenAITTSOption{
+		Model:          "tts-1",
+		Voice:          "alloy",
+		Speed:          1,
+		ResponseFormat: "mp3",
+	}
+}
+
+func DefaultElevenlabsTTSOption() *ElevenlabsTTSOption {
+	// an empty VoiceId lets the provider choose one
+	return &ElevenlabsTTSOption{
+		VoiceId:   "",
+		Stability: 0.5,
+		Clarity:   0.75,
+	}
+}
+
+func DefaultGoogleTTSOption() *GoogleTTSOption {
+	return &GoogleTTSOption{
+		VoiceId:      "",
+		LanguageCode: "en-US",
+		SpeakingRate: 1,
+		Pitch:        0,
+		VolumeGainDb: 0,
+	}
+}
+
+func DefaultPiperTTSOption() *PiperTTSOption {
+	// an empty VoiceId lets the provider choose one
+	return &PiperTTSOption{}
+}
+
+func DefaultWhisperOption() *WhisperOption {
+	return &WhisperOption{
+		Model: "whisper-1",
+	}
+}
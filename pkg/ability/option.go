@@ -6,6 +6,11 @@ import "cloud.google.com/go/texttospeech/apiv1/texttospeechpb"
 type LLMOption struct {
 	ChatGPT *ChatGPTOption `json:"chatGPT"`
 	Gemini  *GeminiOption  `json:"gemini"`
+	Claude  *ClaudeOption  `json:"claude"`
+	// OpenAICompatible is served by the endpoint whose name equals OpenAICompatibleOption.Endpoint
+	OpenAICompatible *OpenAICompatibleOption `json:"openAICompatible"`
+	// AzureChatGPT uses a deployment name as ChatGPTOption.Model
+	AzureChatGPT *ChatGPTOption `json:"azureChatGPT"`
 }
 
 type ChatGPTOption struct {
@@ -17,6 +22,11 @@ type ChatGPTOption struct {
 	FrequencyPenalty float32 `json:"frequencyPenalty"`
 }
 
+type OpenAICompatibleOption struct {
+	Endpoint string `json:"endpoint"` // name of an endpoint declared in llm.openai-compatible
+	ChatGPTOption
+}
+
 type GeminiOption struct {
 	Model           string   `json:"model"`
 	StopSequences   []string `json:"stopSequences"`
@@ -26,9 +36,22 @@ type GeminiOption struct {
 	TopK            int32    `json:"topK"`
 }
 
+type ClaudeOption struct {
+	Model         string   `json:"model"`
+	StopSequences []string `json:"stopSequences"`
+	MaxTokens     int      `json:"maxTokens"`
+	Temperature   float32  `json:"temperature"`
+	TopP          float32  `json:"topP"`
+	TopK          int32    `json:"topK"`
+}
+
 type STTOption struct {
 	Whisper *WhisperOption   `json:"whisper"`
 	Google  *GoogleSTTOption `json:"google"`
+	// AzureWhisper uses a deployment name as WhisperOption.Model
+	AzureWhisper *WhisperOption `json:"azureWhisper"`
+	// LocalWhisper is served by a locally hosted whisper-compatible server, WhisperOption.Model can be empty
+	LocalWhisper *WhisperOption `json:"localWhisper"`
 }
 
 type GoogleTTSOption struct {
@@ -44,6 +67,22 @@ type GoogleTTSOption struct {
 type TTSOption struct {
 	Elevenlabs *ElevenlabsTTSOption `json:"elevenlabs"`
 	Google     *GoogleTTSOption     `json:"google"`
+	Piper      *PiperTTSOption      `json:"piper"`
+	OpenAI     *OpenAITTSOption     `json:"openAI"`
+}
+
+type OpenAITTSOption struct {
+	Model          string  `json:"model"`          // tts-1 or tts-1-hd
+	Voice          string  `json:"voice"`          // e.g. alloy
+	Speed          float64 `json:"speed"`          // 0.25 to 4.0, use 1.0 if it's 0
+	ResponseFormat string  `json:"responseFormat"` // mp3, opus, aac, flac or wav, use mp3 if it's empty
+}
+
+type PiperTTSOption struct {
+	// use the first voice if VoiceId is empty
+	VoiceId string `json:"voiceId"`
+	// phoneme length, larger is slower, use the default of the voice if it's 0
+	LengthScale float32 `json:"lengthScale"`
 }
 
 type WhisperOption struct {
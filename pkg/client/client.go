@@ -2,8 +2,61 @@ package client
 
 import (
 	"context"
+	"fmt"
+	"time"
 )
 
 type Client interface {
-	CheckHealth(ctx context.Context)
+	// CheckHealth sends a request to the server, which consumes a minimal amount of quota or even no quota
+	CheckHealth(ctx context.Context) Health
+}
+
+type HealthStatus string
+
+const (
+	StatusHealthy HealthStatus = "healthy"
+	// StatusDegraded means the server responds, but there are issues such as quota exhaustion or incorrect
+	// transcriptions, indicating a potential problem
+	StatusDegraded HealthStatus = "degraded"
+	// StatusUnhealthy means the server doesn't work, e.g. invalid API key or connection error
+	StatusUnhealthy HealthStatus = "unhealthy"
+)
+
+type Health struct {
+	Status HealthStatus `json:"status"`
+	// LatencyMs is how long the check took, see CheckHealth
+	LatencyMs int64 `json:"latencyMs"`
+	// QuotaUsed and QuotaTotal are 0 if the provider doesn't support quota query
+	QuotaUsed  int    `json:"quotaUsed,omitempty"`
+	QuotaTotal int    `json:"quotaTotal,omitempty"`
+	Message    string `json:"message,omitempty"`
+	// Keys is the health of each credential, if the provider has more than one
+	Keys []KeyHealth `json:"keys,omitempty"`
+}
+
+type KeyHealth struct {
+	Key string `json:"key"` // key of the credential in config
+	Health
+	// CooldownUntil is set if the credential is skipped since it has been throttled or rejected
+	CooldownUntil *time.Time `json:"cooldownUntil,omitempty"`
+}
+
+func Healthy() Health {
+	return Health{Status: StatusHealthy}
+}
+
+func Degraded(format string, a ...any) Health {
+	return Health{Status: StatusDegraded, Message: fmt.Sprintf(format, a...)}
+}
+
+func Unhealthy(format string, a ...any) Health {
+	return Health{Status: StatusUnhealthy, Message: fmt.Sprintf(format, a...)}
+}
+
+// CheckHealth calls c.CheckHealth and sets LatencyMs of the result
+func CheckHealth(ctx context.Context, c Client) Health {
+	start := time.Now()
+	h := c.CheckHealth(ctx)
+	h.LatencyMs = time.Since(start).Milliseconds()
+	return h
 }
@@ -17,3 +17,40 @@ type SpeechToText interface {
 	// read ability.STTOption to check if current provider support the option
 	Support(o ability.STTOption) bool
 }
+
+// StreamingSpeechToText transcribes voice while it's being recorded
+type StreamingSpeechToText interface {
+	SpeechToText
+	// StreamingSpeechToText reads audio as it arrives until io.EOF, and returns the whole transcription once
+	// the utterance ends, which may be before audio is drained.
+	//
+	// audio must not be read after it returns, since the rest of audio is read by the caller. Read audio with
+	// ReadContext, so that a read waiting for audio stops once the call is done.
+	//
+	// onTranscript is called with each interim transcription
+	StreamingSpeechToText(ctx context.Context, audio io.Reader, fileName string, option ability.STTOption,
+		onTranscript func(Transcript)) (string, error)
+}
+
+// Transcript is an interim transcription of StreamingSpeechToText
+type Transcript struct {
+	// Text is the transcription so far, which replaces the previous one, since recognized words may be revised
+	Text string
+	// Final is true if Text will not be revised, although more text may follow
+	Final bool
+}
+
+// ContextReader is a reader of audio that is still being recorded, whose Read waits until more audio arrives
+type ContextReader interface {
+	io.Reader
+	// ReadContext is Read that returns ctx.Err() once ctx is done, without consuming any audio
+	ReadContext(ctx context.Context, p []byte) (int, error)
+}
+
+// ReadContext reads r with ctx if r is a ContextReader, or with Read otherwise
+func ReadContext(ctx context.Context, r io.Reader, p []byte) (int, error) {
+	if cr, ok := r.(ContextReader); ok {
+		return cr.ReadContext(ctx, p)
+	}
+	return r.Read(p)
+}
@@ -0,0 +1,65 @@
+package providers
+
+import (
+	"sort"
+
+	"github.com/proxoar/talk/pkg/ability"
+	"github.com/sashabaranov/go-openai"
+)
+
+// AzureDeployment is a model deployed on Azure OpenAI under a deployment name
+type AzureDeployment struct {
+	Name  string
+	Model string
+}
+
+// newAzureConfig creates a config which sends requests to deployments rather than models.
+//
+// Deployment names are listed as models, so clients usually send a deployment name.
+// A model name is accepted as well, and is mapped to the first deployment of that model.
+func newAzureConfig(apiKey, endpoint, apiVersion string, deployments []AzureDeployment) openai.ClientConfig {
+	conf := openai.DefaultAzureConfig(apiKey, endpoint)
+	if apiVersion != "" {
+		conf.APIVersion = apiVersion
+	}
+	conf.AzureModelMapperFunc = func(model string) string {
+		for _, d := range deployments {
+			if d.Name == model {
+				return d.Name
+			}
+		}
+		for _, d := range deployments {
+			if d.Model == model {
+				return d.Name
+			}
+		}
+		return model
+	}
+	return withRetryAfter(conf)
+}
+
+// azureDeploymentNames returns sorted deployment names
+func azureDeploymentNames(deployments []AzureDeployment) []string {
+	names := make([]string, 0, len(deployments))
+	for _, d := range deployments {
+		names = append(names, d.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// azureDeploymentModels lists deployments as ability.Model, sorted by deployment name
+func azureDeploymentModels(deployments []AzureDeployment) []ability.Model {
+	sorted := make([]AzureDeployment, len(deployments))
+	copy(sorted, deployments)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	ms := make([]ability.Model, len(sorted))
+	for i, d := range sorted {
+		ms[i].Name = d.Name
+		ms[i].DisplayName = d.Name
+		if d.Model != "" && d.Model != d.Name {
+			ms[i].DisplayName = d.Name + " (" + d.Model + ")"
+		}
+	}
+	return ms
+}
@@ -16,33 +16,72 @@ import (
 
 type chatGPT struct {
 	client *openai.Client
-	logger *zap.Logger
+	// endpoint is the name of an OpenAI-compatible endpoint, empty for OpenAI itself
+	endpoint string
+	// models are substrings used to filter the model list, all models are listed if it's empty
+	models []string
+	// deployments is non-nil for Azure OpenAI, which serves deployments rather than models
+	deployments []AzureDeployment
+	logger      *zap.Logger
 }
 
 func NewChatGPT(apiKey string, logger *zap.Logger) client.LLM {
 	// by default, the underlying http.client utilizes the proxy from the environment.
-	c := openai.NewClient(apiKey)
+	c := openai.NewClientWithConfig(withRetryAfter(openai.DefaultConfig(apiKey)))
 
 	return &chatGPT{
 		client: c,
+		models: []string{"gpt"},
 		logger: logger,
 	}
 }
 
-func (c *chatGPT) CheckHealth(ctx context.Context) {
+// NewOpenAICompatible creates a client for a server that speaks the OpenAI chat API, such as Ollama, vLLM and LM Studio.
+//
+// apiKey can be empty since most local servers don't require one.
+func NewOpenAICompatible(name, baseURL, apiKey string, models []string, logger *zap.Logger) client.LLM {
+	conf := openai.DefaultConfig(apiKey)
+	conf.BaseURL = baseURL
+	c := openai.NewClientWithConfig(withRetryAfter(conf))
+
+	return &chatGPT{
+		client:   c,
+		endpoint: name,
+		models:   models,
+		logger:   logger,
+	}
+}
+
+// NewAzureChatGPT creates a client for Azure OpenAI. Deployments are listed as models.
+func NewAzureChatGPT(endpoint, apiVersion, apiKey string, deployments []AzureDeployment, logger *zap.Logger) client.LLM {
+	c := openai.NewClientWithConfig(newAzureConfig(apiKey, endpoint, apiVersion, deployments))
+
+	if deployments == nil {
+		deployments = []AzureDeployment{}
+	}
+	return &chatGPT{
+		client:      c,
+		deployments: deployments,
+		logger:      logger,
+	}
+}
+
+func (c *chatGPT) CheckHealth(ctx context.Context) client.Health {
 	m := client.Message{
 		Role:    "user",
 		Content: "Hello!",
 	}
-	o := ability.DefaultChatGPTOption()
-	content, err := c.Completion(ctx, []client.Message{m}, ability.LLMOption{ChatGPT: o})
+	o, err := c.healthCheckOption(ctx)
+	if err != nil {
+		return client.Unhealthy("failed to get models from server: %v", err)
+	}
+	content, err := c.Completion(ctx, []client.Message{m}, o)
 	if err != nil {
-		c.logger.Sugar().Error("[ChatGPT] failed to get response from server: ", err)
+		return client.Unhealthy("failed to get response from server: %v", err)
 	} else if len(content) == 0 {
-		c.logger.Warn(`[ChatGPT] bad smell: got empty content from ChatGPTAblt server`)
-	} else {
-		c.logger.Info("[ChatGPT]  is healthy")
+		return client.Degraded("got empty content from server")
 	}
+	return client.Healthy()
 }
 
 func (c *chatGPT) Quota(_ context.Context) (used, total int, err error) {
@@ -52,25 +91,26 @@ func (c *chatGPT) Quota(_ context.Context) (used, total int, err error) {
 
 func (c *chatGPT) Completion(ctx context.Context, ms []client.Message, t ability.LLMOption) (string, error) {
 	c.logger.Info("completion...")
-	if t.ChatGPT == nil {
-		return "", errors.New("client did not provide ChatGPT option")
+	o := c.option(t)
+	if o == nil {
+		return "", fmt.Errorf("client did not provide %s option", c.name())
 	}
 
 	messages := messageOfComplete(ms)
 
 	req := openai.ChatCompletionRequest{
 		Messages:         messages,
-		Model:            t.ChatGPT.Model,
-		MaxTokens:        t.ChatGPT.MaxTokens,
-		Temperature:      t.ChatGPT.TopP,
-		TopP:             t.ChatGPT.Temperature,
-		PresencePenalty:  t.ChatGPT.PresencePenalty,
-		FrequencyPenalty: t.ChatGPT.FrequencyPenalty,
+		Model:            o.Model,
+		MaxTokens:        o.MaxTokens,
+		Temperature:      o.TopP,
+		TopP:             o.Temperature,
+		PresencePenalty:  o.PresencePenalty,
+		FrequencyPenalty: o.FrequencyPenalty,
 	}
 
 	resp, err := c.client.CreateChatCompletion(ctx, req)
 	if err != nil {
-		return "", fmt.Errorf("failed to CreateChatCompletion: %s", err)
+		return "", fmt.Errorf("failed to CreateChatCompletion: %w", err)
 	}
 
 	content := resp.Choices[0].Message.Content
@@ -84,8 +124,9 @@ func (c *chatGPT) Completion(ctx context.Context, ms []client.Message, t ability
 func (c *chatGPT) CompletionStream(ctx context.Context, ms []client.Message, t ability.LLMOption) *util.SmoothStream {
 	c.logger.Sugar().Debugw("completion stream...", "message list length", len(ms))
 	stream := util.NewSmoothStream()
-	if t.ChatGPT == nil {
-		stream.WriteError(errors.New("client did not provide ChatGPT option"))
+	o := c.option(t)
+	if o == nil {
+		stream.WriteError(fmt.Errorf("client did not provide %s option", c.name()))
 		return stream
 	}
 
@@ -93,12 +134,12 @@ func (c *chatGPT) CompletionStream(ctx context.Context, ms []client.Message, t a
 
 	req := openai.ChatCompletionRequest{
 		Messages:         messages,
-		Model:            t.ChatGPT.Model,
-		MaxTokens:        t.ChatGPT.MaxTokens,
-		Temperature:      t.ChatGPT.Temperature,
-		TopP:             t.ChatGPT.TopP,
-		PresencePenalty:  t.ChatGPT.PresencePenalty,
-		FrequencyPenalty: t.ChatGPT.FrequencyPenalty,
+		Model:            o.Model,
+		MaxTokens:        o.MaxTokens,
+		Temperature:      o.Temperature,
+		TopP:             o.TopP,
+		PresencePenalty:  o.PresencePenalty,
+		FrequencyPenalty: o.FrequencyPenalty,
 	}
 	reqLog := req
 	reqLog.Messages = nil
@@ -125,15 +166,28 @@ func (c *chatGPT) CompletionStream(ctx context.Context, ms []client.Message, t a
 	return stream
 }
 
-// SetAbility set `ChatGPTAblt` and `available` field of ability.LLMAblt
+// SetAbility set `ChatGPTAblt` or an entry of `OpenAICompatible`, and `available` field of ability.LLMAblt
 func (c *chatGPT) SetAbility(ctx context.Context, a *ability.LLMAblt) error {
 	models, err := c.getModels(ctx)
 	if err != nil {
 		return err
 	}
-	a.ChatGPT = ability.ChatGPTAblt{
-		Available: true,
-		Models:    models,
+	if c.isAzure() {
+		a.AzureChatGPT = ability.ChatGPTAblt{
+			Available: true,
+			Models:    models,
+		}
+	} else if c.endpoint == "" {
+		a.ChatGPT = ability.ChatGPTAblt{
+			Available: true,
+			Models:    models,
+		}
+	} else {
+		a.OpenAICompatible = append(a.OpenAICompatible, ability.OpenAICompatibleAblt{
+			Name:      c.endpoint,
+			Available: true,
+			Models:    models,
+		})
 	}
 	a.Available = true
 	return nil
@@ -143,18 +197,72 @@ func (c *chatGPT) SetAbility(ctx context.Context, a *ability.LLMAblt) error {
 //
 // read ability.LLMOption to check if current provider support the option
 func (c *chatGPT) Support(o ability.LLMOption) bool {
-	return o.ChatGPT != nil
+	return c.option(o) != nil
+}
+
+// option picks ChatGPTOption for OpenAI, AzureChatGPT for Azure OpenAI,
+// or OpenAICompatibleOption whose Endpoint matches this endpoint
+func (c *chatGPT) option(o ability.LLMOption) *ability.ChatGPTOption {
+	if c.isAzure() {
+		return o.AzureChatGPT
+	}
+	if c.endpoint == "" {
+		return o.ChatGPT
+	}
+	if o.OpenAICompatible != nil && o.OpenAICompatible.Endpoint == c.endpoint {
+		return &o.OpenAICompatible.ChatGPTOption
+	}
+	return nil
+}
+
+func (c *chatGPT) isAzure() bool {
+	return c.deployments != nil
+}
+
+func (c *chatGPT) name() string {
+	if c.isAzure() {
+		return "Azure ChatGPT"
+	}
+	if c.endpoint == "" {
+		return "ChatGPT"
+	}
+	return "OpenAI-compatible " + c.endpoint
+}
+
+// healthCheckOption uses the default model for OpenAI, and the first listed model for other endpoints,
+// because there is no model that every OpenAI-compatible server or Azure resource provides.
+func (c *chatGPT) healthCheckOption(ctx context.Context) (ability.LLMOption, error) {
+	o := ability.DefaultChatGPTOption()
+	if c.endpoint == "" && !c.isAzure() {
+		return ability.LLMOption{ChatGPT: o}, nil
+	}
+	models, err := c.getModels(ctx)
+	if err != nil {
+		return ability.LLMOption{}, err
+	}
+	if len(models) == 0 {
+		return ability.LLMOption{}, errors.New("found no model")
+	}
+	o.Model = models[0].Name
+	if c.isAzure() {
+		return ability.LLMOption{AzureChatGPT: o}, nil
+	}
+	return ability.LLMOption{OpenAICompatible: &ability.OpenAICompatibleOption{Endpoint: c.endpoint, ChatGPTOption: *o}}, nil
 }
 
 func (c *chatGPT) getModels(ctx context.Context) ([]ability.Model, error) {
 	c.logger.Info("get models...")
+	if c.isAzure() {
+		// ListModels of Azure returns base models, which can't be used without a deployment
+		return azureDeploymentModels(c.deployments), nil
+	}
 	ml, err := c.client.ListModels(ctx)
 	if err != nil {
 		return nil, err
 	}
 	models := make([]string, 0, len(ml.Models))
 	for i := 0; i < len(ml.Models); i++ {
-		if strings.Contains(ml.Models[i].ID, "gpt") {
+		if c.keepModel(ml.Models[i].ID) {
 			models = append(models, ml.Models[i].ID)
 		}
 	}
@@ -168,6 +276,18 @@ func (c *chatGPT) getModels(ctx context.Context) ([]ability.Model, error) {
 	return ms, err
 }
 
+func (c *chatGPT) keepModel(id string) bool {
+	if len(c.models) == 0 {
+		return true
+	}
+	for _, m := range c.models {
+		if strings.Contains(id, m) {
+			return true
+		}
+	}
+	return false
+}
+
 func messageOfComplete(ms []client.Message) []openai.ChatCompletionMessage {
 	messages := make([]openai.ChatCompletionMessage, len(ms), len(ms))
 	for i, m := range ms {
@@ -45,7 +45,8 @@ func NewChatGPTDemo(pool *demo.ResourcePool, logger *zap.Logger) client.LLM {
 	}
 }
 
-func (c *chatGPTDemo) CheckHealth(_ context.Context) {
+func (c *chatGPTDemo) CheckHealth(_ context.Context) client.Health {
+	return client.Healthy()
 }
 
 func (c *chatGPTDemo) Completion(_ context.Context, _ []client.Message, t ability.LLMOption) (string, error) {
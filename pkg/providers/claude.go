@@ -0,0 +1,208 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/anthropics/anthropic-sdk-go/option"
+	"github.com/proxoar/talk/pkg/ability"
+	"github.com/proxoar/talk/pkg/client"
+	"github.com/proxoar/talk/pkg/util"
+	"go.uber.org/zap"
+)
+
+type claude struct {
+	client anthropic.Client
+	logger *zap.Logger
+}
+
+func NewClaude(apiKey string, logger *zap.Logger) client.LLM {
+	// by default, the underlying http.client utilizes the proxy from the environment.
+	c := anthropic.NewClient(option.WithAPIKey(apiKey))
+
+	return &claude{
+		client: c,
+		logger: logger,
+	}
+}
+
+func (c *claude) CheckHealth(ctx context.Context) client.Health {
+	m := client.Message{
+		Role:    client.RoleUser,
+		Content: "Hello!",
+	}
+	o := ability.DefaultClaudeOption()
+	o.MaxTokens = 10
+	content, err := c.Completion(ctx, []client.Message{m}, ability.LLMOption{Claude: o})
+	if err != nil {
+		return client.Unhealthy("failed to get response from server: %v", err)
+	} else if len(content) == 0 {
+		return client.Degraded("got empty content from server")
+	}
+	return client.Healthy()
+}
+
+func (c *claude) Quota(_ context.Context) (used, total int, err error) {
+	// anthropic.client doesn't support billing query
+	return 0, 0, nil
+}
+
+func (c *claude) Completion(ctx context.Context, ms []client.Message, t ability.LLMOption) (string, error) {
+	c.logger.Sugar().Debugw("completion...", "message list length", len(ms))
+	if t.Claude == nil {
+		return "", errors.New("client did not provide Claude option")
+	}
+
+	resp, err := c.client.Messages.New(ctx, messageParamsOfClaude(ms, *t.Claude, c.logger))
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	for _, block := range resp.Content {
+		if block.Type == "text" {
+			b.WriteString(block.Text)
+		}
+	}
+	content := b.String()
+	c.logger.Sugar().Debug("completion resp content length:", len(content))
+	return content, nil
+}
+
+// CompletionStream
+//
+// Return only one chunk that contains the whole content if stream is not supported.
+func (c *claude) CompletionStream(ctx context.Context, ms []client.Message, t ability.LLMOption) *util.SmoothStream {
+	c.logger.Sugar().Debugw("completion stream...", "message list length", len(ms))
+	stream := util.NewSmoothStream()
+	if t.Claude == nil {
+		stream.WriteError(errors.New("client did not provide Claude option"))
+		return stream
+	}
+
+	req := messageParamsOfClaude(ms, *t.Claude, c.logger)
+
+	go func() {
+		s := c.client.Messages.NewStreaming(ctx, req)
+		defer func() { _ = s.Close() }()
+		for s.Next() {
+			event := s.Current()
+			if event.Type != "content_block_delta" {
+				continue
+			}
+			delta := event.AsContentBlockDelta().Delta
+			if delta.Type != "text_delta" {
+				continue
+			}
+			for _, r := range delta.Text {
+				stream.Write(r)
+			}
+		}
+		if err := s.Err(); err != nil {
+			stream.WriteError(err)
+			return
+		}
+		stream.WriteError(io.EOF)
+	}()
+	return stream
+}
+
+// SetAbility set `ClaudeAblt` and `available` field of ability.LLMAblt
+func (c *claude) SetAbility(ctx context.Context, a *ability.LLMAblt) error {
+	models, err := c.getModels(ctx)
+	if err != nil {
+		return err
+	}
+	a.Claude = ability.ClaudeAblt{
+		Available: true,
+		Models:    models,
+	}
+	a.Available = true
+	return nil
+}
+
+// Support
+//
+// read ability.LLMOption to check if current provider support the option
+func (c *claude) Support(o ability.LLMOption) bool {
+	return o.Claude != nil
+}
+
+func (c *claude) getModels(ctx context.Context) ([]ability.Model, error) {
+	c.logger.Info("get models...")
+	iter := c.client.Models.ListAutoPaging(ctx, anthropic.ModelListParams{})
+	var models []ability.Model
+	for iter.Next() {
+		m := iter.Current()
+		models = append(models, ability.Model{Name: m.ID, DisplayName: m.DisplayName})
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	c.logger.Sugar().Debug("models count:", len(models))
+	return models, nil
+}
+
+// messageParamsOfClaude builds a request from messages and option.
+//
+// Claude accepts system prompts only as a top-level parameter, so system messages are lifted out of the
+// conversation instead of being dropped. Consecutive messages of the same role are merged.
+func messageParamsOfClaude(ms []client.Message, o ability.ClaudeOption, logger *zap.Logger) anthropic.MessageNewParams {
+	var system []anthropic.TextBlockParam
+	var messages []anthropic.MessageParam
+	var prev *client.Message
+
+	flush := func() {
+		if prev == nil {
+			return
+		}
+		block := anthropic.NewTextBlock(prev.Content)
+		if prev.Role == client.RoleAssistant {
+			messages = append(messages, anthropic.NewAssistantMessage(block))
+		} else {
+			messages = append(messages, anthropic.NewUserMessage(block))
+		}
+		prev = nil
+	}
+
+	for _, m := range ms {
+		switch m.Role {
+		case client.RoleSystem:
+			if m.Content != "" {
+				system = append(system, anthropic.TextBlockParam{Text: m.Content})
+			}
+		case client.RoleUser, client.RoleAssistant:
+			if prev != nil && prev.Role == m.Role {
+				prev = &client.Message{Role: m.Role, Content: prev.Content + "\n" + m.Content}
+				continue
+			}
+			flush()
+			prev = &client.Message{Role: m.Role, Content: m.Content}
+		default:
+			logger.Sugar().Warn("ignore message with role==", m.Role)
+		}
+	}
+	flush()
+
+	req := anthropic.MessageNewParams{
+		Model:         anthropic.Model(o.Model),
+		MaxTokens:     int64(o.MaxTokens),
+		Messages:      messages,
+		System:        system,
+		StopSequences: o.StopSequences,
+	}
+	// recent models reject requests that set both temperature and top_p, so top_p replaces temperature
+	// only when it narrows sampling
+	if o.TopP > 0 && o.TopP < 1 {
+		req.TopP = anthropic.Float(float64(o.TopP))
+	} else {
+		req.Temperature = anthropic.Float(float64(o.Temperature))
+	}
+	if o.TopK > 0 {
+		req.TopK = anthropic.Int(int64(o.TopK))
+	}
+	return req
+}
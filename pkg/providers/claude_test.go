@@ -0,0 +1,32 @@
+package providers
+
+import (
+	"testing"
+
+	"github.com/proxoar/talk/pkg/ability"
+	"go.uber.org/zap"
+)
+
+func TestMessageParamsOfClaudeSampling(t *testing.T) {
+	tests := []struct {
+		name            string
+		temperature     float32
+		topP            float32
+		wantTemperature bool
+		wantTopP        bool
+	}{
+		{name: "temperature only", temperature: 0.7, topP: 0, wantTemperature: true},
+		{name: "top_p of 1 doesn't narrow", temperature: 0.7, topP: 1, wantTemperature: true},
+		{name: "top_p replaces temperature", temperature: 0.7, topP: 0.9, wantTopP: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := ability.ClaudeOption{Model: "claude-sonnet-4-5", MaxTokens: 100, Temperature: tt.temperature, TopP: tt.topP}
+			req := messageParamsOfClaude(nil, o, zap.NewNop())
+			if req.Temperature.Valid() != tt.wantTemperature || req.TopP.Valid() != tt.wantTopP {
+				t.Errorf("temperature set = %v, top_p set = %v, want %v, %v",
+					req.Temperature.Valid(), req.TopP.Valid(), tt.wantTemperature, tt.wantTopP)
+			}
+		})
+	}
+}
@@ -15,41 +15,48 @@ import (
 
 const (
 	defaultModelID = "eleven_multilingual_v1" // newer than "eleven_monolingual_v1"
+	// elevenlabs.client requires a timeout for each request, which is only a ceiling
+	// since requests are bound to the context of callers
+	elevenlabsReqTimeout = 10 * time.Minute
 )
 
 type elevenLabs struct {
-	client *elevenlabs.Client
+	apiKey string
 	logger *zap.Logger
 }
 
 func NewElevenLabs(apiKey string, logger *zap.Logger) client.TextToSpeech {
-	// elevenlabs.client create a new http.client everytime it makes a request
-	// by default, the underlying http.client utilizes the proxy from the environment.
-	c := elevenlabs.NewClient(context.Background(), apiKey, time.Minute)
-
 	return &elevenLabs{
-		client: c,
+		apiKey: apiKey,
 		logger: logger,
 	}
 }
 
-func (e *elevenLabs) CheckHealth(_ context.Context) {
-	used, total, err := e.Quota(context.Background())
+// client returns a client bound to ctx, as elevenlabs.client uses the context passed to elevenlabs.NewClient
+// for all requests
+func (e *elevenLabs) client(ctx context.Context) *elevenlabs.Client {
+	// elevenlabs.client create a new http.client everytime it makes a request
+	// by default, the underlying http.client utilizes the proxy from the environment.
+	return elevenlabs.NewClient(ctx, e.apiKey, elevenlabsReqTimeout)
+}
+
+func (e *elevenLabs) CheckHealth(ctx context.Context) client.Health {
+	used, total, err := e.Quota(ctx)
 	if err != nil {
-		e.logger.Sugar().Error("[ElevenLabs] failed to get response from ElevenLabs server: %+v", err)
-	} else {
-		e.logger.Sugar().Debugf("[ElevenLabs] quota: %d/%d used", used, total)
-		if total == 0 || used >= total {
-			e.logger.Warn(`[ElevenLabs] bad smell: ElevenLabs quota may has been exhausted`)
-		} else {
-			e.logger.Info("[ElevenLabs] is healthy")
-		}
+		return client.Unhealthy("failed to get response from server: %v", err)
+	}
+	e.logger.Sugar().Debugf("[ElevenLabs] quota: %d/%d used", used, total)
+	h := client.Healthy()
+	if total == 0 || used >= total {
+		h = client.Degraded("quota may have been exhausted")
 	}
+	h.QuotaUsed, h.QuotaTotal = used, total
+	return h
 }
 
-func (e *elevenLabs) Quota(_ context.Context) (used, total int, err error) {
+func (e *elevenLabs) Quota(ctx context.Context) (used, total int, err error) {
 	e.logger.Info("get subscription...")
-	subscription, err := e.client.GetSubscription()
+	subscription, err := e.client(ctx).GetSubscription()
 	if err != nil {
 		return 0, 0, err
 	}
@@ -57,9 +64,9 @@ func (e *elevenLabs) Quota(_ context.Context) (used, total int, err error) {
 	return subscription.CharacterCount, subscription.CharacterLimit, nil
 }
 
-func (e *elevenLabs) Voices(_ context.Context) ([]ability.TaggedItem, error) {
+func (e *elevenLabs) Voices(ctx context.Context) ([]ability.TaggedItem, error) {
 	e.logger.Info("get voices...")
-	voices, err := e.client.GetVoices()
+	voices, err := e.client(ctx).GetVoices()
 	if err != nil {
 		return nil, err
 	}
@@ -83,11 +90,11 @@ func (e *elevenLabs) TextToSpeech(ctx context.Context, text string, _ string, o
 	}
 	id, err := e.chooseVoiceId(ctx, o.Elevenlabs.VoiceId)
 	if err != nil {
-		return nil, fmt.Errorf("failed to choose a VoiceId %s: %v", o.Elevenlabs.VoiceId, err)
+		return nil, fmt.Errorf("failed to choose a VoiceId %s: %w", o.Elevenlabs.VoiceId, err)
 	}
-	bytes, err := e.client.TextToSpeech(id, req)
+	bytes, err := e.client(ctx).TextToSpeech(id, req)
 	if err != nil {
-		return nil, fmt.Errorf("TextToSpeech %s %v", id, err)
+		return nil, fmt.Errorf("TextToSpeech %s %w", id, err)
 	}
 	e.logger.Sugar().Debug("text to speech result, audio bytes size:", humanize.Bytes(uint64(len(bytes))))
 	return bytes, nil
@@ -48,7 +48,8 @@ func NewElevenlabsDemo(pool *demo.ResourcePool, logger *zap.Logger) client.TextT
 	}
 }
 
-func (e *elevenLabsDemo) CheckHealth(_ context.Context) {
+func (e *elevenLabsDemo) CheckHealth(_ context.Context) client.Health {
+	return client.Healthy()
 }
 
 func (e *elevenLabsDemo) Quota(_ context.Context) (used, total int, err error) {
@@ -0,0 +1,210 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/haguro/elevenlabs-go"
+	"github.com/sashabaranov/go-openai"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// HTTPStatusError is returned by providers that talk to servers with plain net/http
+type HTTPStatusError struct {
+	StatusCode int
+	Status     string
+	Header     http.Header
+	Body       string
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("server responded with %s: %s", e.Status, e.Body)
+}
+
+// ElevenLabs reports these as detail.status, without an HTTP status code
+var retryableElevenlabsStatuses = map[string]struct{}{
+	"too_many_concurrent_requests": {},
+	"system_busy":                  {},
+}
+
+// elevenlabsQuotaExceeded is reported once the characters of the month run out, which retrying doesn't help
+const elevenlabsQuotaExceeded = "quota_exceeded"
+
+// IsRetryable reports whether err is transient, such as 429, 5xx, timeouts and refused connections,
+// so that the same request may succeed later or on another provider.
+//
+// Cancellation by client is never retryable.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	if code := StatusCode(err); code != 0 {
+		return code == http.StatusTooManyRequests || code == http.StatusRequestTimeout || code >= http.StatusInternalServerError
+	}
+	var elevenlabsErr *elevenlabs.APIError
+	if errors.As(err, &elevenlabsErr) {
+		_, ok := retryableElevenlabsStatuses[elevenlabsErr.Detail.Status]
+		return ok
+	}
+	if s, ok := status.FromError(err); ok {
+		switch s.Code() {
+		case codes.ResourceExhausted, codes.Unavailable, codes.DeadlineExceeded, codes.Internal, codes.Aborted:
+			return true
+		}
+	}
+	return false
+}
+
+// ShouldFallback reports whether another provider may serve the request that failed with err, which is the case
+// for retryable errors and for an exhausted quota of the provider.
+func ShouldFallback(err error) bool {
+	if IsRetryable(err) {
+		return true
+	}
+	var elevenlabsErr *elevenlabs.APIError
+	return errors.As(err, &elevenlabsErr) && elevenlabsErr.Detail.Status == elevenlabsQuotaExceeded
+}
+
+// ErrorClass
+// classifies err for metrics: canceled, timeout, network, rate_limit, auth, client, server or unknown
+func ErrorClass(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET):
+		return "network"
+	}
+	// a status is checked first, since net/http wraps errors of a RoundTripper, such as the one of withRetryAfter,
+	// in *url.Error, which is a net.Error
+	if code := StatusCode(err); code != 0 {
+		switch {
+		case code == http.StatusTooManyRequests:
+			return "rate_limit"
+		case code == http.StatusUnauthorized || code == http.StatusForbidden:
+			return "auth"
+		case code == http.StatusRequestTimeout:
+			return "timeout"
+		case code >= http.StatusInternalServerError:
+			return "server"
+		case code >= http.StatusBadRequest:
+			return "client"
+		}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return "timeout"
+		}
+		return "network"
+	}
+	var elevenlabsErr *elevenlabs.APIError
+	if errors.As(err, &elevenlabsErr) {
+		if _, ok := retryableElevenlabsStatuses[elevenlabsErr.Detail.Status]; ok {
+			return "rate_limit"
+		}
+		if elevenlabsErr.Detail.Status == elevenlabsQuotaExceeded {
+			return "rate_limit"
+		}
+		return "client"
+	}
+	if s, ok := status.FromError(err); ok {
+		switch s.Code() {
+		case codes.ResourceExhausted:
+			return "rate_limit"
+		case codes.Unauthenticated, codes.PermissionDenied:
+			return "auth"
+		case codes.DeadlineExceeded:
+			return "timeout"
+		case codes.Unavailable, codes.Internal, codes.Aborted:
+			return "server"
+		case codes.InvalidArgument, codes.NotFound, codes.FailedPrecondition, codes.OutOfRange:
+			return "client"
+		}
+	}
+	return "unknown"
+}
+
+// StatusCode returns the HTTP status code carried by err, or 0 if there isn't one
+func StatusCode(err error) int {
+	var openaiAPIErr *openai.APIError
+	if errors.As(err, &openaiAPIErr) {
+		return openaiAPIErr.HTTPStatusCode
+	}
+	var openaiReqErr *openai.RequestError
+	if errors.As(err, &openaiReqErr) {
+		return openaiReqErr.HTTPStatusCode
+	}
+	var anthropicErr *anthropic.Error
+	if errors.As(err, &anthropicErr) {
+		return anthropicErr.StatusCode
+	}
+	var googleErr *googleapi.Error
+	if errors.As(err, &googleErr) {
+		return googleErr.Code
+	}
+	var httpErr *HTTPStatusError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode
+	}
+	return 0
+}
+
+// RetryAfter returns the delay asked by Retry-After header of the response carried by err
+func RetryAfter(err error) (time.Duration, bool) {
+	var header http.Header
+	var anthropicErr *anthropic.Error
+	var googleErr *googleapi.Error
+	var httpErr *HTTPStatusError
+	switch {
+	case errors.As(err, &anthropicErr) && anthropicErr.Response != nil:
+		header = anthropicErr.Response.Header
+	case errors.As(err, &googleErr):
+		header = googleErr.Header
+	case errors.As(err, &httpErr):
+		header = httpErr.Header
+	}
+	return parseRetryAfter(header.Get("Retry-After"), time.Now())
+}
+
+// parseRetryAfter parses either delay-seconds or an HTTP-date, see https://httpwg.org/specs/rfc9110.html#field.retry-after
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(v); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		d := t.Sub(now)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
@@ -0,0 +1,51 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/haguro/elevenlabs-go"
+)
+
+func TestShouldFallback(t *testing.T) {
+	elevenlabsErr := func(status string) error {
+		return &elevenlabs.APIError{Detail: elevenlabs.APIErrorDetail{Status: status}}
+	}
+	tests := []struct {
+		name         string
+		err          error
+		wantRetry    bool
+		wantFallback bool
+		wantClass    string
+	}{
+		{name: "nil", err: nil, wantClass: ""},
+		{name: "canceled", err: context.Canceled, wantClass: "canceled"},
+		{name: "too many requests", err: &HTTPStatusError{StatusCode: http.StatusTooManyRequests},
+			wantRetry: true, wantFallback: true, wantClass: "rate_limit"},
+		{name: "server error", err: fmt.Errorf("wrapped: %w", &HTTPStatusError{StatusCode: http.StatusBadGateway}),
+			wantRetry: true, wantFallback: true, wantClass: "server"},
+		{name: "bad request", err: &HTTPStatusError{StatusCode: http.StatusBadRequest}, wantClass: "client"},
+		{name: "elevenlabs busy", err: elevenlabsErr("system_busy"),
+			wantRetry: true, wantFallback: true, wantClass: "rate_limit"},
+		{name: "elevenlabs quota exceeded", err: elevenlabsErr("quota_exceeded"),
+			wantRetry: false, wantFallback: true, wantClass: "rate_limit"},
+		{name: "elevenlabs invalid voice", err: elevenlabsErr("voice_not_found"), wantClass: "client"},
+		{name: "unknown", err: errors.New("boom"), wantClass: "unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsRetryable(tt.err); got != tt.wantRetry {
+				t.Errorf("IsRetryable() = %v, want %v", got, tt.wantRetry)
+			}
+			if got := ShouldFallback(tt.err); got != tt.wantFallback {
+				t.Errorf("ShouldFallback() = %v, want %v", got, tt.wantFallback)
+			}
+			if got := ErrorClass(tt.err); got != tt.wantClass {
+				t.Errorf("ErrorClass() = %q, want %q", got, tt.wantClass)
+			}
+		})
+	}
+}
@@ -33,7 +33,7 @@ func NewGemini(apiKey string, logger *zap.Logger) client.LLM {
 	}
 }
 
-func (c *gemini) CheckHealth(ctx context.Context) {
+func (c *gemini) CheckHealth(ctx context.Context) client.Health {
 	m := client.Message{
 		Role:    client.RoleUser,
 		Content: "Hello!",
@@ -42,12 +42,11 @@ func (c *gemini) CheckHealth(ctx context.Context) {
 	o.MaxOutputTokens = 10
 	content, err := c.Completion(ctx, []client.Message{m}, ability.LLMOption{Gemini: o})
 	if err != nil {
-		c.logger.Sugar().Errorf("[Gemini] failed to get response from server: %v", err)
+		return client.Unhealthy("failed to get response from server: %v", err)
 	} else if len(content) == 0 {
-		c.logger.Warn(`[Gemini] bad smell: got empty content from GeminiAblt server`)
-	} else {
-		c.logger.Info("[Gemini]  is healthy")
+		return client.Degraded("got empty content from server")
 	}
+	return client.Healthy()
 }
 
 func (c *gemini) Quota(_ context.Context) (used, total int, err error) {
@@ -8,6 +8,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	resourcemanager "cloud.google.com/go/resourcemanager/apiv3"
 	"cloud.google.com/go/resourcemanager/apiv3/resourcemanagerpb"
@@ -19,6 +20,14 @@ import (
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 	"google.golang.org/genproto/googleapis/cloud/location"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+const (
+	// maximum size of audio in each StreamingRecognizeRequest
+	googleStreamingChunkSize = 15 * 1024
+	// how long the speech has ended before an utterance is regarded as finished
+	googleSpeechEndTimeout = time.Second
 )
 
 type googleSTT struct {
@@ -30,7 +39,7 @@ type googleSTT struct {
 	logger             *zap.Logger
 }
 
-func NewGoogleSTT(accountJson string, logger *zap.Logger) (client.SpeechToText, error) {
+func NewGoogleSTT(accountJson string, logger *zap.Logger) (client.StreamingSpeechToText, error) {
 	// by default, the underlying http.client utilizes the proxy from the environment.
 	speechClient, err := speech.NewClient(context.Background(), option.WithCredentialsJSON([]byte(accountJson)))
 	if err != nil {
@@ -49,15 +58,14 @@ func NewGoogleSTT(accountJson string, logger *zap.Logger) (client.SpeechToText,
 	}, nil
 }
 
-func (g *googleSTT) CheckHealth(ctx context.Context) {
+func (g *googleSTT) CheckHealth(ctx context.Context) client.Health {
 	projects, err := g.getProjects(ctx)
 	if err != nil {
-		g.logger.Sugar().Errorf("[Google speech-to-text] failed to get response from server: %+v", err)
+		return client.Unhealthy("failed to get response from server: %v", err)
 	} else if len(projects) == 0 {
-		g.logger.Sugar().Warn("[Google speech-to-text] bad smell: no projects are found")
-	} else {
-		g.logger.Info("[Google speech-to-text] is healthy")
+		return client.Degraded("no projects are found")
 	}
+	return client.Healthy()
 }
 
 func (g *googleSTT) SpeechToText(ctx context.Context, audio io.Reader, fileName string, option ability.STTOption) (string, error) {
@@ -109,6 +117,135 @@ func (g *googleSTT) SpeechToText(ctx context.Context, audio io.Reader, fileName
 	return text, nil
 }
 
+// StreamingSpeechToText
+//
+// The stream is closed by Google once the speech has ended for googleSpeechEndTimeout, so that the transcription
+// is returned without waiting for client to stop recording.
+func (g *googleSTT) StreamingSpeechToText(ctx context.Context, audio io.Reader, fileName string, option ability.STTOption,
+	onTranscript func(client.Transcript)) (string, error) {
+	g.logger.Sugar().Infow("streaming transcribe...", "fileName", fileName, "option", option)
+	if option.Google == nil {
+		return "", errors.New("client did not provide Google speech-to-text option")
+	}
+
+	rec := option.Google.Recognizer
+	if rec == "" {
+		//goland:noinspection GoErrorStringFormat
+		return "", errors.New("Recognizer mustn't be empty")
+	}
+	c, err := g.clientForRecognizer(rec)
+	if err != nil {
+		return "", err
+	}
+
+	// stop sending audio once the transcription is done
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := c.StreamingRecognize(ctx)
+	if err != nil {
+		return "", err
+	}
+	var lang []string
+	if option.Google.Language != "" {
+		lang = append(lang, option.Google.Language)
+	}
+	err = stream.Send(&speechpb.StreamingRecognizeRequest{
+		Recognizer: rec,
+		StreamingRequest: &speechpb.StreamingRecognizeRequest_StreamingConfig{
+			StreamingConfig: &speechpb.StreamingRecognitionConfig{
+				Config: &speechpb.RecognitionConfig{
+					DecodingConfig: &speechpb.RecognitionConfig_AutoDecodingConfig{
+						AutoDecodingConfig: &speechpb.AutoDetectDecodingConfig{},
+					},
+					Model:         option.Google.Model,
+					LanguageCodes: lang,
+					Features: &speechpb.RecognitionFeatures{
+						EnableAutomaticPunctuation: true,
+					},
+				},
+				StreamingFeatures: &speechpb.StreamingRecognitionFeatures{
+					InterimResults:            true,
+					EnableVoiceActivityEvents: true,
+					VoiceActivityTimeout: &speechpb.StreamingRecognitionFeatures_VoiceActivityTimeout{
+						SpeechEndTimeout: durationpb.New(googleSpeechEndTimeout),
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	sent := make(chan struct{})
+	// audio is left to the caller once it returns, see client.StreamingSpeechToText
+	defer func() {
+		cancel()
+		<-sent
+	}()
+	go func() {
+		defer close(sent)
+		defer func() { _ = stream.CloseSend() }()
+		buf := make([]byte, googleStreamingChunkSize)
+		for {
+			n, err := client.ReadContext(ctx, audio, buf)
+			if n > 0 {
+				chunk := make([]byte, n)
+				copy(chunk, buf[:n])
+				sendErr := stream.Send(&speechpb.StreamingRecognizeRequest{
+					StreamingRequest: &speechpb.StreamingRecognizeRequest_Audio{Audio: chunk},
+				})
+				if sendErr != nil {
+					// the reason is returned by stream.Recv
+					return
+				}
+			}
+			if err != nil {
+				if !errors.Is(err, io.EOF) && ctx.Err() == nil {
+					g.logger.Sugar().Warn("[Google speech-to-text] failed to read audio: ", err)
+				}
+				return
+			}
+		}
+	}()
+
+	var final strings.Builder
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if len(resp.Results) == 0 {
+			continue
+		}
+		interim := ""
+		for _, r := range resp.Results {
+			if len(r.Alternatives) == 0 {
+				continue
+			}
+			if r.IsFinal {
+				final.WriteString(r.Alternatives[0].Transcript)
+			} else {
+				interim += r.Alternatives[0].Transcript
+			}
+		}
+		if onTranscript != nil {
+			onTranscript(client.Transcript{Text: final.String() + interim, Final: interim == ""})
+		}
+	}
+
+	text := strings.TrimSpace(final.String())
+	g.logger.Sugar().Debug("streaming transcribe result text length:", len(text))
+	if len(text) == 0 {
+		return "", errors.New("google speech-to-text service did not provide any final results," +
+			" which typically occurs when the audio quality is poor or the chosen language doesn't match your voice")
+	}
+	return text, nil
+}
+
 // SetAbility set `GoogleSTTAb` and `available` field of ability.STTAblt
 func (g *googleSTT) SetAbility(ctx context.Context, a *ability.STTAblt) error {
 	errs, recs := g.getAllRecognizers(ctx)
@@ -30,7 +30,7 @@ func NewGoogleTTS(accountJson string, logger *zap.Logger) (client.TextToSpeech,
 	}, nil
 }
 
-func (g *googleTTS) CheckHealth(ctx context.Context) {
+func (g *googleTTS) CheckHealth(ctx context.Context) client.Health {
 	o := ability.TTSOption{
 		Google: &ability.GoogleTTSOption{
 			VoiceId:      "",
@@ -43,13 +43,11 @@ func (g *googleTTS) CheckHealth(ctx context.Context) {
 	}
 	audio, err := g.TextToSpeech(ctx, "Hello!", "Hello!", o)
 	if err != nil {
-		g.logger.Sugar().Errorf("[Google text-to-speech] failed to get response from server: %+v", err)
+		return client.Unhealthy("failed to get response from server: %v", err)
 	} else if len(audio) < 100 || len(audio) > 10000 {
-		g.logger.Sugar().Warn("[Google text-to-speech] bad smell: the audio data received from Google text-to-speech server is"+
-			" either too small or too large: %d byte", len(audio))
-	} else {
-		g.logger.Info("[Google text-to-speech]  is healthy")
+		return client.Degraded("the audio data received from server is either too small or too large: %d byte", len(audio))
 	}
+	return client.Healthy()
 }
 
 func (g *googleTTS) Quota(_ context.Context) (used, total int, err error) {
@@ -102,7 +100,7 @@ func (g *googleTTS) TextToSpeech(ctx context.Context, text string, _ string, o a
 
 	resp, err := g.client.SynthesizeSpeech(ctx, &req)
 	if err != nil {
-		return nil, fmt.Errorf("SynthesizeSpeech: %v", err)
+		return nil, fmt.Errorf("SynthesizeSpeech: %w", err)
 	}
 	g.logger.Sugar().Info("text to speech result audio bytes size: ", humanize.Bytes(uint64(len(resp.AudioContent))))
 	return resp.AudioContent, nil
@@ -0,0 +1,149 @@
+package providers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	resource "github.com/proxoar/talk"
+	"github.com/proxoar/talk/pkg/ability"
+	"github.com/proxoar/talk/pkg/client"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.uber.org/zap"
+)
+
+// localWhisper talks to a locally hosted whisper-compatible server, such as whisper.cpp server
+// (http://127.0.0.1:8080/inference) or faster-whisper's OpenAI-compatible endpoint (http://127.0.0.1:8000/v1/audio/transcriptions).
+// Both of them accept a multipart form with a `file` field, and respond with {"text": "..."}
+type localWhisper struct {
+	url    string
+	models []string
+	client *http.Client
+	logger *zap.Logger
+}
+
+// plainTransport is http.DefaultTransport before it's wrapped, e.g. for tracing
+var plainTransport = http.DefaultTransport.(*http.Transport)
+
+func NewLocalWhisper(url string, models []string, logger *zap.Logger) client.SpeechToText {
+	// the server is hosted locally, so bypass the proxy from the environment
+	transport := plainTransport.Clone()
+	transport.Proxy = nil
+
+	return &localWhisper{
+		url:    url,
+		models: models,
+		client: &http.Client{Transport: otelhttp.NewTransport(transport)},
+		logger: logger,
+	}
+}
+
+func (w *localWhisper) CheckHealth(ctx context.Context) client.Health {
+	voice, fileName, err := resource.HelloVoice()
+	if err != nil {
+		return client.Unhealthy("failed to read hello voice: %v", err)
+	}
+	o := ability.STTOption{
+		LocalWhisper: &ability.WhisperOption{},
+	}
+	if len(w.models) > 0 {
+		o.LocalWhisper.Model = w.models[0]
+	}
+	trans, err := w.SpeechToText(ctx, voice, fileName, o)
+	if err != nil {
+		return client.Unhealthy("failed to get response from server: %v", err)
+	} else if !strings.Contains(strings.ToLower(trans), "hello") {
+		return client.Degraded(`transcription from server does not contain "hello"`)
+	}
+	return client.Healthy()
+}
+
+func (w *localWhisper) SpeechToText(ctx context.Context, audio io.Reader, fileName string, option ability.STTOption) (string, error) {
+	w.logger.Sugar().Debugw("transcribe...", "fileName", fileName, "option", option)
+	if option.LocalWhisper == nil {
+		return "", errors.New("client did not provide local Whisper option")
+	}
+
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	part, err := form.CreateFormFile("file", fileName)
+	if err != nil {
+		return "", err
+	}
+	if _, err = io.Copy(part, audio); err != nil {
+		return "", err
+	}
+	// whisper.cpp ignores model, while faster-whisper requires it
+	if option.LocalWhisper.Model != "" {
+		if err = form.WriteField("model", option.LocalWhisper.Model); err != nil {
+			return "", err
+		}
+	}
+	if err = form.WriteField("response_format", "json"); err != nil {
+		return "", err
+	}
+	if err = form.Close(); err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", &HTTPStatusError{StatusCode: resp.StatusCode, Status: resp.Status, Header: resp.Header, Body: string(data)}
+	}
+	var transcription struct {
+		Text string `json:"text"`
+	}
+	if err = json.Unmarshal(data, &transcription); err != nil {
+		return "", fmt.Errorf("failed to parse response of local Whisper server: %v", err)
+	}
+
+	text := strings.TrimSpace(transcription.Text)
+	w.logger.Sugar().Debug("transcribe result text length:", len(text))
+	if len(text) == 0 {
+		return "", errors.New("content of transcription is empty")
+	}
+	return text, nil
+}
+
+// SetAbility set `LocalWhisper` and `available` field of ability.STTAblt
+//
+// whisper-compatible servers don't share a way to list models, so configured models are used
+func (w *localWhisper) SetAbility(_ context.Context, a *ability.STTAblt) error {
+	models := w.models
+	if models == nil {
+		models = []string{}
+	}
+	a.LocalWhisper = ability.WhisperSTTAb{
+		Available: true,
+		Models:    models,
+	}
+	a.Available = true
+	return nil
+}
+
+// Support
+//
+// read ability.STTOption to check if current provider support the option
+func (w *localWhisper) Support(o ability.STTOption) bool {
+	return o.LocalWhisper != nil
+}
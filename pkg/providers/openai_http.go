@@ -0,0 +1,40 @@
+package providers
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// maxErrorBodySize limits the body of an error response kept in HTTPStatusError
+const maxErrorBodySize = 4 << 10
+
+// withRetryAfter makes the client return HTTPStatusError for a 429 or 503 response with Retry-After, so that
+// RetryAfter finds the header. openai.APIError leaves out headers of the response.
+func withRetryAfter(conf openai.ClientConfig) openai.ClientConfig {
+	conf.HTTPClient = &http.Client{Transport: retryAfterTransport{}}
+	return conf
+}
+
+type retryAfterTransport struct{}
+
+func (retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// http.DefaultTransport is looked up for each request, since tracing replaces it at startup
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable ||
+		resp.Header.Get("Retry-After") == "" {
+		return resp, nil
+	}
+	defer func() { _ = resp.Body.Close() }()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+	return nil, &HTTPStatusError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Header:     resp.Header,
+		Body:       string(body),
+	}
+}
@@ -0,0 +1,61 @@
+package providers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestWithRetryAfter(t *testing.T) {
+	tests := []struct {
+		name           string
+		status         int
+		retryAfter     string
+		wantStatus     int
+		wantClass      string
+		wantRetryAfter time.Duration
+		wantOk         bool
+	}{
+		{name: "rate limited", status: http.StatusTooManyRequests, retryAfter: "7", wantStatus: 429, wantClass: "rate_limit",
+			wantRetryAfter: 7 * time.Second, wantOk: true},
+		{name: "unavailable", status: http.StatusServiceUnavailable, retryAfter: "3", wantStatus: 503, wantClass: "server",
+			wantRetryAfter: 3 * time.Second, wantOk: true},
+		{name: "rate limited without Retry-After", status: http.StatusTooManyRequests, wantStatus: 429, wantClass: "rate_limit"},
+		{name: "other status", status: http.StatusBadRequest, retryAfter: "7", wantStatus: 400, wantClass: "client"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.retryAfter != "" {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(`{"error":{"message":"slow down","type":"requests"}}`))
+			}))
+			defer srv.Close()
+
+			conf := openai.DefaultConfig("key")
+			conf.BaseURL = srv.URL
+			c := openai.NewClientWithConfig(withRetryAfter(conf))
+			_, err := c.CreateChatCompletion(context.Background(), openai.ChatCompletionRequest{Model: "gpt-4o"})
+			if err == nil {
+				t.Fatal("CreateChatCompletion() succeeded, want error")
+			}
+			if got := StatusCode(err); got != tt.wantStatus {
+				t.Errorf("StatusCode() = %d, want %d", got, tt.wantStatus)
+			}
+			if got := ErrorClass(err); got != tt.wantClass {
+				t.Errorf("ErrorClass() = %q, want %q", got, tt.wantClass)
+			}
+			d, ok := RetryAfter(err)
+			if d != tt.wantRetryAfter || ok != tt.wantOk {
+				t.Errorf("RetryAfter() = %v, %v, want %v, %v", d, ok, tt.wantRetryAfter, tt.wantOk)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/dustin/go-humanize"
+	"github.com/proxoar/talk/pkg/ability"
+	"github.com/proxoar/talk/pkg/client"
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+)
+
+// see https://platform.openai.com/docs/guides/text-to-speech/voice-options
+var openAITTSVoices = []ability.TaggedItem{
+	{Id: "alloy", Name: "Alloy", Tags: []string{}},
+	{Id: "ash", Name: "Ash", Tags: []string{}},
+	{Id: "coral", Name: "Coral", Tags: []string{}},
+	{Id: "echo", Name: "Echo", Tags: []string{}},
+	{Id: "fable", Name: "Fable", Tags: []string{}},
+	{Id: "onyx", Name: "Onyx", Tags: []string{}},
+	{Id: "nova", Name: "Nova", Tags: []string{}},
+	{Id: "sage", Name: "Sage", Tags: []string{}},
+	{Id: "shimmer", Name: "Shimmer", Tags: []string{}},
+}
+
+var openAITTSModels = []string{string(openai.TTSModel1), string(openai.TTSModel1HD)}
+
+var openAITTSFormats = []string{
+	string(openai.SpeechResponseFormatMp3),
+	string(openai.SpeechResponseFormatOpus),
+	string(openai.SpeechResponseFormatAac),
+	string(openai.SpeechResponseFormatFlac),
+	string(openai.SpeechResponseFormatWav),
+}
+
+type openAITTS struct {
+	client *openai.Client
+	logger *zap.Logger
+}
+
+func NewOpenAITTS(apiKey string, logger *zap.Logger) client.TextToSpeech {
+	// by default, the underlying http.client utilizes the proxy from the environment.
+	c := openai.NewClientWithConfig(withRetryAfter(openai.DefaultConfig(apiKey)))
+
+	return &openAITTS{
+		client: c,
+		logger: logger,
+	}
+}
+
+func (o *openAITTS) CheckHealth(ctx context.Context) client.Health {
+	op := ability.TTSOption{OpenAI: ability.DefaultOpenAITTSOption()}
+	audio, err := o.TextToSpeech(ctx, "Hello!", "Hello!", op)
+	if err != nil {
+		return client.Unhealthy("failed to get response from server: %v", err)
+	} else if len(audio) < 100 || len(audio) > 100000 {
+		return client.Degraded("the audio data received from server is either too small or too large: %d byte", len(audio))
+	}
+	return client.Healthy()
+}
+
+func (o *openAITTS) Quota(_ context.Context) (used, total int, err error) {
+	// openai.client doesn't support billing query
+	return 0, 0, nil
+}
+
+func (o *openAITTS) TextToSpeech(ctx context.Context, text string, _ string, t ability.TTSOption) ([]byte, error) {
+	o.logger.Sugar().Debugw("text to speech...", "option", t)
+	if t.OpenAI == nil {
+		return nil, errors.New("client did not provide OpenAI text-to-speech option")
+	}
+	req := openai.CreateSpeechRequest{
+		Model:          openai.SpeechModel(t.OpenAI.Model),
+		Input:          text,
+		Voice:          openai.SpeechVoice(t.OpenAI.Voice),
+		ResponseFormat: openai.SpeechResponseFormat(t.OpenAI.ResponseFormat),
+		Speed:          t.OpenAI.Speed,
+	}
+	resp, err := o.client.CreateSpeech(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("CreateSpeech: %w", err)
+	}
+	defer func() { _ = resp.Close() }()
+	audio, err := io.ReadAll(resp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audio: %v", err)
+	}
+	o.logger.Sugar().Debug("text to speech result, audio bytes size:", humanize.Bytes(uint64(len(audio))))
+	return audio, nil
+}
+
+// SetAbility set `OpenAI` and `available` field of ability.TTSAblt
+//
+// OpenAI doesn't provide an API to list voices, so a fixed list is used
+func (o *openAITTS) SetAbility(_ context.Context, a *ability.TTSAblt) error {
+	a.OpenAI = ability.OpenAITTSAblt{
+		Available: true,
+		Voices:    openAITTSVoices,
+		Models:    openAITTSModels,
+		Formats:   openAITTSFormats,
+	}
+	a.Available = true
+	return nil
+}
+
+// Support
+//
+// read ability.TTSOption to check if current provider support the option
+func (o *openAITTS) Support(t ability.TTSOption) bool {
+	return t.OpenAI != nil
+}
@@ -0,0 +1,204 @@
+package providers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+	"github.com/proxoar/talk/pkg/ability"
+	"github.com/proxoar/talk/pkg/client"
+	"go.uber.org/zap"
+)
+
+const piperModelExt = ".onnx"
+
+// piper runs a local neural TTS binary, such as https://github.com/rhasspy/piper, as a subprocess.
+//
+// Text is piped to stdin and WAV is read from stdout. Voices are *.onnx models in modelDir,
+// each of which may have a *.onnx.json config next to it.
+type piper struct {
+	binary   string
+	modelDir string
+	args     []string
+	logger   *zap.Logger
+}
+
+// piperVoiceConfig contains the fields we need from *.onnx.json
+type piperVoiceConfig struct {
+	Dataset  string `json:"dataset"`
+	Language struct {
+		Code string `json:"code"`
+	} `json:"language"`
+	Audio struct {
+		Quality string `json:"quality"`
+	} `json:"audio"`
+}
+
+// NewPiper
+//
+// args are appended to every invocation of binary, e.g. ["--cuda"]
+func NewPiper(binary, modelDir string, args []string, logger *zap.Logger) (client.TextToSpeech, error) {
+	path, err := exec.LookPath(binary)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find Piper binary %s: %v", binary, err)
+	}
+	info, err := os.Stat(modelDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Piper model directory %s: %v", modelDir, err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("Piper model directory %s is not a directory", modelDir)
+	}
+	return &piper{
+		binary:   path,
+		modelDir: modelDir,
+		args:     args,
+		logger:   logger,
+	}, nil
+}
+
+func (p *piper) CheckHealth(ctx context.Context) client.Health {
+	voices, err := p.Voices(ctx)
+	if err != nil {
+		return client.Unhealthy("failed to list voices: %v", err)
+	}
+	if len(voices) == 0 {
+		return client.Degraded("found no voice in %s", p.modelDir)
+	}
+	o := ability.TTSOption{Piper: &ability.PiperTTSOption{VoiceId: voices[0].Id}}
+	audio, err := p.TextToSpeech(ctx, "Hello!", "Hello!", o)
+	if err != nil {
+		return client.Unhealthy("failed to synthesize speech: %v", err)
+	} else if len(audio) < 100 {
+		return client.Degraded("the audio data received from Piper is too small: %d byte", len(audio))
+	}
+	return client.Healthy()
+}
+
+// Voices lists *.onnx models in modelDir
+func (p *piper) Voices(_ context.Context) ([]ability.TaggedItem, error) {
+	p.logger.Info("get voices...")
+	entries, err := os.ReadDir(p.modelDir)
+	if err != nil {
+		return nil, err
+	}
+	var vs []ability.TaggedItem
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), piperModelExt) {
+			continue
+		}
+		vs = append(vs, p.voiceOfModel(e.Name()))
+	}
+	sort.Slice(vs, func(i, j int) bool { return vs[i].Id < vs[j].Id })
+	p.logger.Sugar().Debug("voices count:", len(vs))
+	return vs, nil
+}
+
+func (p *piper) TextToSpeech(ctx context.Context, text string, _ string, o ability.TTSOption) ([]byte, error) {
+	p.logger.Sugar().Debugw("text to speech...", "option", o)
+	if o.Piper == nil {
+		return nil, errors.New("client did not provide Piper option")
+	}
+	model, err := p.modelPath(ctx, o.Piper.VoiceId)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"--model", model, "--output_file", "-"}
+	if o.Piper.LengthScale > 0 {
+		args = append(args, "--length_scale", strconv.FormatFloat(float64(o.Piper.LengthScale), 'f', -1, 32))
+	}
+	args = append(args, p.args...)
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, p.binary, args...)
+	cmd.Stdin = strings.NewReader(text)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err = cmd.Run(); err != nil {
+		return nil, fmt.Errorf("Piper exited with %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	audio := stdout.Bytes()
+	if len(audio) == 0 {
+		return nil, fmt.Errorf("Piper produced no audio: %s", strings.TrimSpace(stderr.String()))
+	}
+	p.logger.Sugar().Debug("text to speech result, audio bytes size:", humanize.Bytes(uint64(len(audio))))
+	return audio, nil
+}
+
+func (p *piper) SetAbility(ctx context.Context, a *ability.TTSAblt) error {
+	voices, err := p.Voices(ctx)
+	if err != nil {
+		return err
+	}
+	a.Piper = ability.PiperTTSAblt{
+		Available: true,
+		Voices:    voices,
+	}
+	a.Available = true
+	return nil
+}
+
+// Support
+//
+// read ability.TTSOption to check if current provider support the option
+func (p *piper) Support(o ability.TTSOption) bool {
+	return o.Piper != nil
+}
+
+// modelPath returns the path of model of voiceId, or the first model if voiceId is empty.
+// voiceId must be the name of a model in modelDir, which keeps clients from reading other files.
+func (p *piper) modelPath(ctx context.Context, voiceId string) (string, error) {
+	voices, err := p.Voices(ctx)
+	if err != nil {
+		return "", err
+	}
+	if len(voices) == 0 {
+		return "", fmt.Errorf("found no voice in %s", p.modelDir)
+	}
+	if voiceId == "" {
+		voiceId = voices[0].Id
+	}
+	for _, v := range voices {
+		if v.Id == voiceId {
+			return filepath.Join(p.modelDir, v.Id+piperModelExt), nil
+		}
+	}
+	return "", fmt.Errorf("voice %s is not found in %s", voiceId, p.modelDir)
+}
+
+// voiceOfModel reads tags from the *.onnx.json next to the model, and ignores any errors
+// since a model without config is still usable
+func (p *piper) voiceOfModel(fileName string) ability.TaggedItem {
+	id := strings.TrimSuffix(fileName, piperModelExt)
+	item := ability.TaggedItem{Id: id, Name: id, Tags: []string{}}
+
+	data, err := os.ReadFile(filepath.Join(p.modelDir, fileName+".json"))
+	if err != nil {
+		return item
+	}
+	var conf piperVoiceConfig
+	if err = json.Unmarshal(data, &conf); err != nil {
+		p.logger.Sugar().Warnf("[Piper] failed to parse config of %s: %v", fileName, err)
+		return item
+	}
+	if conf.Language.Code != "" {
+		item.Tags = append(item.Tags, "language="+conf.Language.Code)
+	}
+	if conf.Dataset != "" {
+		item.Tags = append(item.Tags, "dataset="+conf.Dataset)
+	}
+	if conf.Audio.Quality != "" {
+		item.Tags = append(item.Tags, "quality="+conf.Audio.Quality)
+	}
+	return item
+}
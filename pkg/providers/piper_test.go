@@ -0,0 +1,35 @@
+package providers
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestPiperVoiceOfModel(t *testing.T) {
+	dir := t.TempDir()
+	conf := `{"dataset":"lessac","language":{"code":"en_US"},"audio":{"quality":"medium"}}`
+	if err := os.WriteFile(filepath.Join(dir, "en_US-lessac-medium.onnx.json"), []byte(conf), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	p := &piper{modelDir: dir, logger: zap.NewNop()}
+
+	tests := []struct {
+		name     string
+		fileName string
+		wantTags []string
+	}{
+		{name: "with config", fileName: "en_US-lessac-medium.onnx", wantTags: []string{"language=en_US", "dataset=lessac", "quality=medium"}},
+		{name: "without config", fileName: "de_DE-thorsten-low.onnx", wantTags: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := p.voiceOfModel(tt.fileName); !slices.Equal(got.Tags, tt.wantTags) {
+				t.Errorf("voiceOfModel() tags = %v, want %v", got.Tags, tt.wantTags)
+			}
+		})
+	}
+}
@@ -0,0 +1,315 @@
+package providers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/proxoar/talk/pkg/ability"
+	"github.com/proxoar/talk/pkg/client"
+	"github.com/proxoar/talk/pkg/util"
+	"go.uber.org/zap"
+)
+
+const (
+	// how long a credential is skipped after 429, unless the server asks with Retry-After
+	rateLimitCooldown = time.Minute
+	// how long a credential is skipped after 401 or 403, it's likely to be revoked or out of credit
+	authCooldown = 10 * time.Minute
+)
+
+// PoolMember is a client of a provider that uses one of its credentials
+type PoolMember[C client.Client] struct {
+	// Key is the key of the credential in config, which is shown instead of the secret
+	Key    string
+	Client C
+}
+
+// keyPool
+// spreads calls over the credentials of a provider in round-robin order.
+//
+// A credential that is throttled (429) or rejected (401/403) cools down for a while, during which it's skipped,
+// and the call is made again with the next credential. If all credentials are cooling down, the one throttled
+// the longest ago is used.
+type keyPool[C client.Client] struct {
+	name    string
+	mu      sync.Mutex
+	members []*poolMember[C]
+	next    int
+	logger  *zap.Logger
+}
+
+type poolMember[C client.Client] struct {
+	PoolMember[C]
+	throttledAt   time.Time
+	cooldownUntil time.Time
+}
+
+func newKeyPool[C client.Client](name string, members []PoolMember[C], logger *zap.Logger) *keyPool[C] {
+	p := &keyPool[C]{name: name, logger: logger}
+	for _, m := range members {
+		p.members = append(p.members, &poolMember[C]{PoolMember: m})
+	}
+	return p
+}
+
+// pick returns the next member that isn't cooling down, or the one throttled the longest ago if all are.
+// Members in tried are skipped.
+func (p *keyPool[C]) pick(tried map[*poolMember[C]]bool) *poolMember[C] {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	var oldest *poolMember[C]
+	for i := range p.members {
+		m := p.members[(p.next+i)%len(p.members)]
+		if tried[m] {
+			continue
+		}
+		if now.After(m.cooldownUntil) {
+			p.next = (p.next + i + 1) % len(p.members)
+			return m
+		}
+		if oldest == nil || m.throttledAt.Before(oldest.throttledAt) {
+			oldest = m
+		}
+	}
+	return oldest
+}
+
+// report puts m on cooldown if err means that its credential is throttled or rejected,
+// and returns whether another credential may succeed
+func (p *keyPool[C]) report(m *poolMember[C], err error) bool {
+	var d time.Duration
+	switch ErrorClass(err) {
+	case "rate_limit":
+		d = rateLimitCooldown
+		if ra, ok := RetryAfter(err); ok && ra > 0 {
+			d = ra
+		}
+	case "auth":
+		d = authCooldown
+	default:
+		return false
+	}
+	p.mu.Lock()
+	now := time.Now()
+	m.throttledAt = now
+	m.cooldownUntil = now.Add(d)
+	p.mu.Unlock()
+	p.logger.Sugar().Warnf("[%s] credential %s cools down for %s: %v", p.name, m.Key, d, err)
+	return true
+}
+
+// call calls f with one credential after another, until a credential isn't throttled or rejected
+func call[C client.Client, T any](ctx context.Context, p *keyPool[C], f func(c C) (T, error)) (T, error) {
+	tried := make(map[*poolMember[C]]bool, len(p.members))
+	for {
+		m := p.pick(tried)
+		tried[m] = true
+		v, err := f(m.Client)
+		if err == nil || ctx.Err() != nil || !p.report(m, err) || len(tried) == len(p.members) {
+			return v, err
+		}
+	}
+}
+
+// checkHealth checks each credential, the provider is degraded if any of them isn't healthy
+func (p *keyPool[C]) checkHealth(ctx context.Context) client.Health {
+	keys := make([]client.KeyHealth, len(p.members))
+	var wg sync.WaitGroup
+	for i, m := range p.members {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			keys[i] = client.KeyHealth{Key: m.Key, Health: client.CheckHealth(ctx, m.Client)}
+		}()
+	}
+	wg.Wait()
+
+	p.mu.Lock()
+	now := time.Now()
+	for i, m := range p.members {
+		if now.Before(m.cooldownUntil) {
+			until := m.cooldownUntil
+			keys[i].CooldownUntil = &until
+		}
+	}
+	p.mu.Unlock()
+
+	healthy := 0
+	var used, total int
+	for _, k := range keys {
+		if k.Status == client.StatusHealthy {
+			healthy++
+		}
+		used += k.QuotaUsed
+		total += k.QuotaTotal
+	}
+	var h client.Health
+	switch healthy {
+	case len(keys):
+		h = client.Healthy()
+	case 0:
+		h = client.Unhealthy("none of %d credentials is healthy", len(keys))
+	default:
+		h = client.Degraded("%d of %d credentials are healthy", healthy, len(keys))
+	}
+	h.QuotaUsed, h.QuotaTotal = used, total
+	h.Keys = keys
+	return h
+}
+
+type llmPool struct {
+	*keyPool[client.LLM]
+}
+
+// NewLLMPool spreads calls over members, each of which uses a credential of the same provider, see keyPool.
+// It returns the only member if there is one.
+func NewLLMPool(name string, members []PoolMember[client.LLM], logger *zap.Logger) client.LLM {
+	if len(members) == 1 {
+		return members[0].Client
+	}
+	return &llmPool{newKeyPool(name, members, logger)}
+}
+
+func (p *llmPool) Completion(ctx context.Context, ms []client.Message, t ability.LLMOption) (string, error) {
+	return call(ctx, p.keyPool, func(llm client.LLM) (string, error) {
+		return llm.Completion(ctx, ms, t)
+	})
+}
+
+// CompletionStream
+//
+// The next credential is used only if a stream fails before any content arrives.
+func (p *llmPool) CompletionStream(ctx context.Context, ms []client.Message, t ability.LLMOption) *util.SmoothStream {
+	stream := util.NewSmoothStream()
+	go func() {
+		tried := make(map[*poolMember[client.LLM]]bool, len(p.members))
+		for {
+			m := p.pick(tried)
+			tried[m] = true
+			inner := m.Client.CompletionStream(ctx, ms, t)
+			data, err := inner.RecvRaw()
+			if err != nil && !errors.Is(err, io.EOF) && ctx.Err() == nil && p.report(m, err) && len(tried) < len(p.members) {
+				continue
+			}
+			for err == nil {
+				stream.Write(data)
+				data, err = inner.RecvRaw()
+			}
+			stream.WriteError(err)
+			return
+		}
+	}()
+	return stream
+}
+
+func (p *llmPool) CheckHealth(ctx context.Context) client.Health {
+	return p.checkHealth(ctx)
+}
+
+func (p *llmPool) SetAbility(ctx context.Context, a *ability.LLMAblt) error {
+	_, err := call(ctx, p.keyPool, func(llm client.LLM) (struct{}, error) {
+		return struct{}{}, llm.SetAbility(ctx, a)
+	})
+	return err
+}
+
+func (p *llmPool) Support(o ability.LLMOption) bool {
+	return p.members[0].Client.Support(o)
+}
+
+type ttsPool struct {
+	*keyPool[client.TextToSpeech]
+}
+
+// NewTTSPool is NewLLMPool for text-to-speech
+func NewTTSPool(name string, members []PoolMember[client.TextToSpeech], logger *zap.Logger) client.TextToSpeech {
+	if len(members) == 1 {
+		return members[0].Client
+	}
+	return &ttsPool{newKeyPool(name, members, logger)}
+}
+
+func (p *ttsPool) TextToSpeech(ctx context.Context, text string, originalText string, o ability.TTSOption) ([]byte, error) {
+	return call(ctx, p.keyPool, func(tts client.TextToSpeech) ([]byte, error) {
+		return tts.TextToSpeech(ctx, text, originalText, o)
+	})
+}
+
+func (p *ttsPool) CheckHealth(ctx context.Context) client.Health {
+	return p.checkHealth(ctx)
+}
+
+func (p *ttsPool) SetAbility(ctx context.Context, a *ability.TTSAblt) error {
+	_, err := call(ctx, p.keyPool, func(tts client.TextToSpeech) (struct{}, error) {
+		return struct{}{}, tts.SetAbility(ctx, a)
+	})
+	return err
+}
+
+func (p *ttsPool) Support(o ability.TTSOption) bool {
+	return p.members[0].Client.Support(o)
+}
+
+type sttPool struct {
+	*keyPool[client.SpeechToText]
+}
+
+// NewSTTPool is NewLLMPool for speech-to-text
+func NewSTTPool(name string, members []PoolMember[client.SpeechToText], logger *zap.Logger) client.SpeechToText {
+	if len(members) == 1 {
+		return members[0].Client
+	}
+	return &sttPool{newKeyPool(name, members, logger)}
+}
+
+func (p *sttPool) SpeechToText(ctx context.Context, audio io.Reader, fileName string, option ability.STTOption) (string, error) {
+	// audio is read again with the next credential
+	data, err := io.ReadAll(audio)
+	if err != nil {
+		return "", err
+	}
+	return call(ctx, p.keyPool, func(stt client.SpeechToText) (string, error) {
+		return stt.SpeechToText(ctx, bytes.NewReader(data), fileName, option)
+	})
+}
+
+// StreamingSpeechToText
+//
+// The next credential is not tried, since audio is consumed as it arrives, see retryingSTT.StreamingSpeechToText
+func (p *sttPool) StreamingSpeechToText(ctx context.Context, audio io.Reader, fileName string, option ability.STTOption,
+	onTranscript func(client.Transcript)) (string, error) {
+	m := p.pick(nil)
+	s, ok := m.Client.(client.StreamingSpeechToText)
+	if !ok {
+		text, err := p.SpeechToText(ctx, audio, fileName, option)
+		if err == nil && onTranscript != nil {
+			onTranscript(client.Transcript{Text: text, Final: true})
+		}
+		return text, err
+	}
+	text, err := s.StreamingSpeechToText(ctx, audio, fileName, option, onTranscript)
+	if err != nil && ctx.Err() == nil {
+		p.report(m, err)
+	}
+	return text, err
+}
+
+func (p *sttPool) CheckHealth(ctx context.Context) client.Health {
+	return p.checkHealth(ctx)
+}
+
+func (p *sttPool) SetAbility(ctx context.Context, a *ability.STTAblt) error {
+	_, err := call(ctx, p.keyPool, func(stt client.SpeechToText) (struct{}, error) {
+		return struct{}{}, stt.SetAbility(ctx, a)
+	})
+	return err
+}
+
+func (p *sttPool) Support(o ability.STTOption) bool {
+	return p.members[0].Client.Support(o)
+}
@@ -0,0 +1,292 @@
+package providers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/proxoar/talk/pkg/ability"
+	"github.com/proxoar/talk/pkg/client"
+	"go.uber.org/zap"
+)
+
+// fakeTTS replies to each call as fakeLLM does, with text as audio
+type fakeTTS struct {
+	fakeLLM
+}
+
+func (f *fakeTTS) TextToSpeech(ctx context.Context, _ string, _ string, _ ability.TTSOption) ([]byte, error) {
+	r := f.next()
+	if !sleep(ctx, r.delay) {
+		return nil, ctx.Err()
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return []byte(r.text), nil
+}
+
+func (f *fakeTTS) SetAbility(_ context.Context, _ *ability.TTSAblt) error {
+	return nil
+}
+
+func (f *fakeTTS) Support(_ ability.TTSOption) bool {
+	return true
+}
+
+// newFakeLLMPool returns a pool of a fake client for each of replies, whose keys are a, b, c and so on
+func newFakeLLMPool(replies ...[]fakeReply) (*llmPool, []*fakeLLM) {
+	var members []PoolMember[client.LLM]
+	var fakes []*fakeLLM
+	for i, r := range replies {
+		f := &fakeLLM{replies: r}
+		members = append(members, PoolMember[client.LLM]{Key: string(rune('a' + i)), Client: f})
+		fakes = append(fakes, f)
+	}
+	return NewLLMPool("fake", members, zap.NewNop()).(*llmPool), fakes
+}
+
+func TestLLMPool(t *testing.T) {
+	tooMany := statusError(http.StatusTooManyRequests, "")
+	tests := []struct {
+		name    string
+		replies [][]fakeReply
+		// want is the text or the status code of the error of each call
+		want      []any
+		wantCalls []int
+	}{
+		{
+			name:      "round-robin",
+			replies:   [][]fakeReply{{{text: "a"}}, {{text: "b"}}, {{text: "c"}}},
+			want:      []any{"a", "b", "c", "a"},
+			wantCalls: []int{2, 1, 1},
+		},
+		{
+			name:      "cooldown on 429",
+			replies:   [][]fakeReply{{{text: "a", err: tooMany}}, {{text: "b"}}, {{text: "c"}}},
+			want:      []any{"b", "c", "b"},
+			wantCalls: []int{1, 2, 1},
+		},
+		{
+			name:      "cooldown on 401",
+			replies:   [][]fakeReply{{{text: "a", err: statusError(http.StatusUnauthorized, "")}}, {{text: "b"}}},
+			want:      []any{"b", "b"},
+			wantCalls: []int{1, 2},
+		},
+		{
+			name:      "cooldown on 403",
+			replies:   [][]fakeReply{{{text: "a", err: statusError(http.StatusForbidden, "")}}, {{text: "b"}}},
+			want:      []any{"b", "b"},
+			wantCalls: []int{1, 2},
+		},
+		{
+			name:      "no cooldown on other errors",
+			replies:   [][]fakeReply{{{text: "a", err: statusError(http.StatusBadRequest, "")}}, {{text: "b"}}},
+			want:      []any{http.StatusBadRequest, "b", http.StatusBadRequest},
+			wantCalls: []int{2, 1},
+		},
+		{
+			name:      "all cooling down",
+			replies:   [][]fakeReply{{{text: "a", err: tooMany}}, {{text: "b", err: tooMany}}},
+			want:      []any{http.StatusTooManyRequests, http.StatusTooManyRequests},
+			wantCalls: []int{2, 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, fakes := newFakeLLMPool(tt.replies...)
+			for i, want := range tt.want {
+				got, err := p.Completion(context.Background(), nil, ability.LLMOption{})
+				checkPoolCall(t, i, got, err, want)
+			}
+			checkPoolCalls(t, p, fakes, tt.wantCalls)
+		})
+	}
+}
+
+func TestLLMPoolStream(t *testing.T) {
+	tooMany := statusError(http.StatusTooManyRequests, "")
+	tests := []struct {
+		name      string
+		replies   [][]fakeReply
+		want      any
+		wantCalls []int
+	}{
+		{
+			name:      "next credential before first content",
+			replies:   [][]fakeReply{{{err: tooMany}}, {{text: "b"}}},
+			want:      "b",
+			wantCalls: []int{1, 1},
+		},
+		{
+			name:      "no failover once content has streamed",
+			replies:   [][]fakeReply{{{text: "a", err: tooMany}}, {{text: "b"}}},
+			want:      http.StatusTooManyRequests,
+			wantCalls: []int{1, 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, fakes := newFakeLLMPool(tt.replies...)
+			got, err := recvAll(p.CompletionStream(context.Background(), nil, ability.LLMOption{}))
+			checkPoolCall(t, 0, got, err, tt.want)
+			checkPoolCalls(t, p, fakes, tt.wantCalls)
+		})
+	}
+}
+
+func TestTTSPool(t *testing.T) {
+	a := &fakeTTS{fakeLLM{replies: []fakeReply{{text: "a", err: statusError(http.StatusTooManyRequests, "")}}}}
+	b := &fakeTTS{fakeLLM{replies: []fakeReply{{text: "b"}}}}
+	p := NewTTSPool("fake", []PoolMember[client.TextToSpeech]{{Key: "a", Client: a}, {Key: "b", Client: b}}, zap.NewNop())
+	for i, want := range []string{"b", "b"} {
+		got, err := p.TextToSpeech(context.Background(), "hi", "hi", ability.TTSOption{})
+		checkPoolCall(t, i, string(got), err, want)
+	}
+	if a.callCount() != 1 || b.callCount() != 2 {
+		t.Errorf("called %d and %d times, want 1 and 2", a.callCount(), b.callCount())
+	}
+}
+
+func TestKeyPoolReport(t *testing.T) {
+	tests := []struct {
+		name         string
+		err          error
+		wantCooldown time.Duration
+		wantOk       bool
+	}{
+		{name: "rate limited", err: statusError(http.StatusTooManyRequests, ""), wantCooldown: rateLimitCooldown, wantOk: true},
+		{name: "Retry-After", err: statusError(http.StatusTooManyRequests, "5"), wantCooldown: 5 * time.Second, wantOk: true},
+		{name: "Retry-After of 0", err: statusError(http.StatusTooManyRequests, "0"), wantCooldown: rateLimitCooldown, wantOk: true},
+		{name: "unauthorized", err: statusError(http.StatusUnauthorized, ""), wantCooldown: authCooldown, wantOk: true},
+		{name: "server error", err: statusError(http.StatusInternalServerError, "")},
+		{name: "canceled", err: context.Canceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _ := newFakeLLMPool([]fakeReply{{text: "a"}}, []fakeReply{{text: "b"}})
+			m := p.members[0]
+			before := time.Now()
+			if ok := p.report(m, tt.err); ok != tt.wantOk {
+				t.Fatalf("report() = %v, want %v", ok, tt.wantOk)
+			}
+			if !tt.wantOk {
+				if !m.cooldownUntil.IsZero() {
+					t.Errorf("cooldownUntil = %v, want none", m.cooldownUntil)
+				}
+				return
+			}
+			if d := m.cooldownUntil.Sub(before); d < tt.wantCooldown || d > tt.wantCooldown+time.Second {
+				t.Errorf("cooldown = %v, want %v", d, tt.wantCooldown)
+			}
+			if got := p.pick(nil); got != p.members[1] {
+				t.Errorf("pick() = %s, want b", got.Key)
+			}
+		})
+	}
+}
+
+// TestLLMPoolOpenAI drives go-openai clients through withRetryAfter, whose errors are wrapped by net/http
+func TestLLMPoolOpenAI(t *testing.T) {
+	var throttled atomic.Int32
+	a := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		throttled.Add(1)
+		w.Header().Set("Retry-After", "30")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusTooManyRequests)
+		_, _ = w.Write([]byte(`{"error":{"message":"Rate limit reached","type":"requests"}}`))
+	}))
+	defer a.Close()
+	b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+			w.Header().Set("Content-Type", "text/event-stream")
+			_, _ = w.Write([]byte("data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"b\"}}]}\n\ndata: [DONE]\n\n"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"choices":[{"index":0,"message":{"role":"assistant","content":"b"},"finish_reason":"stop"}]}`))
+	}))
+	defer b.Close()
+	o := ability.LLMOption{OpenAICompatible: &ability.OpenAICompatibleOption{
+		Endpoint: "local", ChatGPTOption: ability.ChatGPTOption{Model: "llama3"}}}
+
+	tests := []struct {
+		name string
+		call func(p *llmPool) (string, error)
+	}{
+		{name: "Completion", call: func(p *llmPool) (string, error) {
+			return p.Completion(context.Background(), nil, o)
+		}},
+		{name: "CompletionStream", call: func(p *llmPool) (string, error) {
+			return recvAll(p.CompletionStream(context.Background(), nil, o))
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			throttled.Store(0)
+			p := NewLLMPool("local", []PoolMember[client.LLM]{
+				{Key: "a", Client: NewOpenAICompatible("local", a.URL, "", nil, zap.NewNop())},
+				{Key: "b", Client: NewOpenAICompatible("local", b.URL, "", nil, zap.NewNop())},
+			}, zap.NewNop()).(*llmPool)
+			before := time.Now()
+			for i, want := range []string{"b", "b"} {
+				got, err := tt.call(p)
+				checkPoolCall(t, i, got, err, want)
+			}
+			if throttled.Load() != 1 {
+				t.Errorf("a is called %d times, want 1", throttled.Load())
+			}
+			if d := p.members[0].cooldownUntil.Sub(before); d < 30*time.Second || d > 31*time.Second {
+				t.Errorf("cooldown of a = %v, want Retry-After of 30s", d)
+			}
+		})
+	}
+}
+
+func TestKeyPoolPick(t *testing.T) {
+	p, _ := newFakeLLMPool([]fakeReply{{text: "a"}}, []fakeReply{{text: "b"}}, []fakeReply{{text: "c"}})
+	tooMany := statusError(http.StatusTooManyRequests, "")
+	for _, m := range p.members {
+		p.report(m, tooMany)
+	}
+	// the one throttled the longest ago is used once all are cooling down
+	if got := p.pick(nil); got.Key != "a" {
+		t.Errorf("pick() = %s, want a", got.Key)
+	}
+	p.report(p.members[0], tooMany)
+	if got := p.pick(nil); got.Key != "b" {
+		t.Errorf("pick() = %s, want b", got.Key)
+	}
+	// members that have been tried are skipped even if they cooled down the longest ago
+	if got := p.pick(map[*poolMember[client.LLM]]bool{p.members[1]: true}); got.Key != "c" {
+		t.Errorf("pick() = %s, want c", got.Key)
+	}
+}
+
+// checkPoolCall checks the result of the i-th call, want is the text or the status code of the error
+func checkPoolCall(t *testing.T, i int, got string, err error, want any) {
+	t.Helper()
+	switch want := want.(type) {
+	case string:
+		if err != nil || got != want {
+			t.Errorf("call %d = %q, %v, want %q, nil", i, got, err, want)
+		}
+	case int:
+		if code := StatusCode(err); code != want {
+			t.Errorf("call %d error = %v, want status %d", i, err, want)
+		}
+	}
+}
+
+func checkPoolCalls(t *testing.T, p *llmPool, fakes []*fakeLLM, want []int) {
+	t.Helper()
+	for i, f := range fakes {
+		if f.callCount() != want[i] {
+			t.Errorf("%s is called %d times, want %d", p.members[i].Key, f.callCount(), want[i])
+		}
+	}
+}
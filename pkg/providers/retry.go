@@ -0,0 +1,271 @@
+package providers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"time"
+
+	"github.com/proxoar/talk/pkg/ability"
+	"github.com/proxoar/talk/pkg/client"
+	"github.com/proxoar/talk/pkg/util"
+	"go.uber.org/zap"
+)
+
+// RetryPolicy
+// retries calls that fail with a retryable error, see IsRetryable, with exponential backoff and jitter
+type RetryPolicy struct {
+	// MaxAttempts includes the first attempt, there is no retry if it's less than 2
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Timeout limits each attempt, there is no limit if it's 0.
+	// For CompletionStream, it limits the time until the first content arrives.
+	Timeout time.Duration
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: 500 * time.Millisecond,
+		MaxBackoff:     10 * time.Second,
+		Timeout:        time.Minute,
+	}
+}
+
+// backoff returns how long to wait before the next attempt, or false if it should not retry.
+//
+// Retry-After is honoured. If the server asks to wait longer than MaxBackoff, it gives up
+// so that the message can be served by another provider in the fallback chain instead.
+func (p RetryPolicy) backoff(attempt int, err error) (time.Duration, bool) {
+	if attempt >= p.MaxAttempts || !IsRetryable(err) {
+		return 0, false
+	}
+	if d, ok := RetryAfter(err); ok {
+		return d, d <= p.MaxBackoff
+	}
+	d := p.InitialBackoff << (attempt - 1)
+	if d <= 0 || d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	// full jitter keeps concurrent clients from retrying at the same moment
+	return d/2 + rand.N(d/2+1), true
+}
+
+var errAttemptTimeout = fmt.Errorf("attempt timed out: %w", context.DeadlineExceeded)
+
+// attemptContext
+// returns a context that is cancelled with errAttemptTimeout once the timeout of policy elapses,
+// unless stop is called before that.
+func (p RetryPolicy) attemptContext(ctx context.Context) (attemptCtx context.Context, cancel context.CancelFunc, stop func()) {
+	attemptCtx, cancelCause := context.WithCancelCause(ctx)
+	cancel = func() { cancelCause(context.Canceled) }
+	if p.Timeout <= 0 {
+		return attemptCtx, cancel, func() {}
+	}
+	timer := time.AfterFunc(p.Timeout, func() { cancelCause(errAttemptTimeout) })
+	return attemptCtx, cancel, func() { timer.Stop() }
+}
+
+// attemptError replaces the error caused by cancelling attemptCtx, which providers usually report as
+// context.Canceled, with errAttemptTimeout, so that it is retryable
+func attemptError(ctx, attemptCtx context.Context, err error) error {
+	if ctx.Err() == nil && errors.Is(context.Cause(attemptCtx), errAttemptTimeout) {
+		return fmt.Errorf("%w: %v", errAttemptTimeout, err)
+	}
+	return err
+}
+
+// sleep returns false if ctx is done before d elapses
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// retry calls f until it succeeds, the error isn't retryable, or attempts run out
+func retry[T any](ctx context.Context, p RetryPolicy, name string, logger *zap.Logger, f func(ctx context.Context) (T, error)) (T, error) {
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel, stop := p.attemptContext(ctx)
+		v, err := f(attemptCtx)
+		stop()
+		err = attemptError(ctx, attemptCtx, err)
+		cancel()
+		if err == nil {
+			return v, nil
+		}
+		d, ok := p.backoff(attempt, err)
+		if !ok {
+			return v, err
+		}
+		logger.Sugar().Warnf("[%s] attempt %d failed, retry in %s: %v", name, attempt, d, err)
+		if !sleep(ctx, d) {
+			return v, err
+		}
+	}
+}
+
+type retryingLLM struct {
+	llm    client.LLM
+	name   string
+	policy RetryPolicy
+	logger *zap.Logger
+}
+
+// NewRetryingLLM
+// retries Completion and the connection of CompletionStream of llm according to policy
+func NewRetryingLLM(llm client.LLM, name string, policy RetryPolicy, logger *zap.Logger) client.LLM {
+	return &retryingLLM{llm: llm, name: name, policy: policy, logger: logger}
+}
+
+func (r *retryingLLM) Completion(ctx context.Context, ms []client.Message, t ability.LLMOption) (string, error) {
+	return retry(ctx, r.policy, r.name, r.logger, func(ctx context.Context) (string, error) {
+		return r.llm.Completion(ctx, ms, t)
+	})
+}
+
+// CompletionStream
+//
+// An attempt is retried only if it fails before any content arrives, since content that has been
+// forwarded may have reached client.
+func (r *retryingLLM) CompletionStream(ctx context.Context, ms []client.Message, t ability.LLMOption) *util.SmoothStream {
+	stream := util.NewSmoothStream()
+	go func() {
+		for attempt := 1; ; attempt++ {
+			attemptCtx, cancel, stop := r.policy.attemptContext(ctx)
+			inner := r.llm.CompletionStream(attemptCtx, ms, t)
+			data, err := inner.RecvRaw()
+			stop()
+			if err != nil {
+				err = attemptError(ctx, attemptCtx, err)
+				cancel()
+				if errors.Is(err, io.EOF) {
+					stream.WriteError(err)
+					return
+				}
+				d, ok := r.policy.backoff(attempt, err)
+				if !ok {
+					stream.WriteError(err)
+					return
+				}
+				r.logger.Sugar().Warnf("[%s] attempt %d failed, retry in %s: %v", r.name, attempt, d, err)
+				if !sleep(ctx, d) {
+					stream.WriteError(err)
+					return
+				}
+				continue
+			}
+
+			// content has arrived, forward the rest without retrying
+			for err == nil {
+				stream.Write(data)
+				data, err = inner.RecvRaw()
+			}
+			stream.WriteError(err)
+			cancel()
+			return
+		}
+	}()
+	return stream
+}
+
+func (r *retryingLLM) CheckHealth(ctx context.Context) client.Health {
+	return r.llm.CheckHealth(ctx)
+}
+
+func (r *retryingLLM) SetAbility(ctx context.Context, a *ability.LLMAblt) error {
+	return r.llm.SetAbility(ctx, a)
+}
+
+func (r *retryingLLM) Support(o ability.LLMOption) bool {
+	return r.llm.Support(o)
+}
+
+type retryingTTS struct {
+	tts    client.TextToSpeech
+	name   string
+	policy RetryPolicy
+	logger *zap.Logger
+}
+
+// NewRetryingTTS retries TextToSpeech of tts according to policy
+func NewRetryingTTS(tts client.TextToSpeech, name string, policy RetryPolicy, logger *zap.Logger) client.TextToSpeech {
+	return &retryingTTS{tts: tts, name: name, policy: policy, logger: logger}
+}
+
+func (r *retryingTTS) TextToSpeech(ctx context.Context, text string, originalText string, o ability.TTSOption) ([]byte, error) {
+	return retry(ctx, r.policy, r.name, r.logger, func(ctx context.Context) ([]byte, error) {
+		return r.tts.TextToSpeech(ctx, text, originalText, o)
+	})
+}
+
+func (r *retryingTTS) CheckHealth(ctx context.Context) client.Health {
+	return r.tts.CheckHealth(ctx)
+}
+
+func (r *retryingTTS) SetAbility(ctx context.Context, a *ability.TTSAblt) error {
+	return r.tts.SetAbility(ctx, a)
+}
+
+func (r *retryingTTS) Support(o ability.TTSOption) bool {
+	return r.tts.Support(o)
+}
+
+type retryingSTT struct {
+	stt    client.SpeechToText
+	name   string
+	policy RetryPolicy
+	logger *zap.Logger
+}
+
+// NewRetryingSTT retries SpeechToText of stt according to policy
+func NewRetryingSTT(stt client.SpeechToText, name string, policy RetryPolicy, logger *zap.Logger) client.StreamingSpeechToText {
+	return &retryingSTT{stt: stt, name: name, policy: policy, logger: logger}
+}
+
+func (r *retryingSTT) SpeechToText(ctx context.Context, audio io.Reader, fileName string, option ability.STTOption) (string, error) {
+	// audio is read again by each attempt
+	data, err := io.ReadAll(audio)
+	if err != nil {
+		return "", err
+	}
+	return retry(ctx, r.policy, r.name, r.logger, func(ctx context.Context) (string, error) {
+		return r.stt.SpeechToText(ctx, bytes.NewReader(data), fileName, option)
+	})
+}
+
+// StreamingSpeechToText
+//
+// Streaming transcription is not retried, since audio is consumed as it arrives and can't be read again by
+// another attempt.
+func (r *retryingSTT) StreamingSpeechToText(ctx context.Context, audio io.Reader, fileName string, option ability.STTOption,
+	onTranscript func(client.Transcript)) (string, error) {
+	if s, ok := r.stt.(client.StreamingSpeechToText); ok {
+		return s.StreamingSpeechToText(ctx, audio, fileName, option, onTranscript)
+	}
+	text, err := r.SpeechToText(ctx, audio, fileName, option)
+	if err == nil && onTranscript != nil {
+		onTranscript(client.Transcript{Text: text, Final: true})
+	}
+	return text, err
+}
+
+func (r *retryingSTT) CheckHealth(ctx context.Context) client.Health {
+	return r.stt.CheckHealth(ctx)
+}
+
+func (r *retryingSTT) SetAbility(ctx context.Context, a *ability.STTAblt) error {
+	return r.stt.SetAbility(ctx, a)
+}
+
+func (r *retryingSTT) Support(o ability.STTOption) bool {
+	return r.stt.Support(o)
+}
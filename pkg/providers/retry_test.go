@@ -0,0 +1,278 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/proxoar/talk/pkg/ability"
+	"github.com/proxoar/talk/pkg/client"
+	"github.com/proxoar/talk/pkg/util"
+	"go.uber.org/zap"
+)
+
+// fakeReply is what a fake client replies to a call
+type fakeReply struct {
+	// text is streamed rune by rune by CompletionStream
+	text string
+	// err is returned after text
+	err error
+	// delay is waited before text, unless ctx is done
+	delay time.Duration
+}
+
+// fakeLLM replies to each call with the next of replies, and repeats the last one once they run out
+type fakeLLM struct {
+	mu      sync.Mutex
+	replies []fakeReply
+	calls   int
+}
+
+func (f *fakeLLM) next() fakeReply {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	return f.replies[min(f.calls, len(f.replies))-1]
+}
+
+func (f *fakeLLM) callCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls
+}
+
+func (f *fakeLLM) Completion(ctx context.Context, _ []client.Message, _ ability.LLMOption) (string, error) {
+	r := f.next()
+	if !sleep(ctx, r.delay) {
+		return "", ctx.Err()
+	}
+	if r.err != nil {
+		return "", r.err
+	}
+	return r.text, nil
+}
+
+func (f *fakeLLM) CompletionStream(ctx context.Context, _ []client.Message, _ ability.LLMOption) *util.SmoothStream {
+	r := f.next()
+	stream := util.NewSmoothStream()
+	go func() {
+		if !sleep(ctx, r.delay) {
+			stream.WriteError(ctx.Err())
+			return
+		}
+		for _, c := range r.text {
+			stream.Write(c)
+		}
+		stream.WriteError(cmpErr(r.err, io.EOF))
+	}()
+	return stream
+}
+
+func (f *fakeLLM) CheckHealth(_ context.Context) client.Health {
+	return client.Healthy()
+}
+
+func (f *fakeLLM) SetAbility(_ context.Context, _ *ability.LLMAblt) error {
+	return nil
+}
+
+func (f *fakeLLM) Support(_ ability.LLMOption) bool {
+	return true
+}
+
+func cmpErr(err, fallback error) error {
+	if err != nil {
+		return err
+	}
+	return fallback
+}
+
+// recvAll reads stream until it ends, and returns the text along with the error other than io.EOF
+func recvAll(stream *util.SmoothStream) (string, error) {
+	var sb strings.Builder
+	for {
+		r, err := stream.RecvRaw()
+		if errors.Is(err, io.EOF) {
+			return sb.String(), nil
+		}
+		if err != nil {
+			return sb.String(), err
+		}
+		sb.WriteRune(r)
+	}
+}
+
+func statusError(code int, retryAfter string) error {
+	header := http.Header{}
+	if retryAfter != "" {
+		header.Set("Retry-After", retryAfter)
+	}
+	return &HTTPStatusError{StatusCode: code, Status: http.StatusText(code), Header: header}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 10, InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	tests := []struct {
+		name    string
+		attempt int
+		err     error
+		wantMin time.Duration
+		wantMax time.Duration
+		wantOk  bool
+	}{
+		{name: "first retry", attempt: 1, err: statusError(http.StatusBadGateway, ""),
+			wantMin: 50 * time.Millisecond, wantMax: 100 * time.Millisecond, wantOk: true},
+		{name: "exponential", attempt: 3, err: statusError(http.StatusBadGateway, ""),
+			wantMin: 200 * time.Millisecond, wantMax: 400 * time.Millisecond, wantOk: true},
+		{name: "capped by MaxBackoff", attempt: 5, err: statusError(http.StatusBadGateway, ""),
+			wantMin: 500 * time.Millisecond, wantMax: time.Second, wantOk: true},
+		{name: "Retry-After", attempt: 1, err: statusError(http.StatusTooManyRequests, "1"),
+			wantMin: time.Second, wantMax: time.Second, wantOk: true},
+		{name: "Retry-After beyond MaxBackoff", attempt: 1, err: statusError(http.StatusTooManyRequests, "30")},
+		{name: "attempts run out", attempt: 10, err: statusError(http.StatusBadGateway, "")},
+		{name: "not retryable", attempt: 1, err: statusError(http.StatusBadRequest, "")},
+		{name: "canceled", attempt: 1, err: context.Canceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seen := map[time.Duration]bool{}
+			for i := 0; i < 100; i++ {
+				d, ok := p.backoff(tt.attempt, tt.err)
+				if ok != tt.wantOk {
+					t.Fatalf("backoff() ok = %v, want %v", ok, tt.wantOk)
+				}
+				if ok && (d < tt.wantMin || d > tt.wantMax) {
+					t.Fatalf("backoff() = %v, want between %v and %v", d, tt.wantMin, tt.wantMax)
+				}
+				seen[d] = true
+			}
+			// jitter spreads backoff over the range, while Retry-After is honoured as is
+			if jitter := tt.wantMin < tt.wantMax; jitter && len(seen) < 2 {
+				t.Errorf("backoff() = %v every time, want jitter", seen)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		value  string
+		want   time.Duration
+		wantOk bool
+	}{
+		{name: "empty", value: ""},
+		{name: "seconds", value: "120", want: 2 * time.Minute, wantOk: true},
+		{name: "zero", value: "0", want: 0, wantOk: true},
+		{name: "negative", value: "-1"},
+		{name: "date", value: now.Add(30 * time.Second).Format(http.TimeFormat), want: 30 * time.Second, wantOk: true},
+		{name: "past date", value: now.Add(-time.Minute).Format(http.TimeFormat), want: 0, wantOk: true},
+		{name: "malformed", value: "soon"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseRetryAfter(tt.value, now)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("parseRetryAfter(%q) = %v, %v, want %v, %v", tt.value, got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestRetryingLLM(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond, Timeout: 50 * time.Millisecond}
+	unavailable := statusError(http.StatusServiceUnavailable, "")
+	tests := []struct {
+		name      string
+		replies   []fakeReply
+		want      string
+		wantErr   error
+		wantCalls int
+	}{
+		{name: "succeeds at once", replies: []fakeReply{{text: "hi"}}, want: "hi", wantCalls: 1},
+		{name: "succeeds after retries", replies: []fakeReply{{err: unavailable}, {err: unavailable}, {text: "hi"}},
+			want: "hi", wantCalls: 3},
+		{name: "attempts run out", replies: []fakeReply{{err: unavailable}}, wantErr: unavailable, wantCalls: 3},
+		{name: "not retryable", replies: []fakeReply{{err: statusError(http.StatusUnauthorized, "")}, {text: "hi"}},
+			wantErr: statusError(http.StatusUnauthorized, ""), wantCalls: 1},
+		{name: "attempt times out", replies: []fakeReply{{text: "late", delay: time.Second}, {text: "hi"}},
+			want: "hi", wantCalls: 2},
+		{name: "every attempt times out", replies: []fakeReply{{text: "late", delay: time.Second}},
+			wantErr: context.DeadlineExceeded, wantCalls: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+"/Completion", func(t *testing.T) {
+			llm := &fakeLLM{replies: tt.replies}
+			got, err := NewRetryingLLM(llm, "fake", p, zap.NewNop()).Completion(context.Background(), nil, ability.LLMOption{})
+			checkRetry(t, got, err, llm.callCount(), tt.want, tt.wantErr, tt.wantCalls)
+		})
+		t.Run(tt.name+"/CompletionStream", func(t *testing.T) {
+			llm := &fakeLLM{replies: tt.replies}
+			got, err := recvAll(NewRetryingLLM(llm, "fake", p, zap.NewNop()).CompletionStream(context.Background(), nil, ability.LLMOption{}))
+			checkRetry(t, got, err, llm.callCount(), tt.want, tt.wantErr, tt.wantCalls)
+		})
+	}
+
+	t.Run("no retry once content has streamed", func(t *testing.T) {
+		llm := &fakeLLM{replies: []fakeReply{{text: "he", err: unavailable}, {text: "hello"}}}
+		got, err := recvAll(NewRetryingLLM(llm, "fake", p, zap.NewNop()).CompletionStream(context.Background(), nil, ability.LLMOption{}))
+		checkRetry(t, got, err, llm.callCount(), "he", unavailable, 1)
+	})
+
+	t.Run("streaming longer than Timeout", func(t *testing.T) {
+		// Timeout only limits the time until the first content
+		llm := &slowStreamLLM{fakeLLM: &fakeLLM{replies: []fakeReply{{text: "hello world"}}}, interval: 10 * time.Millisecond}
+		got, err := recvAll(NewRetryingLLM(llm, "fake", p, zap.NewNop()).CompletionStream(context.Background(), nil, ability.LLMOption{}))
+		checkRetry(t, got, err, llm.callCount(), "hello world", nil, 1)
+	})
+}
+
+// slowStreamLLM streams each rune after interval, and stops with ctx.Err() if ctx is done
+type slowStreamLLM struct {
+	*fakeLLM
+	interval time.Duration
+}
+
+func (s *slowStreamLLM) CompletionStream(ctx context.Context, _ []client.Message, _ ability.LLMOption) *util.SmoothStream {
+	r := s.next()
+	stream := util.NewSmoothStream()
+	go func() {
+		for _, c := range r.text {
+			stream.Write(c)
+			if !sleep(ctx, s.interval) {
+				stream.WriteError(ctx.Err())
+				return
+			}
+		}
+		stream.WriteError(io.EOF)
+	}()
+	return stream
+}
+
+func checkRetry(t *testing.T, got string, err error, calls int, want string, wantErr error, wantCalls int) {
+	t.Helper()
+	switch {
+	case wantErr == nil:
+		if err != nil {
+			t.Errorf("error = %v, want nil", err)
+		}
+	case StatusCode(wantErr) != 0:
+		if StatusCode(err) != StatusCode(wantErr) {
+			t.Errorf("error = %v, want %v", err, wantErr)
+		}
+	case !errors.Is(err, wantErr):
+		t.Errorf("error = %v, want %v", err, wantErr)
+	}
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if calls != wantCalls {
+		t.Errorf("called %d times, want %d", calls, wantCalls)
+	}
+}
@@ -0,0 +1,24 @@
+package providers
+
+import (
+	"context"
+	"io"
+
+	"github.com/proxoar/talk/pkg/ability"
+	"github.com/proxoar/talk/pkg/client"
+)
+
+// StreamSpeechToText
+// transcribes audio as it arrives if stt implements client.StreamingSpeechToText.
+// Otherwise, it waits for the whole audio, and onTranscript is called once with the final transcription.
+func StreamSpeechToText(ctx context.Context, stt client.SpeechToText, audio io.Reader, fileName string,
+	option ability.STTOption, onTranscript func(client.Transcript)) (string, error) {
+	if s, ok := stt.(client.StreamingSpeechToText); ok {
+		return s.StreamingSpeechToText(ctx, audio, fileName, option, onTranscript)
+	}
+	text, err := stt.SpeechToText(ctx, audio, fileName, option)
+	if err == nil && onTranscript != nil {
+		onTranscript(client.Transcript{Text: text, Final: true})
+	}
+	return text, err
+}
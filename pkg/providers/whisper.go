@@ -3,6 +3,7 @@ package providers
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"sort"
 	"strings"
@@ -16,12 +17,14 @@ import (
 
 type whisper struct {
 	client *openai.Client
-	logger *zap.Logger
+	// deployments is non-nil for Azure OpenAI, which serves deployments rather than models
+	deployments []AzureDeployment
+	logger      *zap.Logger
 }
 
 func NewWhisper(apiKey string, logger *zap.Logger) client.SpeechToText {
 	// by default, the underlying http.client utilizes the proxy from the environment.
-	c := openai.NewClient(apiKey)
+	c := openai.NewClientWithConfig(withRetryAfter(openai.DefaultConfig(apiKey)))
 
 	return &whisper{
 		client: c,
@@ -29,19 +32,44 @@ func NewWhisper(apiKey string, logger *zap.Logger) client.SpeechToText {
 	}
 }
 
-func (w *whisper) CheckHealth(_ context.Context) {
+// NewAzureWhisper creates a client for Azure OpenAI. Deployments are listed as models.
+func NewAzureWhisper(endpoint, apiVersion, apiKey string, deployments []AzureDeployment, logger *zap.Logger) client.SpeechToText {
+	c := openai.NewClientWithConfig(newAzureConfig(apiKey, endpoint, apiVersion, deployments))
+
+	if deployments == nil {
+		deployments = []AzureDeployment{}
+	}
+	return &whisper{
+		client:      c,
+		deployments: deployments,
+		logger:      logger,
+	}
+}
+
+func (w *whisper) CheckHealth(ctx context.Context) client.Health {
 	voice, fileName, err := resource.HelloVoice()
+	if err != nil {
+		return client.Unhealthy("failed to read hello voice: %v", err)
+	}
 	o := ability.STTOption{
 		Whisper: &ability.WhisperOption{Model: openai.Whisper1},
 	}
-	trans, err := w.SpeechToText(context.Background(), voice, fileName, o)
+	if w.isAzure() {
+		names := azureDeploymentNames(w.deployments)
+		if len(names) == 0 {
+			return client.Unhealthy("found no deployment")
+		}
+		o = ability.STTOption{
+			AzureWhisper: &ability.WhisperOption{Model: names[0]},
+		}
+	}
+	trans, err := w.SpeechToText(ctx, voice, fileName, o)
 	if err != nil {
-		w.logger.Sugar().Errorf("[Whisper] failed to get response from server: %+v", err)
+		return client.Unhealthy("failed to get response from server: %v", err)
 	} else if !strings.Contains(strings.ToLower(trans), "hello") {
-		w.logger.Warn(`[Whisper] bad smell: transcription from Whisper server does not contains "hello"`)
-	} else {
-		w.logger.Info("[Whisper]  is healthy")
+		return client.Degraded(`transcription from server does not contain "hello"`)
 	}
+	return client.Healthy()
 }
 
 func (w *whisper) Quota(_ context.Context) (used, total int, err error) {
@@ -51,12 +79,16 @@ func (w *whisper) Quota(_ context.Context) (used, total int, err error) {
 
 func (w *whisper) SpeechToText(ctx context.Context, audio io.Reader, fileName string, option ability.STTOption) (string, error) {
 	w.logger.Sugar().Debugw("transcribe...", "fileName", fileName, "option", option)
+	o := w.option(option)
+	if o == nil {
+		return "", fmt.Errorf("client did not provide %s option", w.name())
+	}
 	// File uploads are currently limited to 25 MB and the following input file types are supported: mp3, mp4, mpeg, mpga, m4a, wav, and webm.
 	// see https://platform.openai.com/docs/guides/speech-to-text/introduction
 	resp, err := w.client.CreateTranscription(
 		ctx,
 		openai.AudioRequest{
-			Model:    option.Whisper.Model,
+			Model:    o.Model,
 			FilePath: fileName,
 			Reader:   audio,
 		},
@@ -79,10 +111,15 @@ func (w *whisper) SetAbility(ctx context.Context, a *ability.STTAblt) error {
 	if err != nil {
 		return err
 	}
-	a.Whisper = ability.WhisperSTTAb{
+	ab := ability.WhisperSTTAb{
 		Available: true,
 		Models:    models,
 	}
+	if w.isAzure() {
+		a.AzureWhisper = ab
+	} else {
+		a.Whisper = ab
+	}
 	a.Available = true
 	return nil
 }
@@ -91,11 +128,33 @@ func (w *whisper) SetAbility(ctx context.Context, a *ability.STTAblt) error {
 //
 // read ability.STTOption to check if current provider support the option
 func (w *whisper) Support(o ability.STTOption) bool {
-	return o.Whisper != nil
+	return w.option(o) != nil
+}
+
+func (w *whisper) option(o ability.STTOption) *ability.WhisperOption {
+	if w.isAzure() {
+		return o.AzureWhisper
+	}
+	return o.Whisper
+}
+
+func (w *whisper) isAzure() bool {
+	return w.deployments != nil
+}
+
+func (w *whisper) name() string {
+	if w.isAzure() {
+		return "Azure Whisper"
+	}
+	return "Whisper"
 }
 
 func (w *whisper) setModels(ctx context.Context) ([]string, error) {
 	w.logger.Info("get models...")
+	if w.isAzure() {
+		// ListModels of Azure returns base models, which can't be used without a deployment
+		return azureDeploymentNames(w.deployments), nil
+	}
 	ml, err := w.client.ListModels(ctx)
 	if err != nil {
 		return nil, err
@@ -22,7 +22,8 @@ func NewWhisperDemo(logger *zap.Logger) client.SpeechToText {
 	}
 }
 
-func (w *whisperDemo) CheckHealth(_ context.Context) {
+func (w *whisperDemo) CheckHealth(_ context.Context) client.Health {
+	return client.Healthy()
 }
 
 func (w *whisperDemo) SpeechToText(_ context.Context, _ io.Reader, fileName string, option ability.STTOption) (string, error) {
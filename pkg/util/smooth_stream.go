@@ -35,6 +35,10 @@ type SmoothStream struct {
 	done              atomic.Bool
 	remainingWhenDone atomic.Int32
 	lastRead          time.Time
+	// cancelled is closed by Cancel, after which writes are dropped and reads return cancelErr
+	cancelled  chan struct{}
+	cancelOnce sync.Once
+	cancelErr  error
 }
 
 func NewSmoothStream() *SmoothStream {
@@ -43,34 +47,53 @@ func NewSmoothStream() *SmoothStream {
 		ch:        make(chan chunk, chanCap),
 		remaining: atomic.Int32{},
 		lastRead:  time.Time{},
+		cancelled: make(chan struct{}),
 	}
 }
 
 func (stream *SmoothStream) Write(r rune) {
-	defer stream.remaining.Add(1)
-	stream.ch <- chunk{
-		Data: r,
-		Err:  nil,
+	select {
+	case stream.ch <- chunk{Data: r, Err: nil}:
+		stream.remaining.Add(1)
+	case <-stream.cancelled:
 	}
 }
 
 // WriteError
 // io.EOF or other errors
 func (stream *SmoothStream) WriteError(err error) {
-	stream.ch <- chunk{
-		Data: 0,
-		Err:  err,
+	select {
+	case stream.ch <- chunk{Data: 0, Err: err}:
+	case <-stream.cancelled:
+		// the consumer has gone, and nobody will read the error
+		return
 	}
 	stream.done.Store(true)
 	stream.remainingWhenDone.Store(stream.remaining.Load())
 	stream.Close()
 }
 
+// Cancel
+// stops the stream on behalf of the consumer, e.g. when the user aborts the request.
+// Recv returns err from now on, and the producer can keep writing without being blocked.
+// It's safe to call Cancel more than once, or after the producer has finished.
+func (stream *SmoothStream) Cancel(err error) {
+	stream.cancelOnce.Do(func() {
+		stream.cancelErr = err
+		close(stream.cancelled)
+	})
+}
+
 // Recv
 // is not safe for concurrent read.
 // Recv returns io.EOF or other errors
 func (stream *SmoothStream) Recv() (rune, error) {
-	chunk := <-stream.ch
+	var chunk chunk
+	select {
+	case chunk = <-stream.ch:
+	case <-stream.cancelled:
+		return 0, stream.cancelErr
+	}
 	if chunk.Err != nil {
 		return 0, chunk.Err
 	}
@@ -110,6 +133,23 @@ func (stream *SmoothStream) Recv() (rune, error) {
 	return chunk.Data, nil
 }
 
+// RecvRaw
+// is the same as Recv except that it returns as soon as data arrives, without regulating the speed.
+// It's used to forward a stream to another one, which regulates the speed on its own.
+func (stream *SmoothStream) RecvRaw() (rune, error) {
+	var chunk chunk
+	select {
+	case chunk = <-stream.ch:
+	case <-stream.cancelled:
+		return 0, stream.cancelErr
+	}
+	if chunk.Err != nil {
+		return 0, chunk.Err
+	}
+	stream.remaining.Add(-1)
+	return chunk.Data, nil
+}
+
 func (stream *SmoothStream) Close() {
 	close(stream.ch)
 }
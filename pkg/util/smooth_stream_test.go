@@ -0,0 +1,39 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestSmoothStreamCancel(t *testing.T) {
+	stream := NewSmoothStream()
+	stream.Write('a')
+	if r, err := stream.Recv(); err != nil || r != 'a' {
+		t.Fatalf("Recv() = %q, %v, want 'a', nil", r, err)
+	}
+
+	received := make(chan error, 1)
+	go func() {
+		_, err := stream.Recv()
+		received <- err
+	}()
+	stream.Cancel(context.Canceled)
+	select {
+	case err := <-received:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Recv() error = %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Recv() is still blocked after Cancel()")
+	}
+
+	// the producer must never be blocked or panic after the consumer has gone
+	for i := 0; i < chanCap*2; i++ {
+		stream.Write('b')
+	}
+	stream.WriteError(io.EOF)
+	stream.Cancel(context.Canceled)
+}